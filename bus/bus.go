@@ -1,10 +1,230 @@
 package bus
 
-//const debug bool = false
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const debug bool = false
 
 //Device for the bus need to implement load and store
 type Device interface {
 	// Methods signature with data types of the methods .
+	// Addresses are absolute bus addresses, sizes are given in bits.
 	Load(uint64, uint64) (uint64, error)
 	Store(uint64, uint64, uint64) error
 }
+
+//IRQLine is the interrupt line of a device. The platform hands one to every
+//device which signals interrupts, interrupt controllers implement it.
+//Lines are level triggered and must be used from the simulation goroutine.
+type IRQLine interface {
+	//Raise asserts the line, the interrupt stays pending while it is raised
+	Raise()
+	//Lower deasserts the line
+	Lower()
+}
+
+//NoIRQ is a line which is not connected to an interrupt controller
+var NoIRQ IRQLine = noIRQ{}
+
+type noIRQ struct{}
+
+func (noIRQ) Raise() {}
+func (noIRQ) Lower() {}
+
+//AccessFault is returned for accesses which hit no mapped device
+type AccessFault struct {
+	Addr  uint64
+	Size  uint64
+	Store bool
+}
+
+func (f *AccessFault) Error() string {
+	if f.Store {
+		return fmt.Sprintf("Store access fault at %#x size %d", f.Addr, f.Size)
+	}
+	return fmt.Sprintf("Load access fault at %#x size %d", f.Addr, f.Size)
+}
+
+//mapping places a device at [base, base+size)
+type mapping struct {
+	base uint64
+	size uint64
+	dev  Device
+}
+
+//Bus routes loads and stores to the device mapped at the address, it is a Device itself
+type Bus struct {
+	//mappings sorted by base address
+	mappings []mapping
+	//last is the index of the most recently used mapping
+	last int
+	//reservations maps a hart id to its LR reservation set
+	reservations map[uint64]uint64
+}
+
+//Reserver is implemented by buses which track the load reservations of
+//lr/sc, stores from any hart or device invalidate them
+type Reserver interface {
+	//Reserve registers the reservation set holding addr for hart
+	Reserve(hart uint64, addr uint64)
+	//Release drops the reservation of hart and reports if it still held addr
+	Release(hart uint64, addr uint64) bool
+}
+
+//reservationSize is the size in bytes of a naturally aligned reservation set
+const reservationSize uint64 = 8
+
+//New returns an empty bus
+func New() *Bus {
+	return &Bus{reservations: make(map[uint64]uint64)}
+}
+
+//Map registers dev for the address range [base, base+size)
+func (b *Bus) Map(base uint64, size uint64, dev Device) error {
+	if size == 0 {
+		return errors.New("Could not map device with size 0")
+	}
+	if base+size-1 < base {
+		return fmt.Errorf("Could not map device at %#x, size %#x exceeds the address space", base, size)
+	}
+	for _, m := range b.mappings {
+		if base <= m.base+m.size-1 && m.base <= base+size-1 {
+			return fmt.Errorf("Could not map device at %#x-%#x, overlaps device at %#x-%#x", base, base+size-1, m.base, m.base+m.size-1)
+		}
+	}
+	if debug {
+		fmt.Printf("BUS Map base %#x size %#x", base, size)
+		fmt.Println()
+	}
+	b.mappings = append(b.mappings, mapping{base: base, size: size, dev: dev})
+	sort.Slice(b.mappings, func(i, j int) bool { return b.mappings[i].base < b.mappings[j].base })
+	b.last = 0
+	return nil
+}
+
+//find returns the device which holds the whole access
+func (b *Bus) find(addr uint64, size uint64) Device {
+	bytes := size / 8
+	if bytes == 0 {
+		bytes = 1
+	}
+	if b.last < len(b.mappings) && b.mappings[b.last].contains(addr, bytes) {
+		return b.mappings[b.last].dev
+	}
+	i := sort.Search(len(b.mappings), func(i int) bool { return b.mappings[i].base+b.mappings[i].size-1 >= addr })
+	if i < len(b.mappings) && b.mappings[i].contains(addr, bytes) {
+		b.last = i
+		return b.mappings[i].dev
+	}
+	return nil
+}
+
+func (m *mapping) contains(addr uint64, bytes uint64) bool {
+	return addr >= m.base && bytes <= m.size && addr-m.base <= m.size-bytes
+}
+
+//Load value from the device mapped at addr
+func (b *Bus) Load(addr uint64, size uint64) (uint64, error) {
+	dev := b.find(addr, size)
+	if dev == nil {
+		return 0, &AccessFault{Addr: addr, Size: size}
+	}
+	return dev.Load(addr, size)
+}
+
+//Store value to the device mapped at addr
+func (b *Bus) Store(addr uint64, size uint64, value uint64) error {
+	dev := b.find(addr, size)
+	if dev == nil {
+		return &AccessFault{Addr: addr, Size: size, Store: true}
+	}
+	if len(b.reservations) != 0 {
+		b.invalidate(addr, size)
+	}
+	return dev.Store(addr, size, value)
+}
+
+//Reserve registers the reservation set holding addr for hart
+func (b *Bus) Reserve(hart uint64, addr uint64) {
+	b.reservations[hart] = addr &^ (reservationSize - 1)
+}
+
+//Release drops the reservation of hart and reports if it still held addr
+func (b *Bus) Release(hart uint64, addr uint64) bool {
+	set, ok := b.reservations[hart]
+	delete(b.reservations, hart)
+	return ok && set == addr&^(reservationSize-1)
+}
+
+//invalidate drops every reservation overlapping the stored bytes
+func (b *Bus) invalidate(addr uint64, size uint64) {
+	first := addr &^ (reservationSize - 1)
+	last := (addr + size/8 - 1) &^ (reservationSize - 1)
+	for hart, set := range b.reservations {
+		if set == first || set == last {
+			delete(b.reservations, hart)
+		}
+	}
+}
+
+//Peeker is implemented by devices which can be read without side effects.
+//Debuggers read through it, so they do not claim interrupts or drain FIFOs.
+type Peeker interface {
+	//Peek returns the value Load would return, leaving the device unchanged
+	Peek(addr uint64, size uint64) (uint64, error)
+}
+
+//Peek reads dev without side effects, devices which are not Peekers are refused
+func Peek(dev Device, addr uint64, size uint64) (uint64, error) {
+	if p, ok := dev.(Peeker); ok {
+		return p.Peek(addr, size)
+	}
+	return 0, fmt.Errorf("Could not read device at %#x without side effects", addr)
+}
+
+//Peek reads the device mapped at addr without side effects
+func (b *Bus) Peek(addr uint64, size uint64) (uint64, error) {
+	dev := b.find(addr, size)
+	if dev == nil {
+		return 0, &AccessFault{Addr: addr, Size: size}
+	}
+	return Peek(dev, addr, size)
+}
+
+//Zeroer is implemented by devices which can clear a range of memory at once
+type Zeroer interface {
+	//Zero clears the size bytes at addr
+	Zero(addr uint64, size uint64) error
+}
+
+//Zero clears the size bytes at addr, they must lie within a single device
+func (b *Bus) Zero(addr uint64, size uint64) error {
+	if size == 0 {
+		return nil
+	}
+	var dev Device
+	i := sort.Search(len(b.mappings), func(i int) bool { return b.mappings[i].base+b.mappings[i].size-1 >= addr })
+	if i < len(b.mappings) && b.mappings[i].contains(addr, size) {
+		dev = b.mappings[i].dev
+	}
+	if dev == nil {
+		return &AccessFault{Addr: addr, Size: 8, Store: true}
+	}
+	for hart, set := range b.reservations {
+		if set >= addr&^(reservationSize-1) && set < addr+size {
+			delete(b.reservations, hart)
+		}
+	}
+	if z, ok := dev.(Zeroer); ok {
+		return z.Zero(addr, size)
+	}
+	for end := addr + size; addr < end; addr++ {
+		if err := dev.Store(addr, 8, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
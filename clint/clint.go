@@ -0,0 +1,188 @@
+package clint
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const debug bool = false
+
+//Register offsets of the SiFive CLINT
+const (
+	msipOffset     uint64 = 0x0
+	mtimecmpOffset uint64 = 0x4000
+	mtimeOffset    uint64 = 0xbff8
+)
+
+//Size of the CLINT address space
+const Size uint64 = 0x10000
+
+//DefaultBase is where SiFive boards and the virt machine place the CLINT
+const DefaultBase uint64 = 0x2000000
+
+//Frequency of mtime in Hz in wall clock mode
+const Frequency uint64 = 10000000
+
+//wallClockPeriod is the number of ticks between reads of the host clock
+const wallClockPeriod = 64
+
+//Interrupt numbers, the bits in mip
+const (
+	irqMSIP uint = 3
+	irqMTIP uint = 7
+)
+
+//Hart is the interrupt input of a hart
+type Hart interface {
+	SetPending(irq uint, level bool)
+}
+
+//CLINT is the core local interruptor. It holds the software interrupt and
+//the timer compare register of each hart and the shared mtime.
+type CLINT struct {
+	base     uint64
+	harts    []Hart
+	msip     []uint64
+	mtimecmp []uint64
+	//mtime counts ticks, in wall clock mode it caches the host time
+	mtime     uint64
+	wallClock bool
+	start     time.Time
+	//offset is added to the host time, it is set by writes to mtime
+	offset uint64
+	ticks  uint64
+}
+
+//New returns a CLINT mapped at base. mtime advances by one per Tick, or with
+//wallClock at Frequency in host time.
+func New(base uint64, wallClock bool) *CLINT {
+	return &CLINT{
+		base:      base,
+		wallClock: wallClock,
+		start:     time.Now(),
+	}
+}
+
+//AddHart connects the next hart, harts are numbered in the order they are added
+func (c *CLINT) AddHart(h Hart) {
+	c.harts = append(c.harts, h)
+	c.msip = append(c.msip, 0)
+	//the timer does not fire before software sets it
+	c.mtimecmp = append(c.mtimecmp, ^uint64(0))
+}
+
+//Mtime returns the current value of mtime, it backs the time CSR
+func (c *CLINT) Mtime() uint64 {
+	if c.wallClock {
+		c.mtime = c.hostTime()
+	}
+	return c.mtime
+}
+
+//Tick advances mtime and updates the timer interrupts, the hart calls it
+//before every instruction
+func (c *CLINT) Tick() {
+	if c.wallClock {
+		//reading the host clock is slow, only do it now and then
+		c.ticks++
+		if c.ticks%wallClockPeriod != 0 {
+			return
+		}
+		c.mtime = c.hostTime()
+	} else {
+		c.mtime++
+	}
+	c.update()
+}
+
+//hostTime returns mtime derived from the host clock
+func (c *CLINT) hostTime() uint64 {
+	return c.offset + uint64(time.Since(c.start))/(uint64(time.Second)/Frequency)
+}
+
+//update raises MTIP of every hart whose mtimecmp has been reached and MSIP as set in msip
+func (c *CLINT) update() {
+	for i, h := range c.harts {
+		h.SetPending(irqMSIP, c.msip[i]&0x1 != 0)
+		h.SetPending(irqMTIP, c.mtime >= c.mtimecmp[i])
+	}
+}
+
+//register returns the register at offset off and its width in bytes, nil for reserved offsets
+func (c *CLINT) register(off uint64) (*uint64, uint64) {
+	switch {
+	case off < mtimecmpOffset:
+		if hart := (off - msipOffset) / 4; hart < uint64(len(c.msip)) {
+			return &c.msip[hart], 4
+		}
+	case off < mtimeOffset:
+		if hart := (off - mtimecmpOffset) / 8; hart < uint64(len(c.mtimecmp)) {
+			return &c.mtimecmp[hart], 8
+		}
+	case off < mtimeOffset+8:
+		c.Mtime()
+		return &c.mtime, 8
+	}
+	return nil, 0
+}
+
+//Peek reads like Load, the registers have no read side effects
+func (c *CLINT) Peek(addr uint64, size uint64) (uint64, error) {
+	return c.Load(addr, size)
+}
+
+//Load value
+func (c *CLINT) Load(addr uint64, size uint64) (uint64, error) {
+	if debug {
+		fmt.Println("CLINT Load addr, size", addr, size)
+	}
+	reg, width := c.register(addr - c.base)
+	if reg == nil {
+		return 0, nil
+	}
+	shift, mask, err := field(addr, size, width)
+	if err != nil {
+		return 0, err
+	}
+	return (*reg >> shift) & mask, nil
+}
+
+//Store value, 32 bit accesses reach both halves of the 64 bit registers
+func (c *CLINT) Store(addr uint64, size uint64, value uint64) error {
+	if debug {
+		fmt.Println("CLINT Store addr, size, value ", addr, size, value)
+	}
+	off := addr - c.base
+	reg, width := c.register(off)
+	if reg == nil {
+		return nil
+	}
+	shift, mask, err := field(addr, size, width)
+	if err != nil {
+		return err
+	}
+	*reg = *reg&^(mask<<shift) | (value&mask)<<shift
+	switch {
+	case off < mtimecmpOffset:
+		//only bit 0 of msip is implemented
+		*reg &= 0x1
+	case off >= mtimeOffset && c.wallClock:
+		c.offset = c.mtime - (c.hostTime() - c.offset)
+	}
+	c.update()
+	return nil
+}
+
+//field returns the position of an access of size bits within a register of width bytes
+func field(addr uint64, size uint64, width uint64) (uint64, uint64, error) {
+	offset := addr % width
+	if size > width*8 || offset%(size/8) != 0 {
+		return 0, 0, errors.New("Could not access CLINT register with this size")
+	}
+	mask := ^uint64(0)
+	if size < 64 {
+		mask = 1<<size - 1
+	}
+	return offset * 8, mask, nil
+}
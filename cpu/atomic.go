@@ -0,0 +1,157 @@
+package cpu
+
+import (
+	"errors"
+	"rvsim/bus"
+)
+
+//RV64A funct5 values, inst[31:27]
+const (
+	amoAdd  uint64 = 0x00
+	amoSwap uint64 = 0x01
+	amoLR   uint64 = 0x02
+	amoSC   uint64 = 0x03
+	amoXor  uint64 = 0x04
+	amoOr   uint64 = 0x08
+	amoAnd  uint64 = 0x0c
+	amoMin  uint64 = 0x10
+	amoMax  uint64 = 0x14
+	amoMinu uint64 = 0x18
+	amoMaxu uint64 = 0x1c
+)
+
+//executeAtomic executes lr, sc and the amo instructions of opcode 0x2f.
+//The aq and rl bits in inst[26:25] are accepted, a single hart executes
+//every access in order anyway.
+func (cpu *CPU) executeAtomic(instruction uint64, rd uint, rs1 uint, rs2 uint, funct3 uint64) error {
+	var size uint64
+	switch funct3 {
+	case 0x2:
+		size = 32
+	case 0x3:
+		size = 64
+	default:
+		return errors.New("Could not execute funct3 of instruction 0x2f")
+	}
+	funct5 := (instruction >> 27) & 0x1f
+	addr := cpu.regs[rs1]
+
+	switch funct5 {
+	case amoLR:
+		//stores reach the bus at physical addresses, so does the reservation.
+		//Misaligned lr traps even where plain loads are emulated.
+		paddr, err := cpu.physical(addr, size, accessLoad)
+		if err != nil {
+			return err
+		}
+		val, err := cpu.load(addr, size)
+		if err != nil {
+			return err
+		}
+		cpu.reserve(paddr)
+		cpu.setX(rd, signExtend(val, size))
+		return nil
+	case amoSC:
+		//a misaligned or faulting sc traps even without a reservation
+		paddr, err := cpu.physical(addr, size, accessStore)
+		if err != nil {
+			return err
+		}
+		if !cpu.release(paddr) {
+			cpu.setX(rd, 1)
+			return nil
+		}
+		err = cpu.store(addr, size, cpu.regs[rs2])
+		if err != nil {
+			return err
+		}
+		cpu.setX(rd, 0)
+		return nil
+	}
+
+	//the amo read faults like a store
+	val, err := cpu.read(addr, size, accessStore)
+	if err != nil {
+		return err
+	}
+	old := signExtend(val, size)
+	src := signExtend(cpu.regs[rs2], size)
+	var result uint64
+	switch funct5 {
+	case amoSwap:
+		result = src
+	case amoAdd:
+		result = old + src
+	case amoXor:
+		result = old ^ src
+	case amoAnd:
+		result = old & src
+	case amoOr:
+		result = old | src
+	case amoMin:
+		result = old
+		if int64(src) < int64(old) {
+			result = src
+		}
+	case amoMax:
+		result = old
+		if int64(src) > int64(old) {
+			result = src
+		}
+	case amoMinu:
+		result = old
+		if zeroExtend(src, size) < zeroExtend(old, size) {
+			result = src
+		}
+	case amoMaxu:
+		result = old
+		if zeroExtend(src, size) > zeroExtend(old, size) {
+			result = src
+		}
+	default:
+		return errors.New("Could not execute funct5 of instruction 0x2f")
+	}
+	err = cpu.store(addr, size, result)
+	if err != nil {
+		return err
+	}
+	cpu.setX(rd, old)
+	return nil
+}
+
+//reserve registers the reservation set of the physical address addr for this hart
+func (cpu *CPU) reserve(addr uint64) {
+	if r, ok := cpu.bus.(bus.Reserver); ok {
+		r.Reserve(cpu.hartID, addr)
+		return
+	}
+	cpu.reserved = true
+	cpu.reservation = addr
+}
+
+//release drops the reservation and reports if it was still held for the
+//physical address addr
+func (cpu *CPU) release(addr uint64) bool {
+	if r, ok := cpu.bus.(bus.Reserver); ok {
+		return r.Release(cpu.hartID, addr)
+	}
+	held := cpu.reserved && cpu.reservation == addr
+	cpu.reserved = false
+	return held
+}
+
+//signExtend extends a value of size bits to 64 bits
+func signExtend(value uint64, size uint64) uint64 {
+	if size == 32 {
+		return uint64(int64(int32(value)))
+	}
+	return value
+}
+
+//zeroExtend keeps the lower size bits of value
+func zeroExtend(value uint64, size uint64) uint64 {
+	if size == 32 {
+		return uint64(uint32(value))
+	}
+	return value
+}
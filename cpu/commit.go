@@ -0,0 +1,64 @@
+package cpu
+
+//Access is a load or store of an instruction
+type Access struct {
+	//Addr is the virtual address, Size the size in bits
+	Addr  uint64
+	Size  uint64
+	Value uint64
+	Store bool
+}
+
+//Write is a register written by an instruction
+type Write struct {
+	//Kind is x for integer, f for floating point registers and c for CSRs
+	Kind byte
+	//Num is the register number or the CSR address
+	Num uint64
+}
+
+//Commit describes a retired instruction
+type Commit struct {
+	//Hart is the id of the hart which executed the instruction
+	Hart uint64
+	PC   uint64
+	//Inst is the instruction as fetched, compressed ones in the lower 16 bits
+	Inst uint64
+	//Priv is the privilege level the instruction ran at
+	Priv uint64
+	//Accesses are the loads and stores of the instruction in program order
+	Accesses []Access
+	//Writes are the registers the instruction wrote, each once, including
+	//the implicit updates of fflags and mstatus. x0 is left out.
+	Writes []Write
+}
+
+//CommitHook is told about every retired instruction of hart, after its
+//results are written. The commit is reused for the next instruction.
+//Tracers follow the execution with it.
+type CommitHook func(hart *CPU, c *Commit)
+
+//SetCommitHook installs hook for the retired instructions, nil removes it.
+//Harts cloned from cpu keep the hook.
+func (cpu *CPU) SetCommitHook(hook CommitHook) {
+	cpu.commitHook = hook
+}
+
+//access records a load or store of the executing instruction for the commit hook
+func (cpu *CPU) access(addr uint64, size uint64, value uint64, store bool) {
+	cpu.commit.Accesses = append(cpu.commit.Accesses, Access{Addr: addr, Size: size, Value: value, Store: store})
+}
+
+//written records a register write of the executing instruction for the commit hook
+func (cpu *CPU) written(kind byte, num uint64) {
+	if cpu.commitHook == nil {
+		return
+	}
+	w := Write{Kind: kind, Num: num}
+	for _, seen := range cpu.commit.Writes {
+		if seen == w {
+			return
+		}
+	}
+	cpu.commit.Writes = append(cpu.commit.Writes, w)
+}
@@ -3,57 +3,177 @@ package cpu
 import (
 	"errors"
 	"fmt"
+	"io"
+	"os"
 	"rvsim/bus"
-	"rvsim/ram"
+	"rvsim/disasm"
+	"rvsim/rvc"
 )
 
 const debug bool = false
 
-//Register holds all registers of the cpu
-type register struct {
+//CPU is a single hart with its own registers, attached to a bus device
+type CPU struct {
 	//32 Bit registers
 	regs [32]uint64
+	//32 floating point registers, singles are NaN-boxed
+	fregs [32]uint64
+	//frm is the dynamic rounding mode and fflags the accrued exceptions of fcsr
+	frm    uint64
+	fflags uint8
 	//one Program Counter
 	pc uint64
-	//Add memory here for simplicity
-	ram bus.Device
+	//priv is the current privilege level
+	priv uint64
+	//mstatus is kept apart from the other CSRs, it is used all the time
+	mstatus uint64
+	//csrs holds the plain CSRs, see csrDefs
+	csrs [4096]uint64
+	//tlb caches address translations, see translate
+	tlb [tlbSize]tlbEntry
+	//pmpEntries PMP entries are implemented, pmpActive is set while one of them is on
+	pmpEntries int
+	pmpActive  bool
+	pmpcfg     [MaxPMPEntries]uint8
+	pmpaddr    [MaxPMPEntries]uint64
+	//cycle counts the clock cycles, one per instruction
+	cycle uint64
+	//time returns the value of the time CSR, nil to use the cycle counter
+	time func() uint64
+	//tick is called before every instruction
+	tick func()
+	//syscall emulates environment calls, nil for the exit convention
+	syscall func(num uint64, args [6]uint64) (uint64, error)
+	//exitConvention makes exceptions end the run instead of entering the handlers
+	exitConvention bool
+	//lastTrap is the last trap taken, trapped is set once there was one
+	lastTrap Trap
+	trapped  bool
+	//accessHook is told about loads and stores, it may be nil
+	accessHook AccessHook
+	//commitHook is told about retired instructions, it may be nil. commit
+	//collects the executing instruction for it.
+	commitHook CommitHook
+	commit     Commit
+	//irqLines holds the interrupt inputs raised by devices, as mip bits
+	irqLines uint64
+	//ilen is the length in bytes of the executing instruction, 2 for compressed ones
+	ilen uint64
+	//Memory and devices are reached through the bus
+	bus bus.Device
+	//the loaded program lives in [imageStart, imageEnd)
+	imageStart uint64
+	imageEnd   uint64
+	//maxInstructions stops the run after this many instructions, 0 for no limit
+	maxInstructions uint64
+	//retired counts the executed instructions for maxInstructions, the
+	//program cannot change it
+	retired uint64
+	//instret is the minstret counter of the program
+	instret uint64
+	//stop is set by instructions which end the run
+	stop *StopReason
+	//hartID identifies the hart on the bus
+	hartID uint64
+	//reservation of lr/sc, only used if the bus does not track reservations.
+	//Every store of the hart and every trap drop it, as stores of other bus
+	//masters cannot be seen.
+	reserved    bool
+	reservation uint64
 }
 
-var cpu register
-var prglength uint64
+//Options configure a new CPU
+type Options struct {
+	//HartID identifies the hart, 0 for single core systems
+	HartID uint64
+	//Entry is the address of the first instruction
+	Entry uint64
+	//StackPointer is the initial value of sp
+	StackPointer uint64
+	//ImageStart and ImageEnd bound the loaded program, the pc must stay
+	//within. Leave both 0 to allow the pc anywhere.
+	ImageStart uint64
+	ImageEnd   uint64
+	//MaxInstructions stops the run after this many instructions, 0 for no limit
+	MaxInstructions uint64
+	//Time returns the value of the time CSR, nil to count cycles
+	Time func() uint64
+	//Tick is called before every instruction, devices such as timers use it to
+	//advance and raise their interrupts. It may be nil.
+	Tick func()
+	//PMPEntries is the number of PMP entries, up to MaxPMPEntries
+	PMPEntries int
+	//ExitConvention makes exceptions end the run instead of entering the
+	//trap handlers of the program: ecall follows the exit convention or goes
+	//to Syscall, ebreak stops the run and other exceptions stop it with
+	//StopTrap. Interrupts the program enables are still taken. Without it the
+	//hart traps like real hardware.
+	ExitConvention bool
+	//Syscall handles the environment calls under ExitConvention in place of
+	//the exit convention. It gets the call number from a7 and the
+	//arguments from a0 to a5, the result goes to a0. Returning an *Exit ends
+	//the run with its code, other errors end it with StopError. It may be nil.
+	Syscall func(num uint64, args [6]uint64) (uint64, error)
+	//DeviceTree is the address of a device tree blob. If set the hart starts
+	//with its id in a0 and the address in a1, as firmware and kernels expect.
+	DeviceTree uint64
+}
 
-//Initialize the cpu
-func Initialize(binary []uint8) {
+//New returns a fresh cpu which executes from the given bus device
+func New(dev bus.Device, opts Options) *CPU {
 	if debug {
-		fmt.Println("CPU Initialize")
+		fmt.Println("CPU New")
 	}
-	prglength = uint64(len(binary))
-	//	var ram bus.Device
-	cpu.ram = &ram.RAM{}
-
-	//The stack pointer
-	cpu.regs[2] = ram.MemorySize
-	cpu.pc = 0
-
-	if debug {
-		fmt.Println("CPU Store Program to Memory")
+	cpu := &CPU{
+		bus:             dev,
+		pc:              opts.Entry,
+		imageStart:      opts.ImageStart,
+		imageEnd:        opts.ImageEnd,
+		maxInstructions: opts.MaxInstructions,
+		hartID:          opts.HartID,
+		time:            opts.Time,
+		tick:            opts.Tick,
+		syscall:         opts.Syscall,
+		exitConvention:  opts.ExitConvention,
+		pmpEntries:      opts.PMPEntries,
+		priv:            privMachine,
+		//the floating point unit starts in state initial
+		mstatus: mstatusUXL | mstatusSXL | 0x1<<13,
 	}
-	cpu.ram = &ram.RAM{}
-	for i := 0; i <= len(binary)-1; i++ {
-		if debug {
-			fmt.Println("CPU Store index ", i)
-		}
-		err := cpu.ram.Store(uint64(i), 8, uint64(binary[i]))
-		if err != nil {
-			fmt.Println("PANIC: could not store memory")
-			break
-		}
+	if cpu.pmpEntries > MaxPMPEntries {
+		cpu.pmpEntries = MaxPMPEntries
+	}
+	//The stack pointer
+	cpu.regs[2] = opts.StackPointer
+	//Returning from the entry function lands at the end of the image and ends the run
+	cpu.regs[1] = opts.ImageEnd
+	if opts.DeviceTree != 0 {
+		cpu.regs[10] = opts.HartID
+		cpu.regs[11] = opts.DeviceTree
 	}
+	return cpu
+}
+
+//Clone returns a new hart with the registers and CSRs of cpu, on the same bus.
+//Threads of user programs start this way.
+func (cpu *CPU) Clone(hartID uint64) *CPU {
+	c := *cpu
+	c.hartID = hartID
+	c.retired = 0
+	c.instret = 0
+	c.stop = nil
+	c.reserved = false
+	c.commit = Commit{}
+	return &c
+}
 
+//DumpRegisters dumps all registers x0-x31, with fp also f0-f31 and fcsr
+func (cpu *CPU) DumpRegisters(fp bool) {
+	cpu.WriteRegisters(os.Stdout, fp)
 }
 
-//DumpRegisters dumps all registers x0-x31
-func DumpRegisters() {
+//WriteRegisters writes the dump of DumpRegisters to w
+func (cpu *CPU) WriteRegisters(w io.Writer, fp bool) {
 	name := [32]string{
 		"zero", " ra ", " sp ", " gp ", " tp ", " t0 ", " t1 ", " t2 ",
 		" s0 ", " s1 ", " a0 ", " a1 ", " a2 ", " a3 ", " a4 ", " a5 ",
@@ -62,43 +182,88 @@ func DumpRegisters() {
 	}
 	for i := 0; i <= 31; i += 4 {
 		for j := 0; j <= 3; j++ {
-			fmt.Printf("%#.2x (%s) = %#x\t", i+j, name[i+j], cpu.regs[i+j])
+			fmt.Fprintf(w, "%#.2x (%s) = %#x\t", i+j, name[i+j], cpu.regs[i+j])
 		}
-		fmt.Println()
+		fmt.Fprintln(w)
+	}
+	if fp {
+		cpu.dumpFRegisters(w)
 	}
 }
 
 //GetPC returns the program counter
-func GetPC() uint64 {
+func (cpu *CPU) GetPC() uint64 {
 	return cpu.pc
 }
 
-//IncPC used for jump instructions
-func IncPC() {
-	if (cpu.pc) >= prglength {
-		cpu.pc = 0
-	} else {
-		cpu.pc += 4
-	}
+//IncPC moves the pc past the fetched instruction
+func (cpu *CPU) IncPC(instruction uint64) {
+	cpu.pc += instLength(instruction)
 }
 
 //SetPC used for jump instructions
-func SetPC(newPC uint64) {
+func (cpu *CPU) SetPC(newPC uint64) {
 	cpu.pc = newPC
 }
 
-//Fetch cycle
-func Fetch() (uint64, error) {
-	value, err := cpu.ram.Load(cpu.pc, 32)
+//GetReg returns the value of register x[i]
+func (cpu *CPU) GetReg(i int) uint64 {
+	if i == 0 {
+		return 0
+	}
+	return cpu.regs[i]
+}
+
+//SetReg sets register x[i], writes to x0 are ignored
+func (cpu *CPU) SetReg(i int, value uint64) {
+	if i != 0 {
+		cpu.regs[i] = value
+	}
+}
+
+//setX writes x[i], writes to x0 are not recorded
+func (cpu *CPU) setX(i uint, value uint64) {
+	cpu.regs[i] = value
+	if i != 0 {
+		cpu.written('x', uint64(i))
+	}
+}
+
+//Fetch cycle, returns a 16 bit compressed or a 32 bit instruction
+func (cpu *CPU) Fetch() (uint64, error) {
+	//Instructions are only 2 byte aligned, fetch in 16 bit parcels so a 32 bit
+	//instruction may straddle a 4 byte boundary
+	low, err := cpu.read(cpu.pc, 16, accessFetch)
+	if err != nil || low&0x3 != 0x3 {
+		return low, err
+	}
+	high, err := cpu.read(cpu.pc+2, 16, accessFetch)
+
+	return low | high<<16, err
+}
 
-	return value, err
+//instLength returns the length in bytes of an instruction
+func instLength(instruction uint64) uint64 {
+	if instruction&0x3 != 0x3 {
+		return 2
+	}
+	return 4
 }
 
-//Execute executes an instruction defined by its memory address
-func Execute(instruction uint64) error {
+//Execute executes an instruction, the pc already points past it
+func (cpu *CPU) Execute(instruction uint64) error {
 	//Simulte the zero register at x00
 	cpu.regs[0] = 0
 
+	cpu.ilen = instLength(instruction)
+	if cpu.ilen == 2 {
+		expanded, err := rvc.Expand(instruction)
+		if err != nil {
+			return err
+		}
+		instruction = expanded
+	}
+
 	opcode := instruction & 0x7f
 	rd := uint((instruction >> 7) & 0x1f)
 	rs1 := uint((instruction >> 15) & 0x1f)
@@ -106,7 +271,7 @@ func Execute(instruction uint64) error {
 	funct3 := (instruction >> 12) & 0x7
 	funct7 := (instruction >> 25) & 0x7f
 	if debug {
-		fmt.Printf("CPU DEBUG pc %x instruction %x opcode %x funct3 %x funct7 %x", cpu.pc, instruction, opcode, funct3, funct7)
+		fmt.Printf("CPU DEBUG pc %x instruction %x %s", cpu.pc-cpu.ilen, instruction, disasm.Disassemble(instruction, cpu.pc-cpu.ilen))
 		fmt.Println()
 	}
 
@@ -120,39 +285,77 @@ func Execute(instruction uint64) error {
 		switch funct3 {
 		case 0x0:
 			//lb load byte
-			val, _ := cpu.ram.Load(addr, 8)
-			cpu.regs[rd] = uint64(int64(int8((val))))
+			val, err := cpu.load(addr, 8)
+			if err != nil {
+				return err
+			}
+			cpu.setX(rd, uint64(int64(int8((val)))))
 		case 0x1:
 			//lh load half word
-			val, _ := cpu.ram.Load(addr, 16)
-			cpu.regs[rd] = uint64(int64(int16(val)))
+			val, err := cpu.load(addr, 16)
+			if err != nil {
+				return err
+			}
+			cpu.setX(rd, uint64(int64(int16(val))))
 		case 0x2:
 			//lw load word
-			val, _ := cpu.ram.Load(addr, 32)
-			cpu.regs[rd] = uint64(int64(int32(val)))
+			val, err := cpu.load(addr, 32)
+			if err != nil {
+				return err
+			}
+			cpu.setX(rd, uint64(int64(int32(val))))
 		case 0x3:
 			//ld load double word
-			val, _ := cpu.ram.Load(addr, 64)
-			cpu.regs[rd] = uint64(val)
+			val, err := cpu.load(addr, 64)
+			if err != nil {
+				return err
+			}
+			cpu.setX(rd, uint64(val))
 		case 0x4:
 			//lbu load byte unsigned
-			val, _ := cpu.ram.Load(addr, 8)
-			cpu.regs[rd] = val
+			val, err := cpu.load(addr, 8)
+			if err != nil {
+				return err
+			}
+			cpu.setX(rd, val)
 		case 0x5:
 			//lhu load half word unsigned
-			val, _ := cpu.ram.Load(addr, 16)
-			cpu.regs[rd] = val
+			val, err := cpu.load(addr, 16)
+			if err != nil {
+				return err
+			}
+			cpu.setX(rd, val)
 		case 0x6:
 			//lwu load word unsigned
-			val, _ := cpu.ram.Load(addr, 32)
-			cpu.regs[rd] = val
+			val, err := cpu.load(addr, 32)
+			if err != nil {
+				return err
+			}
+			cpu.setX(rd, val)
 		case 0x7:
 			//ldu load double word unsigned
-			val, _ := cpu.ram.Load(addr, 64)
-			cpu.regs[rd] = val
+			val, err := cpu.load(addr, 64)
+			if err != nil {
+				return err
+			}
+			cpu.setX(rd, val)
 		default:
 			return errors.New("Could not execute funct3 of instruction 0x03")
 		}
+	case 0x07:
+		//I-Type floating point loads
+		imm := uint64((int64(int32(instruction))) >> 20)
+		if !cpu.fpEnabled() {
+			return errFPDisabled
+		}
+		cpu.fpDirty()
+		return cpu.executeFLoad(cpu.regs[rs1]+imm, rd, funct3)
+	case 0x0f:
+		//fence, fence.i
+		//a single hart sees its accesses in order and fetches from memory directly
+		if funct3 > 0x1 {
+			return errors.New("Could not execute funct3 of instruction 0x0f")
+		}
 	case 0x13:
 		//I-Type
 		//imm[11:0]
@@ -163,45 +366,46 @@ func Execute(instruction uint64) error {
 		switch funct3 {
 		case 0x0:
 			//addi add immediate
-			cpu.regs[rd] = cpu.regs[rs1] + imm
+			cpu.setX(rd, cpu.regs[rs1]+imm)
 		case 0x1:
 			//slli shift left logical immediate
-			cpu.regs[rd] = cpu.regs[rs1] << shamt
+			cpu.setX(rd, cpu.regs[rs1]<<shamt)
 		case 0x2:
 			//slti set if less than
 			if (int64(cpu.regs[rs1])) < (int64(imm)) {
-				cpu.regs[rd] = 1
+				cpu.setX(rd, 1)
 			} else {
-				cpu.regs[rd] = 0
+				cpu.setX(rd, 0)
 			}
 		case 0x3:
 			//sltiu set if less than unsigned
 			if cpu.regs[rs1] < imm {
-				cpu.regs[rd] = 1
+				cpu.setX(rd, 1)
 			} else {
-				cpu.regs[rd] = 0
+				cpu.setX(rd, 0)
 			}
 		case 0x4:
 			//xori exclusive or immediate
-			cpu.regs[rd] = cpu.regs[rs1] ^ imm
+			cpu.setX(rd, cpu.regs[rs1]^imm)
 		case 0x5:
-			switch funct7 {
+			//RV64I uses inst[25] as bit 5 of shamt, decode funct6
+			switch funct7 >> 1 {
 			case 0x00:
 				//srli shift right logical immediate.
-				cpu.regs[rd] = cpu.regs[rs1] >> uint64(shamt)
+				cpu.setX(rd, cpu.regs[rs1]>>uint64(shamt))
 			case 0x10:
 				//srai shift right arithmetic immediate
-				cpu.regs[rd] = uint64(int64(cpu.regs[rs1]) >> int64(shamt))
+				cpu.setX(rd, uint64(int64(cpu.regs[rs1])>>int64(shamt)))
 			default:
 				return errors.New("Coud not execute funct7 of instruction 0x13")
 			}
 		case 0x6:
 			//ori or immediate
-			cpu.regs[rd] = cpu.regs[rs1] | imm
+			cpu.setX(rd, cpu.regs[rs1]|imm)
 
 		case 0x7:
 			//andi and immediate
-			cpu.regs[rd] = cpu.regs[rs1] & imm
+			cpu.setX(rd, cpu.regs[rs1]&imm)
 		default:
 			return errors.New("Could not execute funct3 of instruction 0x13")
 		}
@@ -210,7 +414,7 @@ func Execute(instruction uint64) error {
 		//imm[31:12]
 		imm := uint64((int64(int32(instruction & 0xfffff000))))
 		//auipc add upper immediate value to pc
-		cpu.regs[rd] = cpu.pc + imm - 4
+		cpu.setX(rd, cpu.pc+imm-cpu.ilen)
 	case 0x1b:
 		//I-Type
 		//imm[11:0], inst[31,20]
@@ -219,18 +423,18 @@ func Execute(instruction uint64) error {
 		switch funct3 {
 		case 0x0:
 			//addiw add word immediate
-			cpu.regs[rd] = uint64(int64(int32(cpu.regs[rs1] + imm)))
+			cpu.setX(rd, uint64(int64(int32(cpu.regs[rs1]+imm))))
 		case 0x1:
 			//slliw shift left logical word immediate
-			cpu.regs[rd] = uint64(int64(int32(cpu.regs[rs1])) + int64(shamt))
+			cpu.setX(rd, uint64(int64(int32(uint32(cpu.regs[rs1])<<shamt))))
 		case 0x5:
 			switch funct7 {
 			case 0x00:
 				//srliw shift right logical word immediate
-				cpu.regs[rd] = uint64(int64(int32(uint32(cpu.regs[rs1]) >> shamt)))
+				cpu.setX(rd, uint64(int64(int32(uint32(cpu.regs[rs1])>>shamt))))
 			case 0x20:
 				//sraiw shift right arithmetic word immediate
-				cpu.regs[rd] = uint64(int64(int32(cpu.regs[rs1] >> shamt)))
+				cpu.setX(rd, uint64(int64(int32(cpu.regs[rs1])>>shamt)))
 			default:
 				return errors.New("Could not execute funct7 of instruction 0x1b")
 			}
@@ -245,31 +449,41 @@ func Execute(instruction uint64) error {
 		switch funct3 {
 		case 0x0:
 			//sb
-			err := cpu.ram.Store(addr, 8, cpu.regs[rs2])
+			err := cpu.store(addr, 8, cpu.regs[rs2])
 			if err != nil {
 				return err
 			}
 		case 0x1:
 			//sh
-			err := cpu.ram.Store(addr, 16, cpu.regs[rs2])
+			err := cpu.store(addr, 16, cpu.regs[rs2])
 			if err != nil {
 				return err
 			}
 		case 0x2:
 			//sw
-			err := cpu.ram.Store(addr, 32, cpu.regs[rs2])
+			err := cpu.store(addr, 32, cpu.regs[rs2])
 			if err != nil {
 				return err
 			}
 		case 0x3:
 			//sd
-			err := cpu.ram.Store(addr, 64, cpu.regs[rs2])
+			err := cpu.store(addr, 64, cpu.regs[rs2])
 			if err != nil {
 				return err
 			}
 		default:
 			return errors.New("Could not execute funct3 of instruction 0x23")
 		}
+	case 0x27:
+		// S-Type floating point stores
+		imm := uint64((int64(int32(instruction&0xfe000000)))>>20) | ((instruction >> 7) & 0x1f)
+		if !cpu.fpEnabled() {
+			return errFPDisabled
+		}
+		return cpu.executeFStore(cpu.regs[rs1]+imm, rs2, funct3)
+	case 0x2f:
+		//R-Type atomic memory operations
+		return cpu.executeAtomic(instruction, rd, rs1, rs2, funct3)
 	case 0x33:
 		shamt := uint32(uint64(cpu.regs[rs2] & 0x3f))
 		switch funct3 {
@@ -277,13 +491,13 @@ func Execute(instruction uint64) error {
 			switch funct7 {
 			case 0x00:
 				//add
-				cpu.regs[rd] = cpu.regs[rs1] + cpu.regs[rs2]
+				cpu.setX(rd, cpu.regs[rs1]+cpu.regs[rs2])
 			case 0x01:
 				//mul
-				cpu.regs[rd] = cpu.regs[rs1] * cpu.regs[rs2]
-			case 0x02:
+				cpu.setX(rd, cpu.regs[rs1]*cpu.regs[rs2])
+			case 0x20:
 				//sub
-				cpu.regs[rd] = cpu.regs[rs1] - cpu.regs[rs2]
+				cpu.setX(rd, cpu.regs[rs1]-cpu.regs[rs2])
 			default:
 				return errors.New("Could not execute funct7 of funct3 0x0 of instruction 0x33")
 			}
@@ -291,7 +505,10 @@ func Execute(instruction uint64) error {
 			switch funct7 {
 			case 0x00:
 				//sll
-				cpu.regs[rd] = cpu.regs[rs1] << (shamt)
+				cpu.setX(rd, cpu.regs[rs1]<<(shamt))
+			case 0x01:
+				//mulh multiply high signed signed
+				cpu.setX(rd, mulh(cpu.regs[rs1], cpu.regs[rs2]))
 			default:
 				return errors.New("Could not execute funct7 of funct3 of 0x1 instruction 0x33")
 			}
@@ -300,10 +517,13 @@ func Execute(instruction uint64) error {
 			case 0x00:
 				//slt
 				if int64(cpu.regs[rs1]) < int64(cpu.regs[rs2]) {
-					cpu.regs[rd] = 1
+					cpu.setX(rd, 1)
 				} else {
-					cpu.regs[rd] = 0
+					cpu.setX(rd, 0)
 				}
+			case 0x01:
+				//mulhsu multiply high signed unsigned
+				cpu.setX(rd, mulhsu(cpu.regs[rs1], cpu.regs[rs2]))
 			default:
 				return errors.New("Could not execute funct7 of funct3 of 0x2 instruction 0x33")
 			}
@@ -312,10 +532,13 @@ func Execute(instruction uint64) error {
 			case 0x00:
 				//sltu
 				if cpu.regs[rs1] < cpu.regs[rs2] {
-					cpu.regs[rd] = 1
+					cpu.setX(rd, 1)
 				} else {
-					cpu.regs[rd] = 0
+					cpu.setX(rd, 0)
 				}
+			case 0x01:
+				//mulhu multiply high unsigned unsigned
+				cpu.setX(rd, mulhu(cpu.regs[rs1], cpu.regs[rs2]))
 			default:
 				return errors.New("Could not execute funct7 of funct3 of 0x3 instruction 0x33")
 			}
@@ -323,7 +546,10 @@ func Execute(instruction uint64) error {
 			switch funct7 {
 			case 0x00:
 				//xor
-				cpu.regs[rd] = cpu.regs[rs1] ^ cpu.regs[rs2]
+				cpu.setX(rd, cpu.regs[rs1]^cpu.regs[rs2])
+			case 0x01:
+				//div
+				cpu.setX(rd, div(cpu.regs[rs1], cpu.regs[rs2]))
 			default:
 				return errors.New("Could not execute funct7 of funct3 of 0x4 instruction 0x33")
 			}
@@ -331,10 +557,13 @@ func Execute(instruction uint64) error {
 			switch funct7 {
 			case 0x00:
 				//srl
-				cpu.regs[rd] = cpu.regs[rs1] >> (shamt)
+				cpu.setX(rd, cpu.regs[rs1]>>(shamt))
 			case 0x20:
 				//sra
-				cpu.regs[rd] = uint64(int64(cpu.regs[rs1]) >> (shamt))
+				cpu.setX(rd, uint64(int64(cpu.regs[rs1])>>(shamt)))
+			case 0x01:
+				//divu divide unsigned
+				cpu.setX(rd, divu(cpu.regs[rs1], cpu.regs[rs2]))
 			default:
 				return errors.New("Could not execute funct7 of funct3 of 0x5 instruction 0x33")
 			}
@@ -342,7 +571,10 @@ func Execute(instruction uint64) error {
 			switch funct7 {
 			case 0x00:
 				//or
-				cpu.regs[rd] = cpu.regs[rs1] | cpu.regs[rs2]
+				cpu.setX(rd, cpu.regs[rs1]|cpu.regs[rs2])
+			case 0x01:
+				//rem remainder
+				cpu.setX(rd, rem(cpu.regs[rs1], cpu.regs[rs2]))
 			default:
 				return errors.New("Could not execute funct7 of funct3 of 0x6 instruction 0x33")
 			}
@@ -350,7 +582,10 @@ func Execute(instruction uint64) error {
 			switch funct7 {
 			case 0x00:
 				//and
-				cpu.regs[rd] = cpu.regs[rs1] & cpu.regs[rs2]
+				cpu.setX(rd, cpu.regs[rs1]&cpu.regs[rs2])
+			case 0x01:
+				//remu remainder unsigned
+				cpu.setX(rd, remu(cpu.regs[rs1], cpu.regs[rs2]))
 			default:
 				return errors.New("Could not execute funct7 of funct3 of 0x7 instruction 0x33")
 			}
@@ -359,7 +594,7 @@ func Execute(instruction uint64) error {
 		}
 	case 0x37:
 		//lui
-		cpu.regs[rd] = uint64(int64(int32((instruction & 0xfffff000))))
+		cpu.setX(rd, uint64(int64(int32((instruction & 0xfffff000)))))
 	case 0x3b:
 		shamt := uint32(cpu.regs[rs2] & 0x1f)
 		switch funct3 {
@@ -367,10 +602,13 @@ func Execute(instruction uint64) error {
 			switch funct7 {
 			case 0x00:
 				//addw
-				cpu.regs[rd] = uint64(int64(int32(cpu.regs[rs1] + cpu.regs[rs2])))
+				cpu.setX(rd, uint64(int64(int32(cpu.regs[rs1]+cpu.regs[rs2]))))
+			case 0x01:
+				//mulw multiply word
+				cpu.setX(rd, uint64(int64(int32(cpu.regs[rs1]*cpu.regs[rs2]))))
 			case 0x20:
 				//subw
-				cpu.regs[rd] = uint64(int32(cpu.regs[rs1] - cpu.regs[rs2]))
+				cpu.setX(rd, uint64(int32(cpu.regs[rs1]-cpu.regs[rs2])))
 			default:
 				return errors.New("Could not execute funct7 of funct3 of 0x0 instruction 0x3b")
 			}
@@ -378,24 +616,65 @@ func Execute(instruction uint64) error {
 			switch funct7 {
 			case 0x00:
 				//sllw
-				cpu.regs[rd] = uint64(int32(uint32(cpu.regs[rs1]) << (shamt)))
+				cpu.setX(rd, uint64(int32(uint32(cpu.regs[rs1])<<(shamt))))
 			default:
 				return errors.New("Could not execute funct7 of funct3 of 0x1 instruction 0x3b")
 			}
 		case 0x5:
 			switch funct7 {
 			case 0x00:
-				//slrw
-				cpu.regs[rd] = uint64(int32(uint32(cpu.regs[rs1]) >> (shamt)))
+				//srlw
+				cpu.setX(rd, uint64(int32(uint32(cpu.regs[rs1])>>(shamt))))
 			case 0x20:
 				//sraw
-				cpu.regs[rd] = uint64(uint32(cpu.regs[rs1]) >> int32((shamt)))
+				cpu.setX(rd, uint64(int32(cpu.regs[rs1])>>(shamt)))
+			case 0x01:
+				//divuw divide unsigned word
+				cpu.setX(rd, divuw(cpu.regs[rs1], cpu.regs[rs2]))
 			default:
 				return errors.New("Could not execute funct7 of funct3 of 0x5 instruction 0x3b")
 			}
+		case 0x4:
+			switch funct7 {
+			case 0x01:
+				//divw divide word
+				cpu.setX(rd, divw(cpu.regs[rs1], cpu.regs[rs2]))
+			default:
+				return errors.New("Could not execute funct7 of funct3 of 0x4 instruction 0x3b")
+			}
+		case 0x6:
+			switch funct7 {
+			case 0x01:
+				//remw remainder word
+				cpu.setX(rd, remw(cpu.regs[rs1], cpu.regs[rs2]))
+			default:
+				return errors.New("Could not execute funct7 of funct3 of 0x6 instruction 0x3b")
+			}
+		case 0x7:
+			switch funct7 {
+			case 0x01:
+				//remuw remainder unsigned word
+				cpu.setX(rd, remuw(cpu.regs[rs1], cpu.regs[rs2]))
+			default:
+				return errors.New("Could not execute funct7 of funct3 of 0x7 instruction 0x3b")
+			}
 		default:
 			return errors.New("Could not execute funct3 of instruction 0x3b")
 		}
+	case 0x43, 0x47, 0x4b, 0x4f:
+		// R4-Type fused multiply add
+		if !cpu.fpEnabled() {
+			return errFPDisabled
+		}
+		cpu.fpDirty()
+		return cpu.executeFMA(instruction, opcode, rd, rs1, rs2, funct3)
+	case 0x53:
+		// R-Type floating point operations
+		if !cpu.fpEnabled() {
+			return errFPDisabled
+		}
+		cpu.fpDirty()
+		return cpu.executeFP(instruction, rd, rs1, rs2, funct3, funct7)
 	case 0x63:
 		// B-Type
 		// imm[12|10:5|4:1|11]
@@ -408,50 +687,88 @@ func Execute(instruction uint64) error {
 				fmt.Println()
 			}
 			if cpu.regs[rs1] == cpu.regs[rs2] {
-				cpu.pc = cpu.pc + imm - 4
+				cpu.pc = cpu.pc + imm - cpu.ilen
 			}
 		case 0x1:
 			//bne
 			if cpu.regs[rs1] != cpu.regs[rs2] {
-				cpu.pc = cpu.pc + imm - 4
+				cpu.pc = cpu.pc + imm - cpu.ilen
 			}
 		case 0x4:
 			//blt
 			if int64(cpu.regs[rs1]) < int64(cpu.regs[rs2]) {
-				cpu.pc = cpu.pc + imm - 4
+				cpu.pc = cpu.pc + imm - cpu.ilen
 			}
 		case 0x5:
 			//bge
 			if int64(cpu.regs[rs1]) >= int64(cpu.regs[rs2]) {
-				cpu.pc = cpu.pc + imm - 4
+				cpu.pc = cpu.pc + imm - cpu.ilen
 			}
 		case 0x6:
 			//bltu
 			if cpu.regs[rs1] < cpu.regs[rs2] {
-				cpu.pc = cpu.pc + imm - 4
+				cpu.pc = cpu.pc + imm - cpu.ilen
 			}
 		case 0x7:
 			//bgeu
 			if cpu.regs[rs1] >= cpu.regs[rs2] {
-				cpu.pc = cpu.pc + imm - 4
+				cpu.pc = cpu.pc + imm - cpu.ilen
 			}
 		default:
 			return errors.New("Could not execute funct3 of instruction 0x63")
 		}
 	case 0x67:
-		//jal
+		//jalr
 		// Don'd add 4 to t because pc already moved
 		t := cpu.pc
 		imm := uint64(int64(int32((instruction & 0xfff00000))) >> 20)
-		cpu.pc = (cpu.regs[rs1] + imm)
-		cpu.regs[rd] = t
+		cpu.pc = (cpu.regs[rs1] + imm) &^ 1
+		cpu.setX(rd, t)
+	case 0x73:
+		//I-Type
+		imm := (instruction >> 20) & 0xfff
+		switch funct3 {
+		case 0x0:
+			if funct7 == 0x09 {
+				//sfence.vma
+				return cpu.sfenceVMA(rs1, rs2)
+			}
+			switch imm {
+			case 0x0:
+				//ecall
+				return cpu.ecall()
+			case 0x1:
+				//ebreak
+				if cpu.trapsHalt() {
+					cpu.stop = &StopReason{Kind: StopBreak}
+					return nil
+				}
+				return &Exception{Cause: causeBreakpoint, Tval: cpu.pc - cpu.ilen}
+			case 0x102:
+				//sret
+				return cpu.sret()
+			case 0x105:
+				//wfi
+				return cpu.wfi()
+			case 0x302:
+				//mret
+				return cpu.mret()
+			default:
+				return errors.New("Could not execute imm of funct3 0x0 of instruction 0x73")
+			}
+		case 0x1, 0x2, 0x3, 0x5, 0x6, 0x7:
+			//csrrw, csrrs, csrrc, csrrwi, csrrsi, csrrci
+			return cpu.executeCSR(instruction, rd, rs1, funct3)
+		default:
+			return errors.New("Could not execute funct3 of instruction 0x73")
+		}
 	case 0x6f:
 		//jal
-		cpu.regs[rd] = cpu.pc
+		cpu.setX(rd, cpu.pc)
 
 		// imm[20|10:1|11|19:12]
 		imm := uint64((int64(int32(instruction&0x80000000)))>>11) | (instruction & 0xff000) | ((instruction >> 9) & 0x800) | ((instruction >> 20) & 0x7fe)
-		cpu.pc = cpu.pc + imm - 4
+		cpu.pc = cpu.pc + imm - cpu.ilen
 	default:
 		return errors.New("Could not execute instruction. Function not yet implementd")
 	}
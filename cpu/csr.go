@@ -0,0 +1,361 @@
+package cpu
+
+import (
+	"errors"
+	"fmt"
+)
+
+//Privilege levels
+const (
+	privUser       uint64 = 0
+	privSupervisor uint64 = 1
+	privMachine    uint64 = 3
+)
+
+//CSR addresses
+const (
+	csrFflags        uint64 = 0x001
+	csrFrm           uint64 = 0x002
+	csrFcsr          uint64 = 0x003
+	csrSstatus       uint64 = 0x100
+	csrSie           uint64 = 0x104
+	csrStvec         uint64 = 0x105
+	csrScounteren    uint64 = 0x106
+	csrSscratch      uint64 = 0x140
+	csrSepc          uint64 = 0x141
+	csrScause        uint64 = 0x142
+	csrStval         uint64 = 0x143
+	csrSip           uint64 = 0x144
+	csrSatp          uint64 = 0x180
+	csrCycle         uint64 = 0xc00
+	csrTime          uint64 = 0xc01
+	csrInstret       uint64 = 0xc02
+	csrHpmcounter3   uint64 = 0xc03
+	csrHpmcounter31  uint64 = 0xc1f
+	csrMvendorid     uint64 = 0xf11
+	csrMarchid       uint64 = 0xf12
+	csrMimpid        uint64 = 0xf13
+	csrMhartid       uint64 = 0xf14
+	csrMconfigptr    uint64 = 0xf15
+	csrMstatus       uint64 = 0x300
+	csrMisa          uint64 = 0x301
+	csrMedeleg       uint64 = 0x302
+	csrMideleg       uint64 = 0x303
+	csrMie           uint64 = 0x304
+	csrMcounteren    uint64 = 0x306
+	csrMcountinhibit uint64 = 0x320
+	csrMhpmevent3    uint64 = 0x323
+	csrMhpmevent31   uint64 = 0x33f
+	csrMtvec         uint64 = 0x305
+	csrMscratch      uint64 = 0x340
+	csrMepc          uint64 = 0x341
+	csrMcause        uint64 = 0x342
+	csrMtval         uint64 = 0x343
+	csrMip           uint64 = 0x344
+	csrMcycle        uint64 = 0xb00
+	csrMinstret      uint64 = 0xb02
+	csrMhpmcounter3  uint64 = 0xb03
+	csrMhpmcounter31 uint64 = 0xb1f
+)
+
+//mstatus fields
+const (
+	mstatusSIE  uint64 = 1 << 1
+	mstatusMIE  uint64 = 1 << 3
+	mstatusSPIE uint64 = 1 << 5
+	mstatusMPIE uint64 = 1 << 7
+	mstatusSPP  uint64 = 1 << 8
+	mstatusMPP  uint64 = 0x3 << 11
+	mstatusFS   uint64 = 0x3 << 13
+	mstatusMPRV uint64 = 1 << 17
+	mstatusSUM  uint64 = 1 << 18
+	mstatusMXR  uint64 = 1 << 19
+	mstatusTVM  uint64 = 1 << 20
+	mstatusTW   uint64 = 1 << 21
+	mstatusTSR  uint64 = 1 << 22
+	//UXL and SXL are fixed to 64 bit
+	mstatusUXL uint64 = 0x2 << 32
+	mstatusSXL uint64 = 0x2 << 34
+	mstatusSD  uint64 = 1 << 63
+)
+
+//mstatusMask selects the writable bits of mstatus
+const mstatusMask uint64 = mstatusSIE | mstatusMIE | mstatusSPIE | mstatusMPIE | mstatusSPP | mstatusMPP | mstatusFS |
+	mstatusMPRV | mstatusSUM | mstatusMXR | mstatusTVM | mstatusTW | mstatusTSR
+
+//sstatusMask selects the bits of mstatus visible in sstatus
+const sstatusMask uint64 = mstatusSIE | mstatusSPIE | mstatusSPP | mstatusFS | mstatusSUM | mstatusMXR
+
+//Interrupt pending and enable bits of mip and mie
+const (
+	mipSSIP uint64 = 1 << 1
+	mipMSIP uint64 = 1 << 3
+	mipSTIP uint64 = 1 << 5
+	mipMTIP uint64 = 1 << 7
+	mipSEIP uint64 = 1 << 9
+	mipMEIP uint64 = 1 << 11
+)
+
+//medelegMask selects the exceptions which can be delegated, all but ecall from M-mode
+const medelegMask uint64 = 0xb3ff
+
+//midelegMask selects the supervisor interrupts, which can be delegated
+const midelegMask uint64 = mipSSIP | mipSTIP | mipSEIP
+
+//satp modes
+const (
+	satpBare uint64 = 0
+	satpSv39 uint64 = 8
+	satpSv48 uint64 = 9
+)
+
+//misa reports RV64 with the implemented extensions, it is not writable
+const misa uint64 = 2<<62 | 1<<('A'-'A') | 1<<('C'-'A') | 1<<('D'-'A') | 1<<('F'-'A') | 1<<('I'-'A') | 1<<('M'-'A') |
+	1<<('S'-'A') | 1<<('U'-'A')
+
+var errIllegalCSR = errors.New("Illegal CSR access")
+
+//csrDef describes a CSR. Plain CSRs live in cpu.csrs and only the bits in
+//mask can be written, the others keep their value (WARL). read and write
+//replace the plain storage for CSRs which are views of other state.
+type csrDef struct {
+	mask  uint64
+	read  func(cpu *CPU) uint64
+	write func(cpu *CPU, value uint64)
+}
+
+//csrReadOnly is used for CSRs which have a fixed value
+func csrReadOnly(value uint64) csrDef {
+	return csrDef{read: func(cpu *CPU) uint64 { return value }}
+}
+
+//csrZero is used for CSRs which read as zero and ignore writes
+var csrZero = csrDef{}
+
+var csrDefs = map[uint64]csrDef{
+	csrFflags: {
+		read:  func(cpu *CPU) uint64 { return uint64(cpu.fflags) },
+		write: func(cpu *CPU, value uint64) { cpu.fflags = uint8(value & 0x1f) },
+	},
+	csrFrm: {
+		read:  func(cpu *CPU) uint64 { return cpu.frm },
+		write: func(cpu *CPU, value uint64) { cpu.frm = value & 0x7 },
+	},
+	csrFcsr: {
+		read: func(cpu *CPU) uint64 { return cpu.frm<<5 | uint64(cpu.fflags) },
+		write: func(cpu *CPU, value uint64) {
+			cpu.frm = (value >> 5) & 0x7
+			cpu.fflags = uint8(value & 0x1f)
+		},
+	},
+	csrCycle:   {read: func(cpu *CPU) uint64 { return cpu.cycle }},
+	csrTime:    {read: func(cpu *CPU) uint64 { return cpu.now() }},
+	csrInstret: {read: func(cpu *CPU) uint64 { return cpu.instret }},
+	csrMcycle: {
+		read:  func(cpu *CPU) uint64 { return cpu.cycle },
+		write: func(cpu *CPU, value uint64) { cpu.cycle = value },
+	},
+	csrMinstret: {
+		read:  func(cpu *CPU) uint64 { return cpu.instret },
+		write: func(cpu *CPU, value uint64) { cpu.instret = value },
+	},
+	csrMcountinhibit: csrZero,
+	csrMvendorid:     csrReadOnly(0),
+	csrMarchid:       csrReadOnly(0),
+	csrMimpid:        csrReadOnly(0),
+	csrMhartid:       {read: func(cpu *CPU) uint64 { return cpu.hartID }},
+	csrMconfigptr:    csrReadOnly(0),
+	csrMstatus: {
+		read:  func(cpu *CPU) uint64 { return cpu.readMstatus() },
+		write: func(cpu *CPU, value uint64) { cpu.writeMstatus(value, mstatusMask) },
+	},
+	csrSstatus: {
+		read:  func(cpu *CPU) uint64 { return cpu.readMstatus() & (sstatusMask | mstatusUXL | mstatusSD) },
+		write: func(cpu *CPU, value uint64) { cpu.writeMstatus(value, sstatusMask) },
+	},
+	csrMisa: csrReadOnly(misa),
+	//mtvec modes 2 and 3 are reserved, they fall back to direct and vectored
+	csrMtvec:    {mask: ^uint64(0x2)},
+	csrMscratch: {mask: ^uint64(0)},
+	//instructions are 2 byte aligned, mepc[0] is always zero
+	csrMepc:       {mask: ^uint64(0x1)},
+	csrMcause:     {mask: ^uint64(0)},
+	csrMtval:      {mask: ^uint64(0)},
+	csrMedeleg:    {mask: medelegMask},
+	csrMideleg:    {mask: midelegMask},
+	csrMie:        {mask: midelegMask | mipMSIP | mipMTIP | mipMEIP},
+	csrMcounteren: {mask: 0xffffffff},
+	csrStvec:      {mask: ^uint64(0x2)},
+	csrSscratch:   {mask: ^uint64(0)},
+	csrSepc:       {mask: ^uint64(0x1)},
+	csrScause:     {mask: ^uint64(0)},
+	csrStval:      {mask: ^uint64(0)},
+	csrScounteren: {mask: 0xffffffff},
+	//the interrupt inputs show up in mip, software writes the supervisor bits
+	csrMip: {
+		read:  func(cpu *CPU) uint64 { return cpu.readMip() },
+		write: func(cpu *CPU, value uint64) { cpu.writeMasked(csrMip, value, midelegMask) },
+	},
+	//sie and sip show the delegated interrupts of mie and mip
+	csrSie: {
+		read:  func(cpu *CPU) uint64 { return cpu.csrs[csrMie] & cpu.csrs[csrMideleg] },
+		write: func(cpu *CPU, value uint64) { cpu.writeMasked(csrMie, value, cpu.csrs[csrMideleg]) },
+	},
+	csrSip: {
+		read:  func(cpu *CPU) uint64 { return cpu.readMip() & cpu.csrs[csrMideleg] },
+		write: func(cpu *CPU, value uint64) { cpu.writeMasked(csrMip, value, cpu.csrs[csrMideleg]&mipSSIP) },
+	},
+	//writes of unsupported modes are ignored
+	csrSatp: {
+		write: func(cpu *CPU, value uint64) {
+			switch value >> 60 {
+			case satpBare, satpSv39, satpSv48:
+				cpu.csrs[csrSatp] = value
+			}
+		},
+	},
+}
+
+func init() {
+	//the hardware performance monitor is not implemented, its counters read as zero
+	for i := uint64(0); i <= csrHpmcounter31-csrHpmcounter3; i++ {
+		csrDefs[csrHpmcounter3+i] = csrZero
+		csrDefs[csrMhpmcounter3+i] = csrZero
+		csrDefs[csrMhpmevent3+i] = csrZero
+	}
+}
+
+//readMstatus returns mstatus with the summary dirty bit
+func (cpu *CPU) readMstatus() uint64 {
+	if cpu.mstatus&mstatusFS == mstatusFS {
+		return cpu.mstatus | mstatusSD
+	}
+	return cpu.mstatus
+}
+
+//writeMstatus writes the bits of mstatus selected by mask. MPP holds no
+//reserved privilege, a write of 2 keeps the old mode.
+func (cpu *CPU) writeMstatus(value uint64, mask uint64) {
+	if (value&mstatusMPP)>>11 == 0x2 {
+		value = value&^mstatusMPP | cpu.mstatus&mstatusMPP
+	}
+	cpu.mstatus = cpu.mstatus&^mask | value&mask
+}
+
+//writeMasked writes the bits of a plain CSR selected by mask
+func (cpu *CPU) writeMasked(addr uint64, value uint64, mask uint64) {
+	cpu.csrs[addr] = cpu.csrs[addr]&^mask | value&mask
+}
+
+//fpEnabled reports whether mstatus.FS allows floating point instructions
+func (cpu *CPU) fpEnabled() bool {
+	return cpu.mstatus&mstatusFS != 0
+}
+
+//fpDirty marks the floating point state as modified
+func (cpu *CPU) fpDirty() {
+	if cpu.mstatus&mstatusFS == mstatusFS {
+		return
+	}
+	cpu.mstatus |= mstatusFS
+	cpu.written('c', csrMstatus)
+}
+
+//now returns the value of the time CSR
+func (cpu *CPU) now() uint64 {
+	if cpu.time != nil {
+		return cpu.time()
+	}
+	return cpu.cycle
+}
+
+//csrAccess checks that the CSR exists and may be accessed at the current privilege
+func (cpu *CPU) csrAccess(addr uint64, write bool) (csrDef, error) {
+	def, ok := csrDefs[addr]
+	if !ok {
+		return def, errIllegalCSR
+	}
+	//csr[9:8] is the lowest privilege allowed, csr[11:10] == 3 marks read only
+	if (addr>>8)&0x3 > cpu.priv {
+		return def, errIllegalCSR
+	}
+	if write && (addr>>10)&0x3 == 0x3 {
+		return def, errIllegalCSR
+	}
+	if addr <= csrFcsr && !cpu.fpEnabled() {
+		return def, errIllegalCSR
+	}
+	//below machine mode the counters need their bit in mcounteren, user mode also in scounteren
+	if addr >= csrCycle && addr <= csrHpmcounter31 {
+		bit := uint64(1) << (addr - csrCycle)
+		if cpu.priv < privMachine && cpu.csrs[csrMcounteren]&bit == 0 {
+			return def, errIllegalCSR
+		}
+		if cpu.priv == privUser && cpu.csrs[csrScounteren]&bit == 0 {
+			return def, errIllegalCSR
+		}
+	}
+	//mstatus.TVM traps satp accesses in supervisor mode
+	if addr == csrSatp && cpu.priv == privSupervisor && cpu.mstatus&mstatusTVM != 0 {
+		return def, errIllegalCSR
+	}
+	return def, nil
+}
+
+//readCSR returns the value of a CSR
+func (cpu *CPU) readCSR(addr uint64, def csrDef) uint64 {
+	if def.read != nil {
+		return def.read(cpu)
+	}
+	return cpu.csrs[addr]
+}
+
+//writeCSR writes the value of a CSR
+func (cpu *CPU) writeCSR(addr uint64, def csrDef, value uint64) {
+	if addr <= csrFcsr {
+		cpu.fpDirty()
+	}
+	cpu.written('c', addr)
+	if def.write != nil {
+		def.write(cpu, value)
+		return
+	}
+	cpu.writeMasked(addr, value, def.mask)
+}
+
+//executeCSR executes the Zicsr instructions of opcode 0x73
+func (cpu *CPU) executeCSR(instruction uint64, rd uint, rs1 uint, funct3 uint64) error {
+	addr := (instruction >> 20) & 0xfff
+	//the immediate forms use the rs1 field as 5 bit zero extended value
+	src := uint64(rs1)
+	if funct3 < 0x4 {
+		src = cpu.regs[rs1]
+	}
+	//csrrw skips the read for rd x0, csrrs and csrrc skip the write for rs1 x0
+	read := rd != 0 || funct3&0x3 != 0x1
+	write := funct3&0x3 == 0x1 || rs1 != 0
+
+	def, err := cpu.csrAccess(addr, write)
+	if err != nil {
+		return fmt.Errorf("%v %#x", err, addr)
+	}
+	var old uint64
+	if read {
+		old = cpu.readCSR(addr, def)
+	}
+	if write {
+		switch funct3 & 0x3 {
+		case 0x1:
+			//csrrw, csrrwi
+			cpu.writeCSR(addr, def, src)
+		case 0x2:
+			//csrrs, csrrsi
+			cpu.writeCSR(addr, def, old|src)
+		case 0x3:
+			//csrrc, csrrci
+			cpu.writeCSR(addr, def, old&^src)
+		}
+	}
+	cpu.setX(rd, old)
+	return nil
+}
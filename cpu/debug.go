@@ -0,0 +1,80 @@
+package cpu
+
+//AccessHook is told about every load and store of the program once it
+//succeeded, with its virtual address, its size in bits and the value.
+//Debuggers and tracers watch memory with it.
+type AccessHook func(addr uint64, size uint64, value uint64, store bool)
+
+//SetAccessHook installs hook for the loads and stores, nil removes it
+func (cpu *CPU) SetAccessHook(hook AccessHook) {
+	cpu.accessHook = hook
+}
+
+//GetFReg returns the raw value of register f[i], singles are NaN-boxed
+func (cpu *CPU) GetFReg(i int) uint64 {
+	return cpu.fregs[i]
+}
+
+//SetFReg sets register f[i] to a raw value
+func (cpu *CPU) SetFReg(i int, value uint64) {
+	cpu.fregs[i] = value
+}
+
+//Priv returns the current privilege level, 0 user, 1 supervisor and 3 machine
+func (cpu *CPU) Priv() uint64 {
+	return cpu.priv
+}
+
+//SetPriv changes the privilege level, reserved levels are ignored
+func (cpu *CPU) SetPriv(priv uint64) {
+	switch priv {
+	case privUser, privSupervisor, privMachine:
+		cpu.priv = priv
+	}
+}
+
+//GetCSR returns the value of the CSR at addr as a debugger sees it, the
+//privilege checks of the instructions do not apply. ok is false for CSRs
+//which are not implemented.
+func (cpu *CPU) GetCSR(addr uint64) (value uint64, ok bool) {
+	def, ok := csrDefs[addr]
+	if !ok {
+		return 0, false
+	}
+	return cpu.readCSR(addr, def), true
+}
+
+//SetCSR writes the CSR at addr like GetCSR reads it, read only CSRs ignore
+//the write. It reports if the CSR is implemented.
+func (cpu *CPU) SetCSR(addr uint64, value uint64) bool {
+	def, ok := csrDefs[addr]
+	if !ok {
+		return false
+	}
+	if def.write != nil || def.mask != 0 {
+		cpu.writeCSR(addr, def, value)
+	}
+	return true
+}
+
+//Translate returns the physical address the hart reaches at the virtual
+//address addr, with its fetches if fetch is set and with its loads and
+//stores otherwise. The walk ignores the permissions, sets no A or D bits and
+//raises no exceptions, ok is false if addr is not mapped. Debuggers see the
+//memory of the program with it.
+func (cpu *CPU) Translate(addr uint64, fetch bool) (paddr uint64, ok bool) {
+	kind := accessLoad
+	if fetch {
+		kind = accessFetch
+	}
+	satp := cpu.csrs[csrSatp]
+	if cpu.accessPriv(kind) == privMachine || satp>>60 == satpBare {
+		return addr, true
+	}
+	pte, _, level, _, err := cpu.lookup(addr, kind, satp)
+	if err != nil {
+		return 0, false
+	}
+	pages := uint64(1)<<(12+9*level) - 1
+	return ((pte>>10)&ppnMask)<<12&^pages | addr&pages, true
+}
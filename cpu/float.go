@@ -0,0 +1,312 @@
+package cpu
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+//F and D extensions. Singles are NaN-boxed in the 64 bit f registers.
+
+var errFPDisabled = errors.New("Could not execute floating point instruction, mstatus.FS is off")
+
+//boxMask holds the upper 32 bits of a NaN-boxed single
+const boxMask uint64 = 0xffffffff00000000
+
+//getS returns the single in f[i], improperly boxed values read as the canonical NaN
+func (cpu *CPU) getS(i uint) uint64 {
+	if cpu.fregs[i]&boxMask != boxMask {
+		return fmtS.canonicalNaN
+	}
+	return cpu.fregs[i] &^ boxMask
+}
+
+//setS NaN-boxes a single into f[i]
+func (cpu *CPU) setS(i uint, value uint64) {
+	cpu.fregs[i] = boxMask | value&^boxMask
+	cpu.written('f', uint64(i))
+}
+
+//setD writes a double or raw bits into f[i]
+func (cpu *CPU) setD(i uint, value uint64) {
+	cpu.fregs[i] = value
+	cpu.written('f', uint64(i))
+}
+
+//getF returns f[i] in format f
+func (cpu *CPU) getF(f fpFormat, i uint) uint64 {
+	if f.mant == fmtS.mant {
+		return cpu.getS(i)
+	}
+	return cpu.fregs[i]
+}
+
+//setF writes a value of format f to f[i] and accrues the exception flags
+func (cpu *CPU) setF(f fpFormat, i uint, value uint64, flags uint8) {
+	if f.mant == fmtS.mant {
+		cpu.setS(i, value)
+	} else {
+		cpu.setD(i, value)
+	}
+	cpu.accrue(flags)
+}
+
+//accrue sets exception flags in fflags
+func (cpu *CPU) accrue(flags uint8) {
+	if flags == 0 {
+		return
+	}
+	cpu.fflags |= flags
+	cpu.written('c', csrFflags)
+}
+
+//roundingMode resolves the rm field of an instruction, dynamic rounding uses frm
+func (cpu *CPU) roundingMode(rm uint64) (uint64, error) {
+	if rm == rmDYN {
+		rm = cpu.frm
+	}
+	if rm > rmRMM {
+		return 0, errors.New("Could not execute reserved rounding mode")
+	}
+	return rm, nil
+}
+
+//fpFormatOf returns the format of the fmt field inst[26:25]
+func fpFormatOf(instruction uint64) (fpFormat, error) {
+	switch (instruction >> 25) & 0x3 {
+	case 0x0:
+		return fmtS, nil
+	case 0x1:
+		return fmtD, nil
+	default:
+		return fpFormat{}, errors.New("Could not execute floating point format")
+	}
+}
+
+//executeFLoad executes flw and fld of opcode 0x07
+func (cpu *CPU) executeFLoad(addr uint64, rd uint, funct3 uint64) error {
+	switch funct3 {
+	case 0x2:
+		//flw
+		val, err := cpu.load(addr, 32)
+		if err != nil {
+			return err
+		}
+		cpu.setS(rd, val)
+	case 0x3:
+		//fld
+		val, err := cpu.load(addr, 64)
+		if err != nil {
+			return err
+		}
+		cpu.setD(rd, val)
+	default:
+		return errors.New("Could not execute funct3 of instruction 0x07")
+	}
+	return nil
+}
+
+//executeFStore executes fsw and fsd of opcode 0x27
+func (cpu *CPU) executeFStore(addr uint64, rs2 uint, funct3 uint64) error {
+	switch funct3 {
+	case 0x2:
+		//fsw stores the raw lower bits, boxed or not
+		return cpu.store(addr, 32, cpu.fregs[rs2])
+	case 0x3:
+		//fsd
+		return cpu.store(addr, 64, cpu.fregs[rs2])
+	default:
+		return errors.New("Could not execute funct3 of instruction 0x27")
+	}
+}
+
+//executeFMA executes the fused multiply add instructions of opcodes 0x43-0x4f
+func (cpu *CPU) executeFMA(instruction uint64, opcode uint64, rd uint, rs1 uint, rs2 uint, funct3 uint64) error {
+	f, err := fpFormatOf(instruction)
+	if err != nil {
+		return err
+	}
+	rm, err := cpu.roundingMode(funct3)
+	if err != nil {
+		return err
+	}
+	rs3 := uint(instruction >> 27)
+	a, b, c := cpu.getF(f, rs1), cpu.getF(f, rs2), cpu.getF(f, rs3)
+	var result uint64
+	var flags uint8
+	switch opcode {
+	case 0x43:
+		//fmadd (rs1*rs2)+rs3
+		result, flags = f.fpFMA(a, b, c, false, false, rm)
+	case 0x47:
+		//fmsub (rs1*rs2)-rs3
+		result, flags = f.fpFMA(a, b, c, false, true, rm)
+	case 0x4b:
+		//fnmsub -(rs1*rs2)+rs3
+		result, flags = f.fpFMA(a, b, c, true, false, rm)
+	default:
+		//fnmadd -(rs1*rs2)-rs3
+		result, flags = f.fpFMA(a, b, c, true, true, rm)
+	}
+	cpu.setF(f, rd, result, flags)
+	return nil
+}
+
+//executeFP executes the OP-FP instructions of opcode 0x53
+func (cpu *CPU) executeFP(instruction uint64, rd uint, rs1 uint, rs2 uint, funct3 uint64, funct7 uint64) error {
+	f, err := fpFormatOf(instruction)
+	if err != nil {
+		return err
+	}
+	//funct5 selects the operation, the lower 2 bits of funct7 are the format
+	funct5 := funct7 >> 2
+	a, b := cpu.getF(f, rs1), cpu.getF(f, rs2)
+
+	//operations which do not round
+	switch funct5 {
+	case 0x04:
+		//fsgnj, fsgnjn, fsgnjx
+		var sign uint64
+		switch funct3 {
+		case 0x0:
+			sign = b & f.signBit
+		case 0x1:
+			sign = ^b & f.signBit
+		case 0x2:
+			sign = (a ^ b) & f.signBit
+		default:
+			return errors.New("Could not execute funct3 of fsgnj")
+		}
+		cpu.setF(f, rd, a&^f.signBit|sign, 0)
+		return nil
+	case 0x05:
+		//fmin, fmax
+		if funct3 > 0x1 {
+			return errors.New("Could not execute funct3 of fmin/fmax")
+		}
+		result, flags := f.fpMinMax(a, b, funct3 == 0x1)
+		cpu.setF(f, rd, result, flags)
+		return nil
+	case 0x14:
+		//fle, flt, feq
+		if funct3 > 0x2 {
+			return errors.New("Could not execute funct3 of fle/flt/feq")
+		}
+		result, flags := f.fpCompare(a, b, funct3)
+		cpu.setX(rd, result)
+		cpu.accrue(flags)
+		return nil
+	case 0x1c:
+		switch {
+		case funct3 == 0x0 && rs2 == 0:
+			//fmv.x.w, fmv.x.d move the raw bits, singles are sign extended
+			if f.mant == fmtS.mant {
+				cpu.setX(rd, uint64(int64(int32(cpu.fregs[rs1]))))
+			} else {
+				cpu.setX(rd, cpu.fregs[rs1])
+			}
+		case funct3 == 0x1 && rs2 == 0:
+			//fclass
+			cpu.setX(rd, f.fpClass(a))
+		default:
+			return errors.New("Could not execute funct3 of fmv.x/fclass")
+		}
+		return nil
+	case 0x1e:
+		//fmv.w.x, fmv.d.x
+		if funct3 != 0x0 || rs2 != 0 {
+			return errors.New("Could not execute funct3 of fmv.w.x/fmv.d.x")
+		}
+		if f.mant == fmtS.mant {
+			cpu.setS(rd, cpu.regs[rs1])
+		} else {
+			cpu.setD(rd, cpu.regs[rs1])
+		}
+		return nil
+	}
+
+	rm, err := cpu.roundingMode(funct3)
+	if err != nil {
+		return err
+	}
+	var result uint64
+	var flags uint8
+	switch funct5 {
+	case 0x00:
+		//fadd
+		result, flags = f.fpAdd(a, b, rm)
+	case 0x01:
+		//fsub
+		result, flags = f.fpAdd(a, b^f.signBit, rm)
+	case 0x02:
+		//fmul
+		result, flags = f.fpMul(a, b, rm)
+	case 0x03:
+		//fdiv
+		result, flags = f.fpDiv(a, b, rm)
+	case 0x0b:
+		//fsqrt
+		if rs2 != 0 {
+			return errors.New("Could not execute rs2 of fsqrt")
+		}
+		result, flags = f.fpSqrt(a, rm)
+	case 0x08:
+		//fcvt.s.d, fcvt.d.s, rs2 holds the source format
+		switch {
+		case f.mant == fmtS.mant && rs2 == 1:
+			result, flags = fmtS.fpConvert(fmtD, cpu.fregs[rs1], rm)
+		case f.mant == fmtD.mant && rs2 == 0:
+			result, flags = fmtD.fpConvert(fmtS, cpu.getS(rs1), rm)
+		default:
+			return errors.New("Could not execute rs2 of fcvt between formats")
+		}
+	case 0x18:
+		//fcvt.w, fcvt.wu, fcvt.l, fcvt.lu, rs2 selects the integer type
+		if rs2 > 3 {
+			return errors.New("Could not execute rs2 of fcvt to integer")
+		}
+		size := uint(32)
+		if rs2 >= 2 {
+			size = 64
+		}
+		value, flags := f.fpToInt(a, rs2&0x1 == 0, size, rm)
+		cpu.setX(rd, value)
+		cpu.accrue(flags)
+		return nil
+	case 0x1a:
+		//fcvt.s.w, fcvt.s.wu, fcvt.s.l, fcvt.s.lu and the double versions
+		value := cpu.regs[rs1]
+		switch rs2 {
+		case 0:
+			value = uint64(int64(int32(value)))
+		case 1:
+			value = uint64(uint32(value))
+		case 2, 3:
+		default:
+			return errors.New("Could not execute rs2 of fcvt from integer")
+		}
+		result, flags = f.fpFromInt(value, rs2&0x1 == 0, rm)
+	default:
+		return fmt.Errorf("Could not execute funct7 %#x of instruction 0x53", funct7)
+	}
+	cpu.setF(f, rd, result, flags)
+	return nil
+}
+
+//dumpFRegisters dumps all floating point registers f0-f31 and fcsr
+func (cpu *CPU) dumpFRegisters(w io.Writer) {
+	name := [32]string{
+		" ft0", " ft1", " ft2", " ft3", " ft4", " ft5", " ft6", " ft7",
+		" fs0", " fs1", " fa0", " fa1", " fa2", " fa3", " fa4", " fa5",
+		" fa6", " fa7", " fs2", " fs3", " fs4", " fs5", " fs6", " fs7",
+		" fs8", " fs9", "fs10", "fs11", " ft8", " ft9", "ft10", "ft11",
+	}
+	for i := 0; i <= 31; i += 4 {
+		for j := 0; j <= 3; j++ {
+			fmt.Fprintf(w, "f%.2d (%s) = %#x\t", i+j, name[i+j], cpu.fregs[i+j])
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "fcsr = %#x (frm %#x fflags %#x)", cpu.frm<<5|uint64(cpu.fflags), cpu.frm, cpu.fflags)
+	fmt.Fprintln(w)
+}
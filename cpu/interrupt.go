@@ -0,0 +1,45 @@
+package cpu
+
+//interruptPriority lists the interrupts from the highest to the lowest priority
+var interruptPriority = [...]uint64{11, 3, 7, 9, 1, 5}
+
+//SetPending raises or lowers the interrupt input irq of the hart. irq is the
+//bit in mip: 3 machine software, 7 machine timer, 9 supervisor external and
+//11 machine external interrupt.
+func (cpu *CPU) SetPending(irq uint, level bool) {
+	if level {
+		cpu.irqLines |= 1 << irq
+	} else {
+		cpu.irqLines &^= 1 << irq
+	}
+}
+
+//readMip returns mip, the bits written by software together with the interrupt inputs
+func (cpu *CPU) readMip() uint64 {
+	return cpu.csrs[csrMip] | cpu.irqLines
+}
+
+//interrupt takes the pending and enabled interrupt with the highest priority.
+//Interrupts for machine mode are enabled below machine mode and with
+//mstatus.MIE, delegated ones below supervisor mode and with mstatus.SIE in
+//supervisor mode.
+func (cpu *CPU) interrupt() {
+	pending := cpu.readMip() & cpu.csrs[csrMie]
+	if pending == 0 {
+		return
+	}
+	mideleg := cpu.csrs[csrMideleg]
+	var enabled uint64
+	if cpu.priv < privMachine || cpu.mstatus&mstatusMIE != 0 {
+		enabled |= pending &^ mideleg
+	}
+	if cpu.priv < privSupervisor || cpu.priv == privSupervisor && cpu.mstatus&mstatusSIE != 0 {
+		enabled |= pending & mideleg
+	}
+	for _, irq := range interruptPriority {
+		if enabled&(1<<irq) != 0 {
+			cpu.takeTrap(causeInterrupt|irq, 0, cpu.pc)
+			return
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package cpu
+
+//accessKind tells what a memory access is for, it selects the exception raised on a fault
+type accessKind int
+
+const (
+	accessFetch accessKind = iota
+	accessLoad
+	accessStore
+)
+
+//misaligned returns the exception code for a misaligned access
+func (kind accessKind) misaligned() uint64 {
+	switch kind {
+	case accessFetch:
+		return causeFetchMisaligned
+	case accessLoad:
+		return causeLoadMisaligned
+	default:
+		return causeStoreMisaligned
+	}
+}
+
+//accessFault returns the exception code for an access the bus refused
+func (kind accessKind) accessFault() uint64 {
+	switch kind {
+	case accessFetch:
+		return causeFetchAccessFault
+	case accessLoad:
+		return causeLoadAccessFault
+	default:
+		return causeStoreAccessFault
+	}
+}
+
+//pageFault returns the exception code for a failed translation
+func (kind accessKind) pageFault() uint64 {
+	switch kind {
+	case accessFetch:
+		return causeFetchPageFault
+	case accessLoad:
+		return causeLoadPageFault
+	default:
+		return causeStorePageFault
+	}
+}
+
+//accessPriv returns the privilege an access is made with. With mstatus.MPRV
+//loads and stores of machine mode use the privilege in mstatus.MPP.
+func (cpu *CPU) accessPriv(kind accessKind) uint64 {
+	if kind != accessFetch && cpu.priv == privMachine && cpu.mstatus&mstatusMPRV != 0 {
+		return (cpu.mstatus & mstatusMPP) >> 11
+	}
+	return cpu.priv
+}
+
+//physical checks an access of size bits at the virtual address addr and
+//returns its physical address. Misaligned accesses trap like bus errors do,
+//with addr in mtval.
+func (cpu *CPU) physical(addr uint64, size uint64, kind accessKind) (uint64, error) {
+	if addr%(size/8) != 0 {
+		return 0, &Exception{Cause: kind.misaligned(), Tval: addr}
+	}
+	priv := cpu.accessPriv(kind)
+	paddr, err := cpu.translate(addr, kind, priv)
+	if err != nil {
+		return 0, err
+	}
+	if !cpu.pmpAllows(paddr, size/8, kind, priv) {
+		return 0, &Exception{Cause: kind.accessFault(), Tval: addr}
+	}
+	return paddr, nil
+}
+
+//read loads size bits from the virtual address addr
+func (cpu *CPU) read(addr uint64, size uint64, kind accessKind) (uint64, error) {
+	paddr, err := cpu.physical(addr, size, kind)
+	if err != nil {
+		return 0, err
+	}
+	val, err := cpu.bus.Load(paddr, size)
+	if err != nil {
+		return 0, &Exception{Cause: kind.accessFault(), Tval: addr, Err: err}
+	}
+	if kind != accessFetch {
+		cpu.record(addr, size, val, false)
+	}
+	return val, nil
+}
+
+//write stores the lower size bits of value at the virtual address addr
+func (cpu *CPU) write(addr uint64, size uint64, value uint64, kind accessKind) error {
+	paddr, err := cpu.physical(addr, size, kind)
+	if err != nil {
+		return err
+	}
+	err = cpu.bus.Store(paddr, size, value)
+	if err != nil {
+		return &Exception{Cause: kind.accessFault(), Tval: addr, Err: err}
+	}
+	cpu.reserved = false
+	cpu.record(addr, size, value, true)
+	return nil
+}
+
+//record tells the hooks about a load or store
+func (cpu *CPU) record(addr uint64, size uint64, value uint64, store bool) {
+	if cpu.accessHook != nil {
+		cpu.accessHook(addr, size, value, store)
+	}
+	if cpu.commitHook != nil {
+		cpu.access(addr, size, value, store)
+	}
+}
+
+//split returns the physical addresses of the bytes of a misaligned access,
+//all of them are checked before any byte is accessed
+func (cpu *CPU) split(addr uint64, size uint64, kind accessKind) ([]uint64, error) {
+	paddrs := make([]uint64, size/8)
+	for i := range paddrs {
+		paddr, err := cpu.physical(addr+uint64(i), 8, kind)
+		if err != nil {
+			return nil, err
+		}
+		paddrs[i] = paddr
+	}
+	return paddrs, nil
+}
+
+//load is a data load. Without trap handlers misaligned loads are carried
+//out byte by byte, as the kernel of a Linux program would emulate them.
+func (cpu *CPU) load(addr uint64, size uint64) (uint64, error) {
+	if addr%(size/8) == 0 || !cpu.trapsHalt() {
+		return cpu.read(addr, size, accessLoad)
+	}
+	paddrs, err := cpu.split(addr, size, accessLoad)
+	if err != nil {
+		return 0, err
+	}
+	var val uint64
+	for i, paddr := range paddrs {
+		b, err := cpu.bus.Load(paddr, 8)
+		if err != nil {
+			return 0, &Exception{Cause: causeLoadAccessFault, Tval: addr + uint64(i), Err: err}
+		}
+		val |= b << (8 * uint(i))
+	}
+	cpu.record(addr, size, val, false)
+	return val, nil
+}
+
+//store is a data store, misaligned ones are split like in load
+func (cpu *CPU) store(addr uint64, size uint64, value uint64) error {
+	if addr%(size/8) == 0 || !cpu.trapsHalt() {
+		return cpu.write(addr, size, value, accessStore)
+	}
+	paddrs, err := cpu.split(addr, size, accessStore)
+	if err != nil {
+		return err
+	}
+	for i, paddr := range paddrs {
+		err := cpu.bus.Store(paddr, 8, (value>>(8*uint(i)))&0xff)
+		if err != nil {
+			return &Exception{Cause: causeStoreAccessFault, Tval: addr + uint64(i), Err: err}
+		}
+	}
+	cpu.reserved = false
+	cpu.record(addr, size, value, true)
+	return nil
+}
@@ -0,0 +1,188 @@
+package cpu
+
+import "errors"
+
+//Sv39 and Sv48 address translation. Translations are cached in a direct
+//mapped software TLB of 4 KiB pages, superpages fill one entry per page used.
+
+//tlbSize is the number of TLB entries, a power of two
+const tlbSize = 256
+
+//Page table entry bits
+const (
+	pteV uint64 = 1 << 0
+	pteR uint64 = 1 << 1
+	pteW uint64 = 1 << 2
+	pteX uint64 = 1 << 3
+	pteU uint64 = 1 << 4
+	pteG uint64 = 1 << 5
+	pteA uint64 = 1 << 6
+	pteD uint64 = 1 << 7
+)
+
+//ppnMask selects the 44 bit physical page number of satp and of a pte
+const ppnMask uint64 = 0xfffffffffff
+
+//tlbEntry caches the translation of one virtual page
+type tlbEntry struct {
+	valid  bool
+	global bool
+	asid   uint64
+	//vpn and ppn are the virtual and physical 4 KiB page numbers
+	vpn uint64
+	ppn uint64
+	//level of the leaf pte, 0 for 4 KiB pages
+	level uint
+	//pte holds the flags of the leaf pte
+	pte uint64
+}
+
+//translate returns the physical address of vaddr for an access at priv,
+//machine mode and bare satp use physical addresses
+func (cpu *CPU) translate(vaddr uint64, kind accessKind, priv uint64) (uint64, error) {
+	satp := cpu.csrs[csrSatp]
+	if priv == privMachine || satp>>60 == satpBare {
+		return vaddr, nil
+	}
+
+	vpn := vaddr >> 12
+	asid := (satp >> 44) & 0xffff
+	e := &cpu.tlb[vpn%tlbSize]
+	//a store to a page which is not dirty yet walks again to set D
+	if !e.valid || e.vpn != vpn || !e.global && e.asid != asid || kind == accessStore && e.pte&pteD == 0 {
+		err := cpu.walk(vaddr, kind, priv, satp, e)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if !cpu.permitted(e.pte, kind, priv) {
+		return 0, &Exception{Cause: kind.pageFault(), Tval: vaddr}
+	}
+	return e.ppn<<12 | vaddr&0xfff, nil
+}
+
+//walk looks up vaddr in the page table of satp, updates the A and D bits of
+//the leaf and fills the TLB entry e
+func (cpu *CPU) walk(vaddr uint64, kind accessKind, priv uint64, satp uint64, e *tlbEntry) error {
+	pte, addr, level, global, err := cpu.lookup(vaddr, kind, satp)
+	if err != nil {
+		return err
+	}
+	if !cpu.permitted(pte, kind, priv) {
+		return &Exception{Cause: kind.pageFault(), Tval: vaddr}
+	}
+	update := pte | pteA
+	if kind == accessStore {
+		update |= pteD
+	}
+	if update != pte {
+		if !cpu.pmpAllows(addr, 8, accessStore, privSupervisor) {
+			return &Exception{Cause: kind.accessFault(), Tval: vaddr}
+		}
+		err = cpu.bus.Store(addr, 64, update)
+		if err != nil {
+			return &Exception{Cause: kind.accessFault(), Tval: vaddr, Err: err}
+		}
+	}
+	pages := uint64(1)<<(9*level) - 1
+	*e = tlbEntry{
+		valid:  true,
+		global: global,
+		asid:   (satp >> 44) & 0xffff,
+		vpn:    vaddr >> 12,
+		ppn:    (pte>>10)&ppnMask | (vaddr>>12)&pages,
+		level:  level,
+		pte:    update & 0xff,
+	}
+	return nil
+}
+
+//lookup finds the leaf pte of vaddr in the page table of satp. It returns
+//the pte, its address, its level, 0 for 4 KiB pages, and if a pte on the way
+//was global. It neither checks the permissions nor changes memory.
+func (cpu *CPU) lookup(vaddr uint64, kind accessKind, satp uint64) (pte uint64, addr uint64, level uint, global bool, err error) {
+	fault := &Exception{Cause: kind.pageFault(), Tval: vaddr}
+	levels := uint(3)
+	if satp>>60 == satpSv48 {
+		levels = 4
+	}
+	//the upper address bits must be copies of the highest translated bit
+	shift := 64 - (12 + 9*levels)
+	if uint64(int64(vaddr<<shift)>>shift) != vaddr {
+		return 0, 0, 0, false, fault
+	}
+
+	table := (satp & ppnMask) << 12
+	for l := int(levels) - 1; l >= 0; l-- {
+		level = uint(l)
+		addr = table + ((vaddr>>(12+9*level))&0x1ff)*8
+		//the walk accesses memory with supervisor privilege
+		if !cpu.pmpAllows(addr, 8, accessLoad, privSupervisor) {
+			return 0, 0, 0, false, &Exception{Cause: kind.accessFault(), Tval: vaddr}
+		}
+		pte, err = cpu.bus.Load(addr, 64)
+		if err != nil {
+			return 0, 0, 0, false, &Exception{Cause: kind.accessFault(), Tval: vaddr, Err: err}
+		}
+		//the reserved upper bits must be zero, W without R is reserved
+		if pte&pteV == 0 || pte&pteR == 0 && pte&pteW != 0 || pte>>54 != 0 {
+			return 0, 0, 0, false, fault
+		}
+		global = global || pte&pteG != 0
+		ppn := (pte >> 10) & ppnMask
+		if pte&(pteR|pteX) == 0 {
+			//pointer to the next level
+			table = ppn << 12
+			continue
+		}
+		//superpages must be aligned to their size
+		if ppn&(uint64(1)<<(9*level)-1) != 0 {
+			return 0, 0, 0, false, fault
+		}
+		return pte, addr, level, global, nil
+	}
+	//the last level holds no leaf
+	return 0, 0, 0, false, fault
+}
+
+//permitted checks the access against the flags of a leaf pte
+func (cpu *CPU) permitted(pte uint64, kind accessKind, priv uint64) bool {
+	if pte&pteU != 0 {
+		//supervisor mode never executes user pages and only accesses them with SUM
+		if priv == privSupervisor && (kind == accessFetch || cpu.mstatus&mstatusSUM == 0) {
+			return false
+		}
+	} else if priv == privUser {
+		return false
+	}
+	switch kind {
+	case accessFetch:
+		return pte&pteX != 0
+	case accessLoad:
+		//MXR makes executable pages readable
+		return pte&pteR != 0 || cpu.mstatus&mstatusMXR != 0 && pte&pteX != 0
+	default:
+		return pte&pteW != 0
+	}
+}
+
+//sfenceVMA flushes the TLB. A nonzero rs1 limits the flush to the page of the
+//address in rs1, a nonzero rs2 to the non global entries of the ASID in rs2.
+func (cpu *CPU) sfenceVMA(rs1 uint, rs2 uint) error {
+	if cpu.priv == privUser || cpu.priv == privSupervisor && cpu.mstatus&mstatusTVM != 0 {
+		return errors.New("Could not execute sfence.vma at this privilege")
+	}
+	vpn := cpu.regs[rs1] >> 12
+	asid := cpu.regs[rs2] & 0xffff
+	for i := range cpu.tlb {
+		e := &cpu.tlb[i]
+		if rs1 != 0 && e.vpn>>(9*e.level) != vpn>>(9*e.level) {
+			continue
+		}
+		if rs2 != 0 && (e.global || e.asid != asid) {
+			continue
+		}
+		e.valid = false
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package cpu
+
+import (
+	"math"
+	"math/bits"
+)
+
+//RV64M helpers. Division by zero and signed overflow do not trap, the
+//results are the ones given in the spec's table 7.1.
+
+//mulhu returns the upper 64 bits of the unsigned 128 bit product
+func mulhu(a uint64, b uint64) uint64 {
+	hi, _ := bits.Mul64(a, b)
+	return hi
+}
+
+//mulh returns the upper 64 bits of the signed 128 bit product
+func mulh(a uint64, b uint64) uint64 {
+	hi := mulhu(a, b)
+	if int64(a) < 0 {
+		hi -= b
+	}
+	if int64(b) < 0 {
+		hi -= a
+	}
+	return hi
+}
+
+//mulhsu returns the upper 64 bits of the product of signed a and unsigned b
+func mulhsu(a uint64, b uint64) uint64 {
+	hi := mulhu(a, b)
+	if int64(a) < 0 {
+		hi -= b
+	}
+	return hi
+}
+
+func div(a uint64, b uint64) uint64 {
+	switch {
+	case b == 0:
+		return math.MaxUint64
+	case int64(a) == math.MinInt64 && int64(b) == -1:
+		return a
+	}
+	return uint64(int64(a) / int64(b))
+}
+
+func divu(a uint64, b uint64) uint64 {
+	if b == 0 {
+		return math.MaxUint64
+	}
+	return a / b
+}
+
+func rem(a uint64, b uint64) uint64 {
+	switch {
+	case b == 0:
+		return a
+	case int64(a) == math.MinInt64 && int64(b) == -1:
+		return 0
+	}
+	return uint64(int64(a) % int64(b))
+}
+
+func remu(a uint64, b uint64) uint64 {
+	if b == 0 {
+		return a
+	}
+	return a % b
+}
+
+//The word variants operate on the lower 32 bits and sign extend the result
+
+func divw(a uint64, b uint64) uint64 {
+	x, y := int32(a), int32(b)
+	switch {
+	case y == 0:
+		return math.MaxUint64
+	case x == math.MinInt32 && y == -1:
+		return uint64(int64(x))
+	}
+	return uint64(int64(x / y))
+}
+
+func divuw(a uint64, b uint64) uint64 {
+	x, y := uint32(a), uint32(b)
+	if y == 0 {
+		return math.MaxUint64
+	}
+	return uint64(int64(int32(x / y)))
+}
+
+func remw(a uint64, b uint64) uint64 {
+	x, y := int32(a), int32(b)
+	switch {
+	case y == 0:
+		return uint64(int64(x))
+	case x == math.MinInt32 && y == -1:
+		return 0
+	}
+	return uint64(int64(x % y))
+}
+
+func remuw(a uint64, b uint64) uint64 {
+	x, y := uint32(a), uint32(b)
+	if y == 0 {
+		return uint64(int64(int32(x)))
+	}
+	return uint64(int64(int32(x % y)))
+}
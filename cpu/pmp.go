@@ -0,0 +1,148 @@
+package cpu
+
+//Physical memory protection. Entries have a granularity of 4 bytes, the
+//number of implemented entries is set with Options.PMPEntries.
+
+//MaxPMPEntries is the number of PMP entries the privileged spec allows
+const MaxPMPEntries = 64
+
+//pmpcfg fields
+const (
+	pmpR     uint8 = 1 << 0
+	pmpW     uint8 = 1 << 1
+	pmpX     uint8 = 1 << 2
+	pmpA     uint8 = 0x3 << 3
+	pmpL     uint8 = 1 << 7
+	pmpOff   uint8 = 0 << 3
+	pmpTOR   uint8 = 1 << 3
+	pmpNA4   uint8 = 2 << 3
+	pmpNAPOT uint8 = 3 << 3
+)
+
+//CSR addresses of the first pmpcfg and pmpaddr registers
+const (
+	csrPmpcfg0  uint64 = 0x3a0
+	csrPmpaddr0 uint64 = 0x3b0
+)
+
+//pmpaddrMask selects bits 55:2 of the physical address held in pmpaddr
+const pmpaddrMask uint64 = 1<<54 - 1
+
+func init() {
+	//RV64 only has the even pmpcfg registers, each holds 8 entries
+	for i := uint64(0); i < MaxPMPEntries/8; i++ {
+		first := int(i * 8)
+		csrDefs[csrPmpcfg0+2*i] = csrDef{
+			read:  func(cpu *CPU) uint64 { return cpu.readPmpcfg(first) },
+			write: func(cpu *CPU, value uint64) { cpu.writePmpcfg(first, value) },
+		}
+	}
+	for i := 0; i < MaxPMPEntries; i++ {
+		entry := i
+		csrDefs[csrPmpaddr0+uint64(i)] = csrDef{
+			read:  func(cpu *CPU) uint64 { return cpu.pmpaddr[entry] },
+			write: func(cpu *CPU, value uint64) { cpu.writePmpaddr(entry, value) },
+		}
+	}
+}
+
+//readPmpcfg packs the configuration of 8 entries starting at first
+func (cpu *CPU) readPmpcfg(first int) uint64 {
+	var value uint64
+	for j := 0; j < 8; j++ {
+		value |= uint64(cpu.pmpcfg[first+j]) << (8 * j)
+	}
+	return value
+}
+
+//writePmpcfg writes the configuration of 8 entries starting at first.
+//Locked and unimplemented entries keep their value.
+func (cpu *CPU) writePmpcfg(first int, value uint64) {
+	for j := 0; j < 8; j++ {
+		entry := first + j
+		if entry >= cpu.pmpEntries || cpu.pmpcfg[entry]&pmpL != 0 {
+			continue
+		}
+		cfg := uint8(value>>(8*j)) &^ 0x60
+		//W without R is reserved
+		if cfg&pmpR == 0 {
+			cfg &^= pmpW
+		}
+		cpu.pmpcfg[entry] = cfg
+	}
+	cpu.pmpActive = false
+	for _, cfg := range cpu.pmpcfg[:cpu.pmpEntries] {
+		if cfg&pmpA != pmpOff {
+			cpu.pmpActive = true
+		}
+	}
+}
+
+//writePmpaddr writes the address of entry. A locked entry keeps it, as does
+//the top of range of a locked TOR entry.
+func (cpu *CPU) writePmpaddr(entry int, value uint64) {
+	if entry >= cpu.pmpEntries || cpu.pmpcfg[entry]&pmpL != 0 {
+		return
+	}
+	if entry+1 < cpu.pmpEntries && cpu.pmpcfg[entry+1]&(pmpL|pmpA) == pmpL|pmpTOR {
+		return
+	}
+	cpu.pmpaddr[entry] = value & pmpaddrMask
+}
+
+//pmpRange returns the address range [lo, hi) matched by entry
+func (cpu *CPU) pmpRange(entry int) (uint64, uint64) {
+	addr := cpu.pmpaddr[entry]
+	switch cpu.pmpcfg[entry] & pmpA {
+	case pmpTOR:
+		var lo uint64
+		if entry > 0 {
+			lo = cpu.pmpaddr[entry-1] << 2
+		}
+		return lo, addr << 2
+	case pmpNA4:
+		return addr << 2, addr<<2 + 4
+	case pmpNAPOT:
+		//the trailing ones of addr encode the size
+		ones := addr ^ (addr + 1)
+		return (addr &^ ones) << 2, (addr&^ones)<<2 + (ones+1)<<2
+	default:
+		return 0, 0
+	}
+}
+
+//pmpAllows checks an access of size bytes at the physical address addr.
+//The entry with the lowest number that matches decides, it must match all
+//bytes. Machine mode is only restricted by locked entries, S and U-mode
+//accesses which match no entry fail.
+func (cpu *CPU) pmpAllows(addr uint64, size uint64, kind accessKind, priv uint64) bool {
+	if !cpu.pmpActive {
+		return priv == privMachine || cpu.pmpEntries == 0
+	}
+	for entry := 0; entry < cpu.pmpEntries; entry++ {
+		cfg := cpu.pmpcfg[entry]
+		if cfg&pmpA == pmpOff {
+			continue
+		}
+		lo, hi := cpu.pmpRange(entry)
+		if addr+size <= lo || addr >= hi {
+			continue
+		}
+		if addr < lo || addr+size > hi {
+			//partial match
+			return false
+		}
+		if priv == privMachine && cfg&pmpL == 0 {
+			return true
+		}
+		switch kind {
+		case accessFetch:
+			return cfg&pmpX != 0
+		case accessLoad:
+			return cfg&pmpR != 0
+		default:
+			return cfg&pmpW != 0
+		}
+	}
+	return priv == privMachine
+}
@@ -0,0 +1,186 @@
+package cpu
+
+import (
+	"errors"
+	"fmt"
+)
+
+//StopKind tells why a run ended
+type StopKind int
+
+const (
+	//StopEnd the pc reached the end of the loaded image, the program ran to completion
+	StopEnd StopKind = iota
+	//StopExit the program called the exit environment call
+	StopExit
+	//StopBreak the program executed ebreak
+	StopBreak
+	//StopLimit the maximum number of instructions was executed
+	StopLimit
+	//StopPCFault the pc left the loaded image
+	StopPCFault
+	//StopError the simulator could not carry out a request of the program
+	StopError
+	//StopTrap an exception was raised while no trap handler was installed
+	StopTrap
+)
+
+//Environment call numbers of the exit convention, taken from the RISC-V Linux ABI
+const (
+	sysExit      uint64 = 93
+	sysExitGroup uint64 = 94
+)
+
+//StopReason describes why and where a run ended
+type StopReason struct {
+	Kind StopKind
+	//PC of the instruction which ended the run
+	PC uint64
+	//Code is the exit code passed in a0 for StopExit
+	Code int
+	//Err holds the failure for StopError and the *Exception for StopTrap
+	Err error
+}
+
+//ExitCode returns the process exit status matching the stop reason
+func (s StopReason) ExitCode() int {
+	switch s.Kind {
+	case StopEnd, StopBreak:
+		return 0
+	case StopExit:
+		return s.Code
+	case StopLimit:
+		return 2
+	default:
+		return 1
+	}
+}
+
+func (s StopReason) String() string {
+	switch s.Kind {
+	case StopEnd:
+		return fmt.Sprintf("HLT end of program at pc %#x", s.PC)
+	case StopExit:
+		return fmt.Sprintf("HLT exit(%d) at pc %#x", s.Code, s.PC)
+	case StopBreak:
+		return fmt.Sprintf("HLT ebreak at pc %#x", s.PC)
+	case StopLimit:
+		return fmt.Sprintf("HLT instruction limit reached at pc %#x", s.PC)
+	case StopPCFault:
+		return fmt.Sprintf("FAULT pc %#x left the loaded image", s.PC)
+	case StopTrap:
+		return fmt.Sprintf("TRAP at pc %#x: %v", s.PC, s.Err)
+	default:
+		return fmt.Sprintf("PANIC at pc %#x: %v", s.PC, s.Err)
+	}
+}
+
+//Retired returns the number of executed instructions
+func (cpu *CPU) Retired() uint64 {
+	return cpu.retired
+}
+
+//Step executes a single instruction, it returns nil as long as the program keeps running
+func (cpu *CPU) Step() *StopReason {
+	pc := cpu.pc
+	if cpu.imageEnd != 0 {
+		if pc == cpu.imageEnd {
+			return &StopReason{Kind: StopEnd, PC: pc}
+		}
+		if pc < cpu.imageStart || pc > cpu.imageEnd {
+			return &StopReason{Kind: StopPCFault, PC: pc}
+		}
+	}
+	if cpu.maxInstructions != 0 && cpu.retired >= cpu.maxInstructions {
+		return &StopReason{Kind: StopLimit, PC: pc}
+	}
+
+	cpu.cycle++
+	if cpu.tick != nil {
+		cpu.tick()
+	}
+	//interrupts are taken between instructions, the handler runs right away
+	cpu.interrupt()
+	pc = cpu.pc
+	if cpu.commitHook != nil {
+		cpu.commit = Commit{Hart: cpu.hartID, PC: pc, Priv: cpu.priv, Accesses: cpu.commit.Accesses[:0], Writes: cpu.commit.Writes[:0]}
+	}
+
+	//Fetch
+	inst, err := cpu.Fetch()
+	if err == nil {
+		cpu.IncPC(inst)
+
+		//Decode / Execute
+		err = cpu.Execute(inst)
+		//x0 is hardwired to zero, drop writes to it
+		cpu.regs[0] = 0
+	}
+	if err != nil {
+		//the trapping instruction does not retire, mepc points at it
+		cpu.pc = pc
+		return cpu.raise(exceptionOf(err, inst), pc)
+	}
+	if cpu.stop != nil {
+		//the pc stays at the instruction which ended the run
+		stop := cpu.stop
+		cpu.stop = nil
+		cpu.pc = pc
+		stop.PC = pc
+		return stop
+	}
+	cpu.retired++
+	cpu.instret++
+	if cpu.commitHook != nil {
+		cpu.commit.Inst = inst
+		cpu.commitHook(cpu, &cpu.commit)
+	}
+	return nil
+}
+
+//Run executes instructions until the program stops
+func (cpu *CPU) Run() StopReason {
+	for {
+		if stop := cpu.Step(); stop != nil {
+			return *stop
+		}
+	}
+}
+
+//Exit is returned by a syscall handler to end the run with an exit code
+type Exit struct {
+	Code int
+}
+
+func (e *Exit) Error() string {
+	return fmt.Sprintf("exit(%d)", e.Code)
+}
+
+//ecall traps to the handler in mtvec. Under the exit convention it passes
+//the call to the syscall handler or ends the run, a7 holds the call number
+//and a0 the exit code.
+func (cpu *CPU) ecall() error {
+	if !cpu.trapsHalt() {
+		return &Exception{Cause: causeEcallU + cpu.priv}
+	}
+	if cpu.syscall != nil {
+		var args [6]uint64
+		copy(args[:], cpu.regs[10:16])
+		ret, err := cpu.syscall(cpu.regs[17], args)
+		if exit, ok := err.(*Exit); ok {
+			cpu.stop = &StopReason{Kind: StopExit, Code: exit.Code}
+		} else if err != nil {
+			cpu.stop = &StopReason{Kind: StopError, Err: err}
+		} else {
+			cpu.setX(10, ret)
+		}
+		return nil
+	}
+	switch cpu.regs[17] {
+	case sysExit, sysExitGroup:
+		cpu.stop = &StopReason{Kind: StopExit, Code: int(int32(cpu.regs[10]))}
+	default:
+		cpu.stop = &StopReason{Kind: StopError, Err: errors.New("Unsupported environment call")}
+	}
+	return nil
+}
@@ -0,0 +1,577 @@
+package cpu
+
+import (
+	"math"
+	"math/big"
+)
+
+//IEEE 754 arithmetic with the RISC-V rounding modes and exception flags.
+//Operations are carried out on raw register bits. Results are computed
+//exactly or rounded to odd at a wide precision with math/big and then
+//rounded once to the destination format, which gives correctly rounded
+//results for all rounding modes including subnormals.
+
+//Rounding modes of the rm field and frm
+const (
+	rmRNE uint64 = 0 //round to nearest, ties to even
+	rmRTZ uint64 = 1 //round towards zero
+	rmRDN uint64 = 2 //round down
+	rmRUP uint64 = 3 //round up
+	rmRMM uint64 = 4 //round to nearest, ties to max magnitude
+	rmDYN uint64 = 7 //use the rounding mode in frm
+)
+
+//Accrued exception flags in fflags
+const (
+	flagNX uint8 = 0x01 //inexact
+	flagUF uint8 = 0x02 //underflow
+	flagOF uint8 = 0x04 //overflow
+	flagDZ uint8 = 0x08 //divide by zero
+	flagNV uint8 = 0x10 //invalid operation
+)
+
+//wide is the precision of intermediate results, it holds the exact product
+//of two doubles and is more than 2 bits wider than a double for round to odd
+const wide uint = 128
+
+//fpFormat describes a binary floating point format
+type fpFormat struct {
+	//mant is the precision including the implicit bit
+	mant uint
+	emin int
+	emax int
+	//signBit masks the sign
+	signBit uint64
+	//expMask masks the biased exponent, quietBit the msb of the fraction
+	expMask  uint64
+	quietBit uint64
+	//canonicalNaN is the only NaN generated by arithmetic
+	canonicalNaN uint64
+}
+
+var (
+	fmtS = fpFormat{mant: 24, emin: -126, emax: 127, signBit: 1 << 31, expMask: 0x7f800000, quietBit: 1 << 22, canonicalNaN: 0x7fc00000}
+	fmtD = fpFormat{mant: 53, emin: -1022, emax: 1023, signBit: 1 << 63, expMask: 0x7ff0000000000000, quietBit: 1 << 51, canonicalNaN: 0x7ff8000000000000}
+)
+
+func (f fpFormat) fracMask() uint64 {
+	return f.quietBit<<1 - 1
+}
+
+func (f fpFormat) isNaN(a uint64) bool {
+	return a&f.expMask == f.expMask && a&f.fracMask() != 0
+}
+
+func (f fpFormat) isSNaN(a uint64) bool {
+	return f.isNaN(a) && a&f.quietBit == 0
+}
+
+func (f fpFormat) isInf(a uint64) bool {
+	return a&f.expMask == f.expMask && a&f.fracMask() == 0
+}
+
+func (f fpFormat) isZero(a uint64) bool {
+	return a&^f.signBit == 0
+}
+
+func (f fpFormat) signOf(a uint64) bool {
+	return a&f.signBit != 0
+}
+
+func (f fpFormat) inf(neg bool) uint64 {
+	return f.zero(neg) | f.expMask
+}
+
+func (f fpFormat) zero(neg bool) uint64 {
+	if neg {
+		return f.signBit
+	}
+	return 0
+}
+
+//maxFinite returns the largest finite magnitude with the given sign
+func (f fpFormat) maxFinite(neg bool) uint64 {
+	return f.zero(neg) | (f.expMask - f.fracMask() - 1) | f.fracMask()
+}
+
+//float64 returns the value of finite or infinite bits, exact for both formats
+func (f fpFormat) float64(a uint64) float64 {
+	if f.mant == fmtS.mant {
+		return float64(math.Float32frombits(uint32(a)))
+	}
+	return math.Float64frombits(a)
+}
+
+//bits returns the encoding of a value representable in the format
+func (f fpFormat) bits(v float64) uint64 {
+	if f.mant == fmtS.mant {
+		return uint64(math.Float32bits(float32(v)))
+	}
+	return math.Float64bits(v)
+}
+
+//big returns the exact value of finite bits
+func (f fpFormat) big(a uint64) *big.Float {
+	return new(big.Float).SetFloat64(f.float64(a))
+}
+
+//nanResult returns the canonical NaN and sets invalid for signaling NaN operands
+func (f fpFormat) nanResult(operands ...uint64) (uint64, uint8) {
+	var flags uint8
+	for _, a := range operands {
+		if f.isSNaN(a) {
+			flags |= flagNV
+		}
+	}
+	return f.canonicalNaN, flags
+}
+
+//roundUp decides whether a truncated magnitude is incremented. half
+//compares the discarded fraction with one half, inexact tells if anything
+//was discarded and odd if the truncated value is odd.
+func roundUp(rm uint64, neg bool, half int, inexact bool, odd bool) bool {
+	switch rm {
+	case rmRNE:
+		return half > 0 || (half == 0 && odd)
+	case rmRMM:
+		return half >= 0
+	case rmRDN:
+		return inexact && neg
+	case rmRUP:
+		return inexact && !neg
+	default:
+		return false
+	}
+}
+
+//quantize rounds |x| to a multiple of 2^q. sticky tells that the true value
+//is slightly larger in magnitude than x. It returns the multiple and whether
+//the result is inexact.
+func quantize(x *big.Float, q int, sticky bool, rm uint64) (*big.Int, bool) {
+	neg := x.Signbit()
+	y := new(big.Float).Abs(x)
+	y.SetMantExp(y, -q)
+	i, _ := y.Int(nil)
+	frac := new(big.Float).Sub(y, new(big.Float).SetInt(i))
+	half := frac.Cmp(big.NewFloat(0.5))
+	if half == 0 && sticky {
+		half = 1
+	}
+	inexact := frac.Sign() != 0 || sticky
+	if roundUp(rm, neg, half, inexact, i.Bit(0) == 1) {
+		i.Add(i, big.NewInt(1))
+	}
+	return i, inexact
+}
+
+//round rounds x to the format. sticky tells that x was truncated, the true
+//value is slightly larger in magnitude. Exact zeros keep the sign of x.
+func (f fpFormat) round(x *big.Float, sticky bool, rm uint64) (uint64, uint8) {
+	neg := x.Signbit()
+	if x.Sign() == 0 && !sticky {
+		return f.zero(neg), 0
+	}
+	//|x| is in [2^e, 2^(e+1))
+	e := x.MantExp(nil) - 1
+	q := e
+	if q < f.emin {
+		q = f.emin
+	}
+	q -= int(f.mant) - 1
+
+	i, inexact := quantize(x, q, sticky, rm)
+	var flags uint8
+	if inexact {
+		flags |= flagNX
+	}
+
+	//tininess is detected after rounding with an unbounded exponent range
+	if e < f.emin && inexact {
+		tiny := true
+		if e == f.emin-1 {
+			j, _ := quantize(x, e-(int(f.mant)-1), sticky, rm)
+			tiny = j.BitLen() <= int(f.mant)
+		}
+		if tiny {
+			flags |= flagUF
+		}
+	}
+
+	if i.Sign() == 0 {
+		return f.zero(neg), flags
+	}
+	result := new(big.Float).SetInt(i)
+	result.SetMantExp(result, q)
+	if result.MantExp(nil)-1 > f.emax {
+		flags |= flagOF | flagNX
+		switch {
+		case rm == rmRTZ, rm == rmRDN && !neg, rm == rmRUP && neg:
+			return f.maxFinite(neg), flags
+		default:
+			return f.inf(neg), flags
+		}
+	}
+	v, _ := result.Float64()
+	if neg {
+		v = -v
+	}
+	return f.bits(v), flags
+}
+
+//roundOdd rounds the result of an inexact big operation, truncated towards
+//zero at wide precision, to the format
+func (f fpFormat) roundOdd(z *big.Float, rm uint64) (uint64, uint8) {
+	return f.round(z, z.Acc() != big.Exact, rm)
+}
+
+//newWide returns a big float which truncates at wide precision
+func newWide() *big.Float {
+	return new(big.Float).SetPrec(wide).SetMode(big.ToZero)
+}
+
+//fpAdd returns a+b, subtraction negates b before
+func (f fpFormat) fpAdd(a uint64, b uint64, rm uint64) (uint64, uint8) {
+	switch {
+	case f.isNaN(a) || f.isNaN(b):
+		return f.nanResult(a, b)
+	case f.isInf(a) && f.isInf(b):
+		if f.signOf(a) != f.signOf(b) {
+			return f.canonicalNaN, flagNV
+		}
+		return a, 0
+	case f.isInf(a):
+		return a, 0
+	case f.isInf(b):
+		return b, 0
+	}
+	if result, flags, ok := f.fastPath(a, b, rm, opAdd); ok {
+		return result, flags
+	}
+	z := newWide().Add(f.big(a), f.big(b))
+	if z.Sign() == 0 {
+		//exact zero sums are +0 unless both operands are -0 or rounding down
+		return f.zero((f.signOf(a) && f.signOf(b)) || (f.signOf(a) != f.signOf(b) && rm == rmRDN)), 0
+	}
+	return f.roundOdd(z, rm)
+}
+
+//fpMul returns a*b
+func (f fpFormat) fpMul(a uint64, b uint64, rm uint64) (uint64, uint8) {
+	neg := f.signOf(a) != f.signOf(b)
+	switch {
+	case f.isNaN(a) || f.isNaN(b):
+		return f.nanResult(a, b)
+	case (f.isInf(a) && f.isZero(b)) || (f.isZero(a) && f.isInf(b)):
+		return f.canonicalNaN, flagNV
+	case f.isInf(a) || f.isInf(b):
+		return f.inf(neg), 0
+	case f.isZero(a) || f.isZero(b):
+		return f.zero(neg), 0
+	}
+	if result, flags, ok := f.fastPath(a, b, rm, opMul); ok {
+		return result, flags
+	}
+	return f.roundOdd(newWide().Mul(f.big(a), f.big(b)), rm)
+}
+
+//fpDiv returns a/b
+func (f fpFormat) fpDiv(a uint64, b uint64, rm uint64) (uint64, uint8) {
+	neg := f.signOf(a) != f.signOf(b)
+	switch {
+	case f.isNaN(a) || f.isNaN(b):
+		return f.nanResult(a, b)
+	case (f.isInf(a) && f.isInf(b)) || (f.isZero(a) && f.isZero(b)):
+		return f.canonicalNaN, flagNV
+	case f.isInf(a):
+		return f.inf(neg), 0
+	case f.isInf(b):
+		return f.zero(neg), 0
+	case f.isZero(b):
+		return f.inf(neg), flagDZ
+	case f.isZero(a):
+		return f.zero(neg), 0
+	}
+	if result, flags, ok := f.fastPath(a, b, rm, opDiv); ok {
+		return result, flags
+	}
+	return f.roundOdd(newWide().Quo(f.big(a), f.big(b)), rm)
+}
+
+//fpSqrt returns the square root of a
+func (f fpFormat) fpSqrt(a uint64, rm uint64) (uint64, uint8) {
+	switch {
+	case f.isNaN(a):
+		return f.nanResult(a)
+	case f.isZero(a):
+		return a, 0
+	case f.signOf(a):
+		return f.canonicalNaN, flagNV
+	case f.isInf(a):
+		return a, 0
+	}
+	if result, flags, ok := f.fastPath(a, 0, rm, opSqrt); ok {
+		return result, flags
+	}
+	x := f.big(a)
+	r := newWide().Sqrt(x)
+	//make sure r is truncated, r*r must not exceed x
+	sq := new(big.Float).SetPrec(2*wide).Mul(r, r)
+	for sq.Cmp(x) > 0 {
+		ulp := new(big.Float).SetMantExp(big.NewFloat(1), r.MantExp(nil)-int(wide))
+		r.Sub(r, ulp)
+		sq.Mul(r, r)
+	}
+	return f.round(r, sq.Cmp(x) != 0, rm)
+}
+
+//fpFMA returns (a*b)+c, negating the product and the addend as requested
+func (f fpFormat) fpFMA(a uint64, b uint64, c uint64, negProduct bool, negAddend bool, rm uint64) (uint64, uint8) {
+	//inf*0 is invalid even if the addend is a quiet NaN
+	if (f.isInf(a) && f.isZero(b)) || (f.isZero(a) && f.isInf(b)) {
+		_, flags := f.nanResult(c)
+		return f.canonicalNaN, flags | flagNV
+	}
+	if f.isNaN(a) || f.isNaN(b) || f.isNaN(c) {
+		return f.nanResult(a, b, c)
+	}
+	productNeg := (f.signOf(a) != f.signOf(b)) != negProduct
+	if negAddend {
+		c ^= f.signBit
+	}
+	productInf := f.isInf(a) || f.isInf(b)
+	switch {
+	case productInf && f.isInf(c) && productNeg != f.signOf(c):
+		return f.canonicalNaN, flagNV
+	case productInf:
+		return f.inf(productNeg), 0
+	case f.isInf(c):
+		return c, 0
+	}
+	product := new(big.Float).SetPrec(wide).Mul(f.big(a), f.big(b))
+	if productNeg != product.Signbit() {
+		product.Neg(product)
+	}
+	z := newWide().Add(product, f.big(c))
+	if z.Sign() == 0 {
+		return f.zero((productNeg && f.signOf(c)) || (productNeg != f.signOf(c) && rm == rmRDN)), 0
+	}
+	return f.roundOdd(z, rm)
+}
+
+//Operations of the native fast path
+const (
+	opAdd = iota
+	opMul
+	opDiv
+	opSqrt
+)
+
+//fastPath computes round to nearest even results with host floating point
+//when the result is a normal number far enough from the subnormal range for
+//the error terms to be exact. ok is false if the slow path has to be taken.
+func (f fpFormat) fastPath(a uint64, b uint64, rm uint64, op int) (uint64, uint8, bool) {
+	if rm != rmRNE {
+		return 0, 0, false
+	}
+	x, y := f.float64(a), f.float64(b)
+	var r, e float64
+	switch op {
+	case opAdd:
+		r = x + y
+		//TwoSum gives the exact error of the addition
+		bv := r - x
+		e = (x - (r - bv)) + (y - bv)
+	case opMul:
+		r = x * y
+		e = math.FMA(x, y, -r)
+	case opDiv:
+		r = x / y
+		e = math.FMA(-r, y, x)
+	case opSqrt:
+		r = math.Sqrt(x)
+		e = math.FMA(-r, r, x)
+	}
+	if math.IsInf(r, 0) || math.IsNaN(r) || math.Abs(r) < 0x1p-900 || math.Abs(x) < 0x1p-900 {
+		return 0, 0, false
+	}
+	if f.mant == fmtD.mant {
+		if math.Abs(r) > math.MaxFloat64/2 {
+			return 0, 0, false
+		}
+		if e != 0 {
+			return math.Float64bits(r), flagNX, true
+		}
+		return math.Float64bits(r), 0, true
+	}
+	//singles are computed in double, sums are only used if exact
+	if op == opAdd && e != 0 {
+		return 0, 0, false
+	}
+	s := float32(r)
+	if math.Abs(float64(s)) < 0x1p-126 || math.Abs(float64(s)) > math.MaxFloat32/2 {
+		return 0, 0, false
+	}
+	if e != 0 || float64(s) != r {
+		return uint64(math.Float32bits(s)), flagNX, true
+	}
+	return uint64(math.Float32bits(s)), 0, true
+}
+
+//fpMinMax returns the minimum or maximum, -0 is less than +0
+func (f fpFormat) fpMinMax(a uint64, b uint64, max bool) (uint64, uint8) {
+	var flags uint8
+	if f.isSNaN(a) || f.isSNaN(b) {
+		flags = flagNV
+	}
+	switch {
+	case f.isNaN(a) && f.isNaN(b):
+		return f.canonicalNaN, flags
+	case f.isNaN(a):
+		return b, flags
+	case f.isNaN(b):
+		return a, flags
+	}
+	less := f.less(a, b)
+	if less != max {
+		return a, flags
+	}
+	return b, flags
+}
+
+//less orders non NaN values with -0 below +0
+func (f fpFormat) less(a uint64, b uint64) bool {
+	if f.isZero(a) && f.isZero(b) {
+		return f.signOf(a) && !f.signOf(b)
+	}
+	return f.float64(a) < f.float64(b)
+}
+
+//fpCompare implements feq (quiet), flt and fle (signaling)
+func (f fpFormat) fpCompare(a uint64, b uint64, funct3 uint64) (uint64, uint8) {
+	if f.isNaN(a) || f.isNaN(b) {
+		if funct3 == 0x2 {
+			//feq only signals for signaling NaN
+			_, flags := f.nanResult(a, b)
+			return 0, flags
+		}
+		return 0, flagNV
+	}
+	x, y := f.float64(a), f.float64(b)
+	var result bool
+	switch funct3 {
+	case 0x0:
+		result = x <= y
+	case 0x1:
+		result = x < y
+	default:
+		result = x == y
+	}
+	if result {
+		return 1, 0
+	}
+	return 0, 0
+}
+
+//fpClass returns the fclass mask of a
+func (f fpFormat) fpClass(a uint64) uint64 {
+	neg := f.signOf(a)
+	exp := a & f.expMask
+	switch {
+	case f.isInf(a) && neg:
+		return 1 << 0
+	case f.isInf(a):
+		return 1 << 7
+	case f.isSNaN(a):
+		return 1 << 8
+	case f.isNaN(a):
+		return 1 << 9
+	case f.isZero(a) && neg:
+		return 1 << 3
+	case f.isZero(a):
+		return 1 << 4
+	case exp == 0 && neg:
+		return 1 << 2
+	case exp == 0:
+		return 1 << 5
+	case neg:
+		return 1 << 1
+	default:
+		return 1 << 6
+	}
+}
+
+//fpToInt converts a to a signed or unsigned integer of size bits, out of
+//range values and NaN saturate and raise invalid
+func (f fpFormat) fpToInt(a uint64, signed bool, size uint, rm uint64) (uint64, uint8) {
+	var min, max *big.Int
+	if signed {
+		max = new(big.Int).Lsh(big.NewInt(1), size-1)
+		min = new(big.Int).Neg(max)
+		max.Sub(max, big.NewInt(1))
+	} else {
+		max = new(big.Int).Lsh(big.NewInt(1), size)
+		max.Sub(max, big.NewInt(1))
+		min = big.NewInt(0)
+	}
+	var result *big.Int
+	var flags uint8
+	switch {
+	case f.isNaN(a):
+		result, flags = max, flagNV
+	case f.isInf(a) && f.signOf(a):
+		result, flags = min, flagNV
+	case f.isInf(a):
+		result, flags = max, flagNV
+	default:
+		x := f.big(a)
+		i, inexact := quantize(x, 0, false, rm)
+		if x.Signbit() {
+			i.Neg(i)
+		}
+		switch {
+		case i.Cmp(max) > 0:
+			result, flags = max, flagNV
+		case i.Cmp(min) < 0:
+			result, flags = min, flagNV
+		default:
+			result = i
+			if inexact {
+				flags = flagNX
+			}
+		}
+	}
+	var value uint64
+	if result.Sign() < 0 {
+		value = uint64(result.Int64())
+	} else {
+		value = result.Uint64()
+	}
+	//32 bit results are sign extended, also the unsigned ones
+	if size == 32 {
+		value = uint64(int64(int32(value)))
+	}
+	return value, flags
+}
+
+//fpFromInt converts an integer to the format
+func (f fpFormat) fpFromInt(value uint64, signed bool, rm uint64) (uint64, uint8) {
+	x := new(big.Float).SetPrec(64)
+	if signed {
+		x.SetInt64(int64(value))
+	} else {
+		x.SetUint64(value)
+	}
+	return f.round(x, false, rm)
+}
+
+//fpConvert converts a of format from to the format f
+func (f fpFormat) fpConvert(from fpFormat, a uint64, rm uint64) (uint64, uint8) {
+	switch {
+	case from.isNaN(a):
+		_, flags := from.nanResult(a)
+		return f.canonicalNaN, flags
+	case from.isInf(a):
+		return f.inf(from.signOf(a)), 0
+	}
+	return f.round(from.big(a), false, rm)
+}
@@ -0,0 +1,227 @@
+package cpu
+
+import (
+	"errors"
+	"fmt"
+)
+
+//Exception codes of mcause, interrupts have causeInterrupt set
+const (
+	causeFetchMisaligned    uint64 = 0
+	causeFetchAccessFault   uint64 = 1
+	causeIllegalInstruction uint64 = 2
+	causeBreakpoint         uint64 = 3
+	causeLoadMisaligned     uint64 = 4
+	causeLoadAccessFault    uint64 = 5
+	causeStoreMisaligned    uint64 = 6
+	causeStoreAccessFault   uint64 = 7
+	causeEcallU             uint64 = 8
+	causeEcallS             uint64 = 9
+	causeEcallM             uint64 = 11
+	causeFetchPageFault     uint64 = 12
+	causeLoadPageFault      uint64 = 13
+	causeStorePageFault     uint64 = 15
+	causeInterrupt          uint64 = 1 << 63
+)
+
+var causeNames = map[uint64]string{
+	causeFetchMisaligned:    "instruction address misaligned",
+	causeFetchAccessFault:   "instruction access fault",
+	causeIllegalInstruction: "illegal instruction",
+	causeBreakpoint:         "breakpoint",
+	causeLoadMisaligned:     "load address misaligned",
+	causeLoadAccessFault:    "load access fault",
+	causeStoreMisaligned:    "store/AMO address misaligned",
+	causeStoreAccessFault:   "store/AMO access fault",
+	causeEcallU:             "environment call from U-mode",
+	causeEcallS:             "environment call from S-mode",
+	causeEcallM:             "environment call from M-mode",
+	causeFetchPageFault:     "instruction page fault",
+	causeLoadPageFault:      "load page fault",
+	causeStorePageFault:     "store/AMO page fault",
+}
+
+var interruptNames = map[uint64]string{
+	1:  "supervisor software interrupt",
+	3:  "machine software interrupt",
+	5:  "supervisor timer interrupt",
+	7:  "machine timer interrupt",
+	9:  "supervisor external interrupt",
+	11: "machine external interrupt",
+}
+
+//privNames are the letters of the privilege levels
+var privNames = map[uint64]string{privUser: "U", privSupervisor: "S", privMachine: "M"}
+
+//Trap is a trap the hart took, or one which ended the run because no
+//handler was installed
+type Trap struct {
+	//Cause is the value written to mcause or scause
+	Cause uint64
+	//Tval is the value written to mtval or stval
+	Tval uint64
+	//EPC is the pc of the interrupted instruction
+	EPC uint64
+	//From and To are the privilege levels before and in the handler
+	From uint64
+	To   uint64
+	//Halted is set if the trap ended the run
+	Halted bool
+}
+
+func (t Trap) String() string {
+	var name string
+	var ok bool
+	if t.Cause&causeInterrupt != 0 {
+		name, ok = interruptNames[t.Cause&^causeInterrupt]
+	} else {
+		name, ok = causeNames[t.Cause]
+	}
+	if !ok {
+		name = fmt.Sprintf("cause %#x", t.Cause)
+	}
+	to := privNames[t.To] + "-mode handler"
+	if t.Halted {
+		to = "halt, no handler"
+	}
+	return fmt.Sprintf("%s at pc %#x, tval %#x, from %s-mode to %s", name, t.EPC, t.Tval, privNames[t.From], to)
+}
+
+//LastTrap returns the last trap of the hart, ok is false if there was none
+func (cpu *CPU) LastTrap() (trap Trap, ok bool) {
+	return cpu.lastTrap, cpu.trapped
+}
+
+//Exception is a synchronous trap raised by an instruction
+type Exception struct {
+	//Cause is the exception code written to mcause
+	Cause uint64
+	//Tval is written to mtval, the faulting address or instruction
+	Tval uint64
+	//Err is the underlying failure, it may be nil
+	Err error
+}
+
+func (e *Exception) Error() string {
+	name, ok := causeNames[e.Cause]
+	if !ok {
+		name = fmt.Sprintf("exception %d", e.Cause)
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("%s, mtval %#x: %v", name, e.Tval, e.Err)
+	}
+	return fmt.Sprintf("%s, mtval %#x", name, e.Tval)
+}
+
+//exceptionOf turns an execution error into an exception. Errors which are
+//not exceptions already mean the instruction is illegal.
+func exceptionOf(err error, instruction uint64) *Exception {
+	var exc *Exception
+	if errors.As(err, &exc) {
+		return exc
+	}
+	return &Exception{Cause: causeIllegalInstruction, Tval: instruction, Err: err}
+}
+
+//trapsHalt reports whether exceptions end the run. Under the exit convention
+//ecall and ebreak end it and any other exception stops the simulation.
+//Interrupts the program enables are taken either way.
+func (cpu *CPU) trapsHalt() bool {
+	return cpu.exitConvention
+}
+
+//raise takes the exception of the instruction at pc
+func (cpu *CPU) raise(exc *Exception, pc uint64) *StopReason {
+	if cpu.trapsHalt() {
+		cpu.lastTrap = Trap{Cause: exc.Cause, Tval: exc.Tval, EPC: pc, From: cpu.priv, To: cpu.priv, Halted: true}
+		cpu.trapped = true
+		return &StopReason{Kind: StopTrap, PC: pc, Err: exc}
+	}
+	cpu.takeTrap(exc.Cause, exc.Tval, pc)
+	return nil
+}
+
+//takeTrap enters the trap handler, epc is the pc of the interrupted
+//instruction. Traps from S and U-mode go to the supervisor handler when
+//medeleg or mideleg delegate them, all others to machine mode.
+func (cpu *CPU) takeTrap(cause uint64, tval uint64, epc uint64) {
+	deleg := cpu.csrs[csrMedeleg]
+	if cause&causeInterrupt != 0 {
+		deleg = cpu.csrs[csrMideleg]
+	}
+	cpu.lastTrap = Trap{Cause: cause, Tval: tval, EPC: epc, From: cpu.priv, To: privMachine}
+	cpu.trapped = true
+	//a trap drops the lr reservation
+	cpu.release(cpu.reservation)
+	if cpu.priv <= privSupervisor && (deleg>>(cause&^causeInterrupt))&0x1 != 0 {
+		cpu.lastTrap.To = privSupervisor
+		cpu.csrs[csrSepc] = epc
+		cpu.csrs[csrScause] = cause
+		cpu.csrs[csrStval] = tval
+		//SPIE keeps SIE and SPP the privilege the trap came from
+		sie := (cpu.mstatus & mstatusSIE) >> 1
+		cpu.mstatus = cpu.mstatus&^(mstatusSIE|mstatusSPIE|mstatusSPP) | sie<<5 | cpu.priv<<8
+		cpu.priv = privSupervisor
+		cpu.pc = trapVector(cpu.csrs[csrStvec], cause)
+		return
+	}
+
+	cpu.csrs[csrMepc] = epc
+	cpu.csrs[csrMcause] = cause
+	cpu.csrs[csrMtval] = tval
+	//MPIE keeps MIE and MPP the privilege the trap came from
+	mie := (cpu.mstatus & mstatusMIE) >> 3
+	cpu.mstatus = cpu.mstatus&^(mstatusMIE|mstatusMPIE|mstatusMPP) | mie<<7 | cpu.priv<<11
+	cpu.priv = privMachine
+	cpu.pc = trapVector(cpu.csrs[csrMtvec], cause)
+}
+
+//trapVector returns the handler address for cause, vectored mode sends
+//interrupts to base + 4 * cause
+func trapVector(tvec uint64, cause uint64) uint64 {
+	base := tvec &^ 0x3
+	if tvec&0x3 == 0x1 && cause&causeInterrupt != 0 {
+		return base + 4*(cause&^causeInterrupt)
+	}
+	return base
+}
+
+//mret returns from a machine mode trap handler
+func (cpu *CPU) mret() error {
+	if cpu.priv < privMachine {
+		return errors.New("Could not execute mret below machine mode")
+	}
+	mpp := (cpu.mstatus & mstatusMPP) >> 11
+	mpie := (cpu.mstatus & mstatusMPIE) >> 7
+	//MIE gets MPIE back, MPIE is set and MPP falls to user mode
+	cpu.mstatus = cpu.mstatus&^(mstatusMIE|mstatusMPP) | mpie<<3 | mstatusMPIE | privUser<<11
+	//MPRV only stays set when returning to machine mode
+	if mpp != privMachine {
+		cpu.mstatus &^= mstatusMPRV
+	}
+	cpu.priv = mpp
+	cpu.pc = cpu.csrs[csrMepc]
+	return nil
+}
+
+//sret returns from a supervisor trap handler, mstatus.TSR traps it in supervisor mode
+func (cpu *CPU) sret() error {
+	if cpu.priv < privSupervisor || cpu.priv == privSupervisor && cpu.mstatus&mstatusTSR != 0 {
+		return errors.New("Could not execute sret at this privilege")
+	}
+	spp := (cpu.mstatus & mstatusSPP) >> 8
+	spie := (cpu.mstatus & mstatusSPIE) >> 5
+	cpu.mstatus = cpu.mstatus&^(mstatusSIE|mstatusSPP|mstatusMPRV) | spie<<1 | mstatusSPIE
+	cpu.priv = spp
+	cpu.pc = cpu.csrs[csrSepc]
+	return nil
+}
+
+//wfi is illegal in user mode and, with mstatus.TW, in supervisor mode
+func (cpu *CPU) wfi() error {
+	if cpu.priv == privUser || cpu.priv == privSupervisor && cpu.mstatus&mstatusTW != 0 {
+		return errors.New("Could not execute wfi at this privilege")
+	}
+	//there is nothing to wait for as long as no device raises interrupts, wfi is a nop
+	return nil
+}
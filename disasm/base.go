@@ -0,0 +1,383 @@
+package disasm
+
+import "strings"
+
+//Mnemonics of the base instructions indexed by funct3
+var (
+	loads    = [8]string{"lb", "lh", "lw", "ld", "lbu", "lhu", "lwu", "ldu"}
+	stores   = [8]string{"sb", "sh", "sw", "sd"}
+	branches = [8]string{"beq", "bne", "", "", "blt", "bge", "bltu", "bgeu"}
+	immOps   = [8]string{"addi", "slli", "slti", "sltiu", "xori", "srli", "ori", "andi"}
+	regOps   = [8]string{"add", "sll", "slt", "sltu", "xor", "srl", "or", "and"}
+	mulOps   = [8]string{"mul", "mulh", "mulhsu", "mulhu", "div", "divu", "rem", "remu"}
+	csrOps   = [8]string{"", "csrrw", "csrrs", "csrrc", "", "csrrwi", "csrrsi", "csrrci"}
+)
+
+//amoOps are the RV64A mnemonics indexed by funct5
+var amoOps = map[uint64]string{
+	0x00: "amoadd",
+	0x01: "amoswap",
+	0x02: "lr",
+	0x03: "sc",
+	0x04: "amoxor",
+	0x08: "amoor",
+	0x0c: "amoand",
+	0x10: "amomin",
+	0x14: "amomax",
+	0x18: "amominu",
+	0x1c: "amomaxu",
+}
+
+//decode returns the assembly of a 32 bit instruction, an empty string if
+//the hart does not execute it
+func decode(inst uint64, pc uint64) string {
+	opcode := inst & 0x7f
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	funct3 := (inst >> 12) & 0x7
+	funct7 := (inst >> 25) & 0x7f
+	immI := uint64(int64(int32(inst)) >> 20)
+
+	switch opcode {
+	case 0x03:
+		return format(loads[funct3], x(rd), offset(immI, rs1))
+	case 0x07, 0x27, 0x43, 0x47, 0x4b, 0x4f, 0x53:
+		return decodeFloat(inst)
+	case 0x0f:
+		return decodeFence(inst)
+	case 0x13:
+		return decodeOpImm(inst, rd, rs1, funct3, immI)
+	case 0x17:
+		return format("auipc", x(rd), hex(inst>>12&0xfffff))
+	case 0x1b:
+		return decodeOpImmW(inst, rd, rs1, funct3, immI)
+	case 0x23:
+		immS := uint64(int64(int32(inst&0xfe000000))>>20) | rd
+		if funct3 > 0x3 {
+			return ""
+		}
+		return format(stores[funct3], x(rs2), offset(immS, rs1))
+	case 0x2f:
+		return decodeAtomic(inst, rd, rs1, rs2, funct3)
+	case 0x33:
+		return decodeOp(rd, rs1, rs2, funct3, funct7)
+	case 0x37:
+		return format("lui", x(rd), hex(inst>>12&0xfffff))
+	case 0x3b:
+		return decodeOpW(rd, rs1, rs2, funct3, funct7)
+	case 0x63:
+		//imm[12|10:5|4:1|11]
+		immB := uint64(int64(int32(inst&0x80000000))>>19) | ((inst & 0x80) << 4) | ((inst >> 20) & 0x7e0) | ((inst >> 7) & 0x1e)
+		return decodeBranch(rs1, rs2, funct3, pc+immB)
+	case 0x67:
+		if funct3 != 0x0 {
+			return ""
+		}
+		switch {
+		case rd == 0 && rs1 == 1 && immI == 0:
+			return "ret"
+		case rd == 0 && immI == 0:
+			return format("jr", x(rs1))
+		case rd == 1 && immI == 0:
+			return format("jalr", x(rs1))
+		}
+		return format("jalr", x(rd), offset(immI, rs1))
+	case 0x6f:
+		//imm[20|10:1|11|19:12]
+		immJ := uint64(int64(int32(inst&0x80000000))>>11) | (inst & 0xff000) | ((inst >> 9) & 0x800) | ((inst >> 20) & 0x7fe)
+		switch rd {
+		case 0:
+			return format("j", hex(pc+immJ))
+		case 1:
+			return format("jal", hex(pc+immJ))
+		}
+		return format("jal", x(rd), hex(pc+immJ))
+	case 0x73:
+		return decodeSystem(inst, rd, rs1, rs2, funct3, funct7)
+	}
+	return ""
+}
+
+func decodeOpImm(inst, rd, rs1, funct3, value uint64) string {
+	switch funct3 {
+	case 0x0:
+		switch {
+		case rd == 0 && rs1 == 0 && value == 0:
+			return "nop"
+		case rs1 == 0:
+			return format("li", x(rd), imm(value))
+		case value == 0:
+			return format("mv", x(rd), x(rs1))
+		}
+	case 0x1:
+		//RV64I uses inst[25] as bit 5 of shamt
+		if inst>>26 != 0x00 {
+			return ""
+		}
+		return format("slli", x(rd), x(rs1), imm(value&0x3f))
+	case 0x3:
+		if value == 1 {
+			return format("seqz", x(rd), x(rs1))
+		}
+	case 0x4:
+		if int64(value) == -1 {
+			return format("not", x(rd), x(rs1))
+		}
+	case 0x5:
+		switch inst >> 26 {
+		case 0x00:
+			return format("srli", x(rd), x(rs1), imm(value&0x3f))
+		case 0x10:
+			return format("srai", x(rd), x(rs1), imm(value&0x3f))
+		}
+		return ""
+	}
+	return format(immOps[funct3], x(rd), x(rs1), imm(value))
+}
+
+func decodeOpImmW(inst, rd, rs1, funct3, value uint64) string {
+	switch funct3 {
+	case 0x0:
+		if value == 0 {
+			return format("sext.w", x(rd), x(rs1))
+		}
+		return format("addiw", x(rd), x(rs1), imm(value))
+	case 0x1:
+		if inst>>25 == 0x00 {
+			return format("slliw", x(rd), x(rs1), imm(value&0x1f))
+		}
+	case 0x5:
+		switch inst >> 25 {
+		case 0x00:
+			return format("srliw", x(rd), x(rs1), imm(value&0x1f))
+		case 0x20:
+			return format("sraiw", x(rd), x(rs1), imm(value&0x1f))
+		}
+	}
+	return ""
+}
+
+func decodeOp(rd, rs1, rs2, funct3, funct7 uint64) string {
+	switch funct7 {
+	case 0x00:
+		switch {
+		case funct3 == 0x0 && rs1 == 0:
+			return format("mv", x(rd), x(rs2))
+		case funct3 == 0x3 && rs1 == 0:
+			return format("snez", x(rd), x(rs2))
+		case funct3 == 0x2 && rs2 == 0:
+			return format("sltz", x(rd), x(rs1))
+		case funct3 == 0x2 && rs1 == 0:
+			return format("sgtz", x(rd), x(rs2))
+		}
+		return format(regOps[funct3], x(rd), x(rs1), x(rs2))
+	case 0x01:
+		return format(mulOps[funct3], x(rd), x(rs1), x(rs2))
+	case 0x20:
+		switch funct3 {
+		case 0x0:
+			if rs1 == 0 {
+				return format("neg", x(rd), x(rs2))
+			}
+			return format("sub", x(rd), x(rs1), x(rs2))
+		case 0x5:
+			return format("sra", x(rd), x(rs1), x(rs2))
+		}
+	}
+	return ""
+}
+
+func decodeOpW(rd, rs1, rs2, funct3, funct7 uint64) string {
+	switch funct7 {
+	case 0x00:
+		switch funct3 {
+		case 0x0:
+			return format("addw", x(rd), x(rs1), x(rs2))
+		case 0x1:
+			return format("sllw", x(rd), x(rs1), x(rs2))
+		case 0x5:
+			return format("srlw", x(rd), x(rs1), x(rs2))
+		}
+	case 0x01:
+		switch funct3 {
+		case 0x0, 0x4, 0x5, 0x6, 0x7:
+			return format(mulOps[funct3]+"w", x(rd), x(rs1), x(rs2))
+		}
+	case 0x20:
+		switch funct3 {
+		case 0x0:
+			if rs1 == 0 {
+				return format("negw", x(rd), x(rs2))
+			}
+			return format("subw", x(rd), x(rs1), x(rs2))
+		case 0x5:
+			return format("sraw", x(rd), x(rs1), x(rs2))
+		}
+	}
+	return ""
+}
+
+func decodeBranch(rs1, rs2, funct3, target uint64) string {
+	name := branches[funct3]
+	if name == "" {
+		return ""
+	}
+	switch {
+	case rs2 == 0 && funct3 <= 0x1:
+		return format(name+"z", x(rs1), hex(target))
+	case rs2 == 0 && funct3 == 0x4:
+		return format("bltz", x(rs1), hex(target))
+	case rs2 == 0 && funct3 == 0x5:
+		return format("bgez", x(rs1), hex(target))
+	case rs1 == 0 && funct3 == 0x4:
+		return format("bgtz", x(rs2), hex(target))
+	case rs1 == 0 && funct3 == 0x5:
+		return format("blez", x(rs2), hex(target))
+	}
+	return format(name, x(rs1), x(rs2), hex(target))
+}
+
+//fenceSet formats the predecessor or successor set of a fence
+func fenceSet(bits uint64) string {
+	var s strings.Builder
+	for i, c := range "iorw" {
+		if bits&(0x8>>uint(i)) != 0 {
+			s.WriteRune(c)
+		}
+	}
+	return s.String()
+}
+
+func decodeFence(inst uint64) string {
+	switch (inst >> 12) & 0x7 {
+	case 0x0:
+		pred := (inst >> 24) & 0xf
+		succ := (inst >> 20) & 0xf
+		switch {
+		case inst>>28 == 0x8 && pred == 0x3 && succ == 0x3:
+			return "fence.tso"
+		case pred == 0xf && succ == 0xf:
+			return "fence"
+		case pred == 0 || succ == 0:
+			return format("fence", hex(pred), hex(succ))
+		}
+		return format("fence", fenceSet(pred), fenceSet(succ))
+	case 0x1:
+		return "fence.i"
+	}
+	return ""
+}
+
+func decodeAtomic(inst, rd, rs1, rs2, funct3 uint64) string {
+	var width string
+	switch funct3 {
+	case 0x2:
+		width = ".w"
+	case 0x3:
+		width = ".d"
+	default:
+		return ""
+	}
+	name, ok := amoOps[inst>>27]
+	if !ok {
+		return ""
+	}
+	name += width
+	switch (inst >> 25) & 0x3 {
+	case 0x1:
+		name += ".rl"
+	case 0x2:
+		name += ".aq"
+	case 0x3:
+		name += ".aqrl"
+	}
+	switch inst >> 27 {
+	case 0x02:
+		if rs2 != 0 {
+			return ""
+		}
+		return format(name, x(rd), "("+x(rs1)+")")
+	}
+	return format(name, x(rd), x(rs2), "("+x(rs1)+")")
+}
+
+//counters are read by the rdcycle, rdtime and rdinstret pseudo instructions
+var counters = map[uint64]string{
+	0xc00: "rdcycle",
+	0xc01: "rdtime",
+	0xc02: "rdinstret",
+}
+
+//fcsrAliases are the pseudo instructions for the floating point CSRs,
+//indexed by address, the read, the swap and the write form
+var fcsrAliases = map[uint64][3]string{
+	0x001: {"frflags", "fsflags", "fsflags"},
+	0x002: {"frrm", "fsrm", "fsrm"},
+	0x003: {"frcsr", "fscsr", "fscsr"},
+}
+
+func decodeSystem(inst, rd, rs1, rs2, funct3, funct7 uint64) string {
+	addr := inst >> 20
+	if funct3 == 0x0 {
+		if rd != 0 {
+			return ""
+		}
+		if funct7 == 0x09 {
+			switch {
+			case rs1 == 0 && rs2 == 0:
+				return "sfence.vma"
+			case rs2 == 0:
+				return format("sfence.vma", x(rs1))
+			}
+			return format("sfence.vma", x(rs1), x(rs2))
+		}
+		if rs1 != 0 {
+			return ""
+		}
+		switch addr {
+		case 0x000:
+			return "ecall"
+		case 0x001:
+			return "ebreak"
+		case 0x102:
+			return "sret"
+		case 0x105:
+			return "wfi"
+		case 0x302:
+			return "mret"
+		}
+		return ""
+	}
+	name := csrOps[funct3]
+	if name == "" {
+		return ""
+	}
+	csr := CSRName(addr)
+	if funct3 >= 0x5 {
+		//the immediate forms use the rs1 field as 5 bit zero extended value
+		if rd == 0 {
+			return format("csr"+name[4:5]+"i", csr, imm(rs1))
+		}
+		return format(name, x(rd), csr, imm(rs1))
+	}
+	alias, fp := fcsrAliases[addr]
+	switch {
+	case funct3 == 0x2 && rs1 == 0:
+		if counter, ok := counters[addr]; ok {
+			return format(counter, x(rd))
+		}
+		if fp {
+			return format(alias[0], x(rd))
+		}
+		return format("csrr", x(rd), csr)
+	case funct3 == 0x1 && fp:
+		if rd == 0 {
+			return format(alias[2], x(rs1))
+		}
+		return format(alias[1], x(rd), x(rs1))
+	case rd == 0:
+		return format("csr"+name[4:5], csr, x(rs1))
+	}
+	return format(name, x(rd), csr, x(rs1))
+}
@@ -0,0 +1,163 @@
+package disasm
+
+import (
+	"fmt"
+	"rvsim/rvc"
+	"strings"
+)
+
+const debug bool = false
+
+//xNames and fNames are the ABI names of the registers
+var xNames = [32]string{
+	"zero", "ra", "sp", "gp", "tp", "t0", "t1", "t2",
+	"s0", "s1", "a0", "a1", "a2", "a3", "a4", "a5",
+	"a6", "a7", "s2", "s3", "s4", "s5", "s6", "s7",
+	"s8", "s9", "s10", "s11", "t3", "t4", "t5", "t6",
+}
+
+var fNames = [32]string{
+	"ft0", "ft1", "ft2", "ft3", "ft4", "ft5", "ft6", "ft7",
+	"fs0", "fs1", "fa0", "fa1", "fa2", "fa3", "fa4", "fa5",
+	"fa6", "fa7", "fs2", "fs3", "fs4", "fs5", "fs6", "fs7",
+	"fs8", "fs9", "fs10", "fs11", "ft8", "ft9", "ft10", "ft11",
+}
+
+//csrNames are the names of the CSRs the hart implements
+var csrNames = map[uint64]string{
+	0x001: "fflags",
+	0x002: "frm",
+	0x003: "fcsr",
+	0xc00: "cycle",
+	0xc01: "time",
+	0xc02: "instret",
+	0x100: "sstatus",
+	0x104: "sie",
+	0x105: "stvec",
+	0x106: "scounteren",
+	0x140: "sscratch",
+	0x141: "sepc",
+	0x142: "scause",
+	0x143: "stval",
+	0x144: "sip",
+	0x180: "satp",
+	0xf11: "mvendorid",
+	0xf12: "marchid",
+	0xf13: "mimpid",
+	0xf14: "mhartid",
+	0xf15: "mconfigptr",
+	0x300: "mstatus",
+	0x301: "misa",
+	0x302: "medeleg",
+	0x303: "mideleg",
+	0x304: "mie",
+	0x305: "mtvec",
+	0x306: "mcounteren",
+	0x320: "mcountinhibit",
+	0x340: "mscratch",
+	0x341: "mepc",
+	0x342: "mcause",
+	0x343: "mtval",
+	0x344: "mip",
+	0xb00: "mcycle",
+	0xb02: "minstret",
+}
+
+func init() {
+	//the counters, the hardware performance monitor and the PMP registers
+	//are numbered
+	for i := uint64(3); i <= 31; i++ {
+		csrNames[0xc00+i] = fmt.Sprintf("hpmcounter%d", i)
+		csrNames[0xb00+i] = fmt.Sprintf("mhpmcounter%d", i)
+		csrNames[0x320+i] = fmt.Sprintf("mhpmevent%d", i)
+	}
+	for i := uint64(0); i < 16; i += 2 {
+		csrNames[0x3a0+i] = fmt.Sprintf("pmpcfg%d", i)
+	}
+	for i := uint64(0); i < 64; i++ {
+		csrNames[0x3b0+i] = fmt.Sprintf("pmpaddr%d", i)
+	}
+}
+
+//RegName returns the ABI name of register x[i]
+func RegName(i int) string {
+	return xNames[i&0x1f]
+}
+
+//FRegName returns the ABI name of register f[i]
+func FRegName(i int) string {
+	return fNames[i&0x1f]
+}
+
+//CSRName returns the name of the CSR at addr, its address in hex if it has none
+func CSRName(addr uint64) string {
+	if name, ok := csrNames[addr]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%x", addr)
+}
+
+//Length returns the length in bytes of the instruction starting with the
+//16 bit parcel low, 2 for compressed instructions
+func Length(low uint64) uint64 {
+	if low&0x3 != 0x3 {
+		return 2
+	}
+	return 4
+}
+
+//Disassemble returns the assembly of the instruction inst at pc, with ABI
+//register names and the common pseudo instructions. Compressed instructions
+//in the lower 16 bits of inst are shown as the instruction they expand to,
+//branch and jump targets as addresses. Encodings the hart does not execute
+//are shown as .half or .word directives.
+func Disassemble(inst uint64, pc uint64) string {
+	if Length(inst) == 2 {
+		expanded, err := rvc.Expand(inst & 0xffff)
+		if err != nil {
+			return fmt.Sprintf(".half 0x%04x", inst&0xffff)
+		}
+		inst = expanded
+	}
+	inst &= 0xffffffff
+	if s := decode(inst, pc); s != "" {
+		return s
+	}
+	return fmt.Sprintf(".word 0x%08x", inst)
+}
+
+//format writes the mnemonic padded to a column and its operands
+func format(mnemonic string, operands ...string) string {
+	if len(operands) == 0 {
+		return mnemonic
+	}
+	pad := 8 - len(mnemonic)
+	if pad < 1 {
+		pad = 1
+	}
+	return mnemonic + strings.Repeat(" ", pad) + strings.Join(operands, ", ")
+}
+
+//x and f name register fields
+func x(r uint64) string {
+	return xNames[r]
+}
+
+func f(r uint64) string {
+	return fNames[r]
+}
+
+//imm formats a signed immediate in decimal
+func imm(v uint64) string {
+	return fmt.Sprintf("%d", int64(v))
+}
+
+//hex formats an address or an unsigned value
+func hex(v uint64) string {
+	return fmt.Sprintf("0x%x", v)
+}
+
+//offset formats a memory operand
+func offset(v uint64, base uint64) string {
+	return fmt.Sprintf("%d(%s)", int64(v), x(base))
+}
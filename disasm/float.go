@@ -0,0 +1,179 @@
+package disasm
+
+//roundingModes are the names of the static rounding modes, dyn is not shown
+var roundingModes = [8]string{"rne", "rtz", "rdn", "rup", "rmm", "", "", ""}
+
+//fmaOps are the fused multiply add mnemonics indexed by opcode
+var fmaOps = map[uint64]string{
+	0x43: "fmadd",
+	0x47: "fmsub",
+	0x4b: "fnmsub",
+	0x4f: "fnmadd",
+}
+
+//arithOps are the rounding operations of opcode 0x53 indexed by funct5
+var arithOps = map[uint64]string{
+	0x00: "fadd",
+	0x01: "fsub",
+	0x02: "fmul",
+	0x03: "fdiv",
+}
+
+//intTypes are the integer types of fcvt indexed by rs2
+var intTypes = [4]string{"w", "wu", "l", "lu"}
+
+//rounded appends the rounding mode rm to the operands unless it is dynamic,
+//ok is false for the reserved modes
+func rounded(rm uint64, operands ...string) ([]string, bool) {
+	if rm == 0x7 {
+		return operands, true
+	}
+	if roundingModes[rm] == "" {
+		return nil, false
+	}
+	return append(operands, roundingModes[rm]), true
+}
+
+//decodeFloat returns the assembly of the F and D instructions
+func decodeFloat(inst uint64) string {
+	opcode := inst & 0x7f
+	rd := (inst >> 7) & 0x1f
+	rs1 := (inst >> 15) & 0x1f
+	rs2 := (inst >> 20) & 0x1f
+	funct3 := (inst >> 12) & 0x7
+
+	switch opcode {
+	case 0x07:
+		immI := uint64(int64(int32(inst)) >> 20)
+		switch funct3 {
+		case 0x2:
+			return format("flw", f(rd), offset(immI, rs1))
+		case 0x3:
+			return format("fld", f(rd), offset(immI, rs1))
+		}
+		return ""
+	case 0x27:
+		immS := uint64(int64(int32(inst&0xfe000000))>>20) | rd
+		switch funct3 {
+		case 0x2:
+			return format("fsw", f(rs2), offset(immS, rs1))
+		case 0x3:
+			return format("fsd", f(rs2), offset(immS, rs1))
+		}
+		return ""
+	}
+
+	//the fmt field inst[26:25] selects single or double precision
+	var suffix string
+	switch (inst >> 25) & 0x3 {
+	case 0x0:
+		suffix = ".s"
+	case 0x1:
+		suffix = ".d"
+	default:
+		return ""
+	}
+
+	if name, ok := fmaOps[opcode]; ok {
+		rs3 := inst >> 27
+		operands, ok := rounded(funct3, f(rd), f(rs1), f(rs2), f(rs3))
+		if !ok {
+			return ""
+		}
+		return format(name+suffix, operands...)
+	}
+
+	funct5 := inst >> 27
+	if name, ok := arithOps[funct5]; ok {
+		operands, ok := rounded(funct3, f(rd), f(rs1), f(rs2))
+		if !ok {
+			return ""
+		}
+		return format(name+suffix, operands...)
+	}
+	switch funct5 {
+	case 0x0b:
+		operands, ok := rounded(funct3, f(rd), f(rs1))
+		if !ok || rs2 != 0 {
+			return ""
+		}
+		return format("fsqrt"+suffix, operands...)
+	case 0x04:
+		if rs1 == rs2 {
+			switch funct3 {
+			case 0x0:
+				return format("fmv"+suffix, f(rd), f(rs1))
+			case 0x1:
+				return format("fneg"+suffix, f(rd), f(rs1))
+			case 0x2:
+				return format("fabs"+suffix, f(rd), f(rs1))
+			}
+		}
+		switch funct3 {
+		case 0x0:
+			return format("fsgnj"+suffix, f(rd), f(rs1), f(rs2))
+		case 0x1:
+			return format("fsgnjn"+suffix, f(rd), f(rs1), f(rs2))
+		case 0x2:
+			return format("fsgnjx"+suffix, f(rd), f(rs1), f(rs2))
+		}
+	case 0x05:
+		switch funct3 {
+		case 0x0:
+			return format("fmin"+suffix, f(rd), f(rs1), f(rs2))
+		case 0x1:
+			return format("fmax"+suffix, f(rd), f(rs1), f(rs2))
+		}
+	case 0x14:
+		switch funct3 {
+		case 0x0:
+			return format("fle"+suffix, x(rd), f(rs1), f(rs2))
+		case 0x1:
+			return format("flt"+suffix, x(rd), f(rs1), f(rs2))
+		case 0x2:
+			return format("feq"+suffix, x(rd), f(rs1), f(rs2))
+		}
+	case 0x1c:
+		switch {
+		case funct3 == 0x0 && rs2 == 0 && suffix == ".s":
+			return format("fmv.x.w", x(rd), f(rs1))
+		case funct3 == 0x0 && rs2 == 0:
+			return format("fmv.x.d", x(rd), f(rs1))
+		case funct3 == 0x1 && rs2 == 0:
+			return format("fclass"+suffix, x(rd), f(rs1))
+		}
+	case 0x1e:
+		switch {
+		case funct3 == 0x0 && rs2 == 0 && suffix == ".s":
+			return format("fmv.w.x", f(rd), x(rs1))
+		case funct3 == 0x0 && rs2 == 0:
+			return format("fmv.d.x", f(rd), x(rs1))
+		}
+	case 0x08:
+		//rs2 holds the source format
+		operands, ok := rounded(funct3, f(rd), f(rs1))
+		switch {
+		case !ok:
+		case suffix == ".s" && rs2 == 1:
+			return format("fcvt.s.d", operands...)
+		case suffix == ".d" && rs2 == 0:
+			//widening is exact, the rounding mode is not shown
+			return format("fcvt.d.s", f(rd), f(rs1))
+		}
+	case 0x18:
+		//rs2 selects the integer type
+		operands, ok := rounded(funct3, x(rd), f(rs1))
+		if ok && rs2 < 4 {
+			return format("fcvt."+intTypes[rs2]+suffix, operands...)
+		}
+	case 0x1a:
+		operands, ok := rounded(funct3, f(rd), x(rs1))
+		if suffix == ".d" && rs2 < 2 {
+			operands, ok = []string{f(rd), x(rs1)}, true
+		}
+		if ok && rs2 < 4 {
+			return format("fcvt"+suffix+"."+intTypes[rs2], operands...)
+		}
+	}
+	return ""
+}
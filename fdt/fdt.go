@@ -0,0 +1,154 @@
+package fdt
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const debug bool = false
+
+//Header values of a version 17 flattened device tree
+const (
+	magic             uint32 = 0xd00dfeed
+	version           uint32 = 17
+	lastCompVersion   uint32 = 16
+	headerSize               = 40
+	memReserveMapSize        = 16
+)
+
+//Structure block tokens
+const (
+	tokenBeginNode uint32 = 1
+	tokenEndNode   uint32 = 2
+	tokenProp      uint32 = 3
+	tokenEnd       uint32 = 9
+)
+
+//Builder writes a flattened device tree. Nodes are opened with BeginNode and
+//closed with EndNode, properties belong to the innermost open node.
+type Builder struct {
+	structure []byte
+	strings   []byte
+	//offsets of the names in the strings block
+	names map[string]uint32
+	depth int
+}
+
+//New returns a builder for an empty tree
+func New() *Builder {
+	return &Builder{names: make(map[string]uint32)}
+}
+
+//appendU32 appends a big endian 32 bit value
+func appendU32(buf []byte, value uint32) []byte {
+	var cell [4]byte
+	binary.BigEndian.PutUint32(cell[:], value)
+	return append(buf, cell[:]...)
+}
+
+//appendU64 appends a big endian 64 bit value
+func appendU64(buf []byte, value uint64) []byte {
+	return appendU32(appendU32(buf, uint32(value>>32)), uint32(value))
+}
+
+//u32 appends a cell to the structure block
+func (b *Builder) u32(value uint32) {
+	b.structure = appendU32(b.structure, value)
+}
+
+//pad aligns the structure block to 4 bytes
+func (b *Builder) pad() {
+	for len(b.structure)%4 != 0 {
+		b.structure = append(b.structure, 0)
+	}
+}
+
+//BeginNode opens a node, the root node has the empty name
+func (b *Builder) BeginNode(name string) {
+	b.u32(tokenBeginNode)
+	b.structure = append(b.structure, name...)
+	b.structure = append(b.structure, 0)
+	b.pad()
+	b.depth++
+}
+
+//EndNode closes the innermost node
+func (b *Builder) EndNode() {
+	b.u32(tokenEndNode)
+	b.depth--
+}
+
+//Property adds a property with a raw value
+func (b *Builder) Property(name string, value []byte) {
+	offset, ok := b.names[name]
+	if !ok {
+		offset = uint32(len(b.strings))
+		b.names[name] = offset
+		b.strings = append(b.strings, name...)
+		b.strings = append(b.strings, 0)
+	}
+	b.u32(tokenProp)
+	b.u32(uint32(len(value)))
+	b.u32(offset)
+	b.structure = append(b.structure, value...)
+	b.pad()
+}
+
+//PropertyEmpty adds a property without value, like interrupt-controller
+func (b *Builder) PropertyEmpty(name string) {
+	b.Property(name, nil)
+}
+
+//PropertyCells adds a property of 32 bit cells
+func (b *Builder) PropertyCells(name string, cells ...uint32) {
+	value := make([]byte, 0, 4*len(cells))
+	for _, c := range cells {
+		value = appendU32(value, c)
+	}
+	b.Property(name, value)
+}
+
+//PropertyU64s adds a property of 64 bit values, each as two cells
+func (b *Builder) PropertyU64s(name string, values ...uint64) {
+	value := make([]byte, 0, 8*len(values))
+	for _, v := range values {
+		value = appendU64(value, v)
+	}
+	b.Property(name, value)
+}
+
+//PropertyStrings adds a property of one or more strings
+func (b *Builder) PropertyStrings(name string, values ...string) {
+	var value []byte
+	for _, s := range values {
+		value = append(value, s...)
+		value = append(value, 0)
+	}
+	b.Property(name, value)
+}
+
+//Blob returns the device tree blob, all nodes must be closed
+func (b *Builder) Blob() ([]byte, error) {
+	if b.depth != 0 {
+		return nil, errors.New("Could not build device tree with open nodes")
+	}
+	structure := appendU32(append([]byte{}, b.structure...), tokenEnd)
+	//the reserve map holds only its terminating entry
+	offReserve := uint32(headerSize)
+	offStruct := offReserve + memReserveMapSize
+	offStrings := offStruct + uint32(len(structure))
+	total := offStrings + uint32(len(b.strings))
+
+	blob := make([]byte, headerSize+memReserveMapSize, total)
+	for i, field := range []uint32{
+		magic, total, offStruct, offStrings, offReserve,
+		version, lastCompVersion,
+		0, //boot_cpuid_phys
+		uint32(len(b.strings)), uint32(len(structure)),
+	} {
+		binary.BigEndian.PutUint32(blob[4*i:], field)
+	}
+	blob = append(blob, structure...)
+	blob = append(blob, b.strings...)
+	return blob, nil
+}
@@ -0,0 +1,487 @@
+package gdb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"rvsim/bus"
+	"rvsim/cpu"
+	"strconv"
+	"strings"
+)
+
+const debug bool = false
+
+//ErrKilled is returned by Serve when the debugger killed the program
+var ErrKilled = errors.New("Program killed by the debugger")
+
+//interrupt is delivered in place of a packet when the debugger sends ^C
+const interrupt = "\x03"
+
+//pollInterval is the number of instructions run between checks for ^C
+const pollInterval = 4096
+
+//Signals reported in stop replies
+const (
+	sigInt  = 0x02
+	sigIll  = 0x04
+	sigTrap = 0x05
+	sigAbrt = 0x06
+	sigSegv = 0x0b
+	sigXCPU = 0x18
+)
+
+//causeIllegalInstruction is the mcause of illegal instructions
+const causeIllegalInstruction uint64 = 2
+
+//Z packet types
+const (
+	softwareBreakpoint = 0
+	hardwareBreakpoint = 1
+	writeWatchpoint    = 2
+	readWatchpoint     = 3
+	accessWatchpoint   = 4
+)
+
+//watchpoint watches the size bytes at addr, kind is the Z packet type
+type watchpoint struct {
+	addr uint64
+	size uint64
+	kind int
+}
+
+//Stub is a GDB remote serial protocol server for a hart. Addresses of memory
+//packets, breakpoints and watchpoints are virtual addresses of the program,
+//memory is reached through mem at the physical addresses the hart translates
+//them to.
+type Stub struct {
+	hart *cpu.CPU
+	mem  bus.Device
+	//breakpoints maps the breakpoint addresses to their Z packet type
+	breakpoints map[uint64]int
+	watchpoints []watchpoint
+	//hit is the watchpoint the last instruction triggered, nil for none
+	hit *watchpoint
+	//stop is set once the program ended, it cannot run on
+	stop *cpu.StopReason
+	//packets delivers the packets of the debugger and interrupts
+	packets chan string
+	//pending holds the packets which arrived while the hart was running
+	pending []string
+	out     *bufio.Writer
+	noAck   bool
+}
+
+//New returns a stub for hart, which uses mem
+func New(hart *cpu.CPU, mem bus.Device) *Stub {
+	return &Stub{
+		hart:        hart,
+		mem:         mem,
+		breakpoints: make(map[uint64]int),
+	}
+}
+
+//Serve waits for a debugger on l and serves it until it detaches, kills the
+//program or closes the connection. It returns why the program stopped, nil
+//if it is still able to run.
+func (s *Stub) Serve(l net.Listener) (*cpu.StopReason, error) {
+	conn, err := l.Accept()
+	if err != nil {
+		return nil, fmt.Errorf("Could not accept debugger: %v", err)
+	}
+	defer conn.Close()
+	s.out = bufio.NewWriter(conn)
+	s.packets = make(chan string, 16)
+	go readPackets(bufio.NewReader(conn), s.packets)
+
+	s.hart.SetAccessHook(s.access)
+	defer s.hart.SetAccessHook(nil)
+	for {
+		pkt, ok := s.next()
+		if !ok {
+			break
+		}
+		if pkt == interrupt {
+			continue
+		}
+		if !s.noAck {
+			s.out.WriteByte('+')
+		}
+		if debug {
+			fmt.Println("GDB <-", pkt)
+		}
+		switch {
+		case pkt == "D":
+			s.send("OK")
+			return s.stop, nil
+		case pkt == "k":
+			return s.stop, ErrKilled
+		case strings.HasPrefix(pkt, "vKill"):
+			s.send("OK")
+			return s.stop, ErrKilled
+		}
+		s.send(s.handle(pkt))
+	}
+	//the debugger went away, as if it detached
+	return s.stop, nil
+}
+
+//next returns the next packet of the debugger, ok is false once the
+//connection is closed
+func (s *Stub) next() (pkt string, ok bool) {
+	if len(s.pending) > 0 {
+		pkt, s.pending = s.pending[0], s.pending[1:]
+		return pkt, true
+	}
+	pkt, ok = <-s.packets
+	return pkt, ok
+}
+
+//readPackets delivers the packets read from r until it fails
+func readPackets(r *bufio.Reader, packets chan<- string) {
+	defer close(packets)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		switch b {
+		case 0x03:
+			packets <- interrupt
+			continue
+		case '$':
+		default:
+			//acknowledgments and noise
+			continue
+		}
+		var data []byte
+		for {
+			b, err = r.ReadByte()
+			if err != nil {
+				return
+			}
+			if b == '#' {
+				break
+			}
+			//escaped bytes follow a }, xored with 0x20
+			if b == '}' {
+				b, err = r.ReadByte()
+				if err != nil {
+					return
+				}
+				b ^= 0x20
+			}
+			data = append(data, b)
+		}
+		//the checksum is not verified, the connection is reliable
+		if _, err := io.ReadFull(r, make([]byte, 2)); err != nil {
+			return
+		}
+		packets <- string(data)
+	}
+}
+
+//send writes a reply packet
+func (s *Stub) send(data string) {
+	if debug {
+		fmt.Println("GDB ->", data)
+	}
+	var sum byte
+	s.out.WriteByte('$')
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		switch b {
+		case '$', '#', '}', '*':
+			s.out.WriteByte('}')
+			sum += '}'
+			b ^= 0x20
+		}
+		s.out.WriteByte(b)
+		sum += b
+	}
+	fmt.Fprintf(s.out, "#%02x", sum)
+	s.out.Flush()
+}
+
+//handle carries out a packet and returns the reply, empty for unsupported packets
+func (s *Stub) handle(pkt string) string {
+	switch {
+	case pkt == "?":
+		if s.stop != nil {
+			return s.endReply()
+		}
+		return fmt.Sprintf("S%02x", sigTrap)
+	case strings.HasPrefix(pkt, "qSupported"):
+		return "PacketSize=4000;qXfer:features:read+;swbreak+;hwbreak+;QStartNoAckMode+;vContSupported+"
+	case pkt == "QStartNoAckMode":
+		s.noAck = true
+		return "OK"
+	case strings.HasPrefix(pkt, "qXfer:features:read:"):
+		return s.features(strings.TrimPrefix(pkt, "qXfer:features:read:"))
+	case pkt == "qAttached":
+		return "1"
+	case pkt == "qC":
+		return "QC1"
+	case pkt == "qfThreadInfo":
+		return "m1"
+	case pkt == "qsThreadInfo":
+		return "l"
+	case strings.HasPrefix(pkt, "H"), strings.HasPrefix(pkt, "T"):
+		//there is a single thread
+		return "OK"
+	case pkt == "g":
+		return s.readRegisters()
+	case strings.HasPrefix(pkt, "G"):
+		return s.writeRegisters(pkt[1:])
+	case strings.HasPrefix(pkt, "p"):
+		return s.readRegister(pkt[1:])
+	case strings.HasPrefix(pkt, "P"):
+		return s.writeRegister(pkt[1:])
+	case strings.HasPrefix(pkt, "m"):
+		return s.readMemory(pkt[1:])
+	case strings.HasPrefix(pkt, "M"), strings.HasPrefix(pkt, "X"):
+		return s.writeMemory(pkt[0], pkt[1:])
+	case pkt == "vCont?":
+		return "vCont;c;C;s;S"
+	case strings.HasPrefix(pkt, "vCont;"):
+		//all actions apply to the single thread, the first one counts
+		action := pkt[len("vCont;"):]
+		if action == "" {
+			return "E01"
+		}
+		return s.resume(action[0] == 's' || action[0] == 'S')
+	case strings.HasPrefix(pkt, "c"), strings.HasPrefix(pkt, "s"):
+		if len(pkt) > 1 {
+			addr, err := strconv.ParseUint(pkt[1:], 16, 64)
+			if err != nil {
+				return "E01"
+			}
+			s.hart.SetPC(addr)
+		}
+		return s.resume(pkt[0] == 's')
+	case strings.HasPrefix(pkt, "C"), strings.HasPrefix(pkt, "S"):
+		//signals are not delivered to the program
+		return s.resume(pkt[0] == 'S')
+	case strings.HasPrefix(pkt, "Z"), strings.HasPrefix(pkt, "z"):
+		return s.breakpoint(pkt[0] == 'Z', pkt[1:])
+	}
+	return ""
+}
+
+//resume runs the hart for one instruction or until it hits a breakpoint or
+//watchpoint, stops or the debugger interrupts it. It returns the stop reply.
+func (s *Stub) resume(step bool) string {
+	if s.stop != nil {
+		return s.endReply()
+	}
+	for i := 1; ; i++ {
+		s.hit = nil
+		if stop := s.hart.Step(); stop != nil {
+			return s.stopReply(stop)
+		}
+		if s.hit != nil {
+			names := map[int]string{writeWatchpoint: "watch", readWatchpoint: "rwatch", accessWatchpoint: "awatch"}
+			return fmt.Sprintf("T%02x%s:%x;", sigTrap, names[s.hit.kind], s.hit.addr)
+		}
+		if step {
+			return fmt.Sprintf("S%02x", sigTrap)
+		}
+		if kind, ok := s.breakpoints[s.hart.GetPC()]; ok {
+			if kind == hardwareBreakpoint {
+				return fmt.Sprintf("T%02xhwbreak:;", sigTrap)
+			}
+			return fmt.Sprintf("T%02xswbreak:;", sigTrap)
+		}
+		if i%pollInterval == 0 {
+			select {
+			case pkt, ok := <-s.packets:
+				if !ok || pkt == interrupt {
+					return fmt.Sprintf("S%02x", sigInt)
+				}
+				//other packets wait for the stop
+				s.pending = append(s.pending, pkt)
+			default:
+			}
+		}
+	}
+}
+
+//signal returns the signal reported for a stop reason
+func signal(stop *cpu.StopReason) int {
+	switch stop.Kind {
+	case cpu.StopBreak:
+		return sigTrap
+	case cpu.StopLimit:
+		return sigXCPU
+	case cpu.StopError:
+		return sigAbrt
+	case cpu.StopTrap:
+		var exc *cpu.Exception
+		if errors.As(stop.Err, &exc) && exc.Cause == causeIllegalInstruction {
+			return sigIll
+		}
+	}
+	return sigSegv
+}
+
+//stopReply reports a stop of the hart. An ebreak leaves the hart able to
+//run on, the debugger moves the pc past it. All other stops end the program
+//but its state can still be examined.
+func (s *Stub) stopReply(stop *cpu.StopReason) string {
+	if stop.Kind != cpu.StopBreak {
+		s.stop = stop
+	}
+	if stop.Kind == cpu.StopExit || stop.Kind == cpu.StopEnd {
+		return s.endReply()
+	}
+	return fmt.Sprintf("S%02x", signal(stop))
+}
+
+//endReply reports that the program ended, with its exit status or the signal
+//which stopped it
+func (s *Stub) endReply() string {
+	if s.stop.Kind == cpu.StopExit || s.stop.Kind == cpu.StopEnd {
+		return fmt.Sprintf("W%02x", s.stop.ExitCode()&0xff)
+	}
+	return fmt.Sprintf("X%02x", signal(s.stop))
+}
+
+//access is the access hook of the hart, it checks the watchpoints
+func (s *Stub) access(addr uint64, size uint64, value uint64, store bool) {
+	end := addr + size/8
+	for i := range s.watchpoints {
+		w := &s.watchpoints[i]
+		if addr >= w.addr+w.size || w.addr >= end {
+			continue
+		}
+		if w.kind == accessWatchpoint || w.kind == writeWatchpoint && store || w.kind == readWatchpoint && !store {
+			s.hit = w
+			return
+		}
+	}
+}
+
+//breakpoint inserts or removes a breakpoint or watchpoint, args is
+//type,addr,kind
+func (s *Stub) breakpoint(insert bool, args string) string {
+	fields := strings.Split(args, ",")
+	if len(fields) < 3 {
+		return "E01"
+	}
+	kind, err1 := strconv.Atoi(fields[0])
+	addr, err2 := strconv.ParseUint(fields[1], 16, 64)
+	size, err3 := strconv.ParseUint(strings.SplitN(fields[2], ";", 2)[0], 16, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return "E01"
+	}
+	switch kind {
+	case softwareBreakpoint, hardwareBreakpoint:
+		if insert {
+			s.breakpoints[addr] = kind
+		} else {
+			delete(s.breakpoints, addr)
+		}
+		return "OK"
+	case writeWatchpoint, readWatchpoint, accessWatchpoint:
+		w := watchpoint{addr: addr, size: size, kind: kind}
+		if insert {
+			s.watchpoints = append(s.watchpoints, w)
+			return "OK"
+		}
+		for i, other := range s.watchpoints {
+			if other == w {
+				s.watchpoints = append(s.watchpoints[:i], s.watchpoints[i+1:]...)
+				break
+			}
+		}
+		return "OK"
+	}
+	return ""
+}
+
+//readMemory reads memory for addr,length, it stops at the first byte which
+//cannot be read
+func (s *Stub) readMemory(args string) string {
+	addr, length, ok := parseRange(args)
+	if !ok {
+		return "E01"
+	}
+	var b strings.Builder
+	for i := uint64(0); i < length; i++ {
+		paddr, ok := s.hart.Translate(addr+i, false)
+		if !ok {
+			break
+		}
+		v, err := bus.Peek(s.mem, paddr, 8)
+		if err != nil {
+			break
+		}
+		fmt.Fprintf(&b, "%02x", v)
+	}
+	if b.Len() == 0 && length > 0 {
+		return "E14"
+	}
+	return b.String()
+}
+
+//writeMemory writes memory for addr,length:data. The data of M packets is
+//hex encoded, that of X packets binary.
+func (s *Stub) writeMemory(packet byte, args string) string {
+	colon := strings.IndexByte(args, ':')
+	if colon < 0 {
+		return "E01"
+	}
+	addr, length, ok := parseRange(args[:colon])
+	if !ok {
+		return "E01"
+	}
+	data := []byte(args[colon+1:])
+	if packet == 'M' {
+		data, ok = decodeHex(args[colon+1:])
+		if !ok {
+			return "E01"
+		}
+	}
+	if uint64(len(data)) < length {
+		return "E01"
+	}
+	for i := uint64(0); i < length; i++ {
+		paddr, ok := s.hart.Translate(addr+i, false)
+		if !ok {
+			return "E14"
+		}
+		if err := s.mem.Store(paddr, 8, uint64(data[i])); err != nil {
+			return "E14"
+		}
+	}
+	return "OK"
+}
+
+//parseRange parses addr,length in hex
+func parseRange(args string) (uint64, uint64, bool) {
+	fields := strings.Split(args, ",")
+	if len(fields) != 2 {
+		return 0, 0, false
+	}
+	addr, err1 := strconv.ParseUint(fields[0], 16, 64)
+	length, err2 := strconv.ParseUint(fields[1], 16, 64)
+	return addr, length, err1 == nil && err2 == nil
+}
+
+//decodeHex decodes pairs of hex digits
+func decodeHex(s string) ([]byte, bool) {
+	if len(s)%2 != 0 {
+		return nil, false
+	}
+	data := make([]byte, len(s)/2)
+	for i := range data {
+		v, err := strconv.ParseUint(s[2*i:2*i+2], 16, 8)
+		if err != nil {
+			return nil, false
+		}
+		data[i] = byte(v)
+	}
+	return data, true
+}
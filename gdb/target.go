@@ -0,0 +1,259 @@
+package gdb
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//GDB register numbers of RISC-V, the CSRs follow at regCSR plus their address
+const (
+	regPC    = 32
+	regF0    = 33
+	regCSR   = 65
+	regPriv  = regCSR + 4096
+	regCount = regPC + 1
+)
+
+//Addresses of the floating point CSRs, GDB sees them as 32 bit registers
+const (
+	csrFflags uint64 = 0x001
+	csrFcsr   uint64 = 0x003
+)
+
+//xNames and fNames are the ABI names of the registers
+var xNames = [32]string{
+	"zero", "ra", "sp", "gp", "tp", "t0", "t1", "t2",
+	"fp", "s1", "a0", "a1", "a2", "a3", "a4", "a5",
+	"a6", "a7", "s2", "s3", "s4", "s5", "s6", "s7",
+	"s8", "s9", "s10", "s11", "t3", "t4", "t5", "t6",
+}
+
+var fNames = [32]string{
+	"ft0", "ft1", "ft2", "ft3", "ft4", "ft5", "ft6", "ft7",
+	"fs0", "fs1", "fa0", "fa1", "fa2", "fa3", "fa4", "fa5",
+	"fa6", "fa7", "fs2", "fs3", "fs4", "fs5", "fs6", "fs7",
+	"fs8", "fs9", "fs10", "fs11", "ft8", "ft9", "ft10", "ft11",
+}
+
+//csrNames are the CSRs shown to the debugger besides those of the FPU
+var csrNames = []struct {
+	addr uint64
+	name string
+}{
+	{0xc00, "cycle"},
+	{0xc01, "time"},
+	{0xc02, "instret"},
+	{0x100, "sstatus"},
+	{0x104, "sie"},
+	{0x105, "stvec"},
+	{0x106, "scounteren"},
+	{0x140, "sscratch"},
+	{0x141, "sepc"},
+	{0x142, "scause"},
+	{0x143, "stval"},
+	{0x144, "sip"},
+	{0x180, "satp"},
+	{0xf11, "mvendorid"},
+	{0xf12, "marchid"},
+	{0xf13, "mimpid"},
+	{0xf14, "mhartid"},
+	{0x300, "mstatus"},
+	{0x301, "misa"},
+	{0x302, "medeleg"},
+	{0x303, "mideleg"},
+	{0x304, "mie"},
+	{0x305, "mtvec"},
+	{0x306, "mcounteren"},
+	{0x340, "mscratch"},
+	{0x341, "mepc"},
+	{0x342, "mcause"},
+	{0x343, "mtval"},
+	{0x344, "mip"},
+	{0xb00, "mcycle"},
+	{0xb02, "minstret"},
+}
+
+//targetXML describes the registers of the hart to the debugger
+var targetXML = buildTargetXML()
+
+func buildTargetXML() string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0"?>` + "\n")
+	b.WriteString(`<!DOCTYPE target SYSTEM "gdb-target.dtd">` + "\n")
+	b.WriteString(`<target version="1.0">` + "\n")
+	b.WriteString("<architecture>riscv:rv64</architecture>\n")
+
+	b.WriteString(`<feature name="org.gnu.gdb.riscv.cpu">` + "\n")
+	for i, name := range xNames {
+		typ := "int"
+		switch name {
+		case "ra":
+			typ = "code_ptr"
+		case "sp", "gp", "tp", "fp":
+			typ = "data_ptr"
+		}
+		fmt.Fprintf(&b, `<reg name="%s" bitsize="64" type="%s" regnum="%d"/>`+"\n", name, typ, i)
+	}
+	fmt.Fprintf(&b, `<reg name="pc" bitsize="64" type="code_ptr" regnum="%d"/>`+"\n", regPC)
+	b.WriteString("</feature>\n")
+
+	b.WriteString(`<feature name="org.gnu.gdb.riscv.fpu">` + "\n")
+	for i, name := range fNames {
+		fmt.Fprintf(&b, `<reg name="%s" bitsize="64" type="ieee_double" regnum="%d"/>`+"\n", name, regF0+i)
+	}
+	for addr, name := range []string{"", "fflags", "frm", "fcsr"} {
+		if name != "" {
+			fmt.Fprintf(&b, `<reg name="%s" bitsize="32" type="int" regnum="%d"/>`+"\n", name, regCSR+addr)
+		}
+	}
+	b.WriteString("</feature>\n")
+
+	b.WriteString(`<feature name="org.gnu.gdb.riscv.csr">` + "\n")
+	for _, csr := range csrNames {
+		fmt.Fprintf(&b, `<reg name="%s" bitsize="64" type="int" regnum="%d"/>`+"\n", csr.name, regCSR+csr.addr)
+	}
+	b.WriteString("</feature>\n")
+
+	b.WriteString(`<feature name="org.gnu.gdb.riscv.virtual">` + "\n")
+	fmt.Fprintf(&b, `<reg name="priv" bitsize="64" type="int" regnum="%d"/>`+"\n", regPriv)
+	b.WriteString("</feature>\n")
+	b.WriteString("</target>\n")
+	return b.String()
+}
+
+//features answers qXfer:features:read for annex:offset,length
+func (s *Stub) features(args string) string {
+	colon := strings.IndexByte(args, ':')
+	if colon < 0 || args[:colon] != "target.xml" {
+		return "E00"
+	}
+	offset, length, ok := parseRange(args[colon+1:])
+	if !ok {
+		return "E01"
+	}
+	if offset >= uint64(len(targetXML)) {
+		return "l"
+	}
+	rest := targetXML[offset:]
+	if uint64(len(rest)) > length {
+		return "m" + rest[:length]
+	}
+	return "l" + rest
+}
+
+//encode returns value as little endian hex of size bytes
+func encode(value uint64, size int) string {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], value)
+	return hex.EncodeToString(b[:size])
+}
+
+//decode reads a little endian hex value
+func decode(s string) (uint64, bool) {
+	data, ok := decodeHex(s)
+	if !ok || len(data) > 8 {
+		return 0, false
+	}
+	var b [8]byte
+	copy(b[:], data)
+	return binary.LittleEndian.Uint64(b[:]), true
+}
+
+//getRegister returns register n and its size in bytes, ok is false for
+//registers which do not exist
+func (s *Stub) getRegister(n int) (value uint64, size int, ok bool) {
+	switch {
+	case n < 32:
+		return s.hart.GetReg(n), 8, true
+	case n == regPC:
+		return s.hart.GetPC(), 8, true
+	case n < regCSR:
+		return s.hart.GetFReg(n - regF0), 8, true
+	case n == regPriv:
+		return s.hart.Priv(), 8, true
+	case n < regPriv:
+		addr := uint64(n - regCSR)
+		value, ok := s.hart.GetCSR(addr)
+		if addr >= csrFflags && addr <= csrFcsr {
+			return value, 4, ok
+		}
+		return value, 8, ok
+	}
+	return 0, 0, false
+}
+
+//setRegister writes register n, it reports if the register exists
+func (s *Stub) setRegister(n int, value uint64) bool {
+	switch {
+	case n < 32:
+		s.hart.SetReg(n, value)
+	case n == regPC:
+		s.hart.SetPC(value)
+	case n < regCSR:
+		s.hart.SetFReg(n-regF0, value)
+	case n == regPriv:
+		s.hart.SetPriv(value)
+	case n < regPriv:
+		return s.hart.SetCSR(uint64(n-regCSR), value)
+	default:
+		return false
+	}
+	return true
+}
+
+//readRegisters answers g with the integer registers and the pc, GDB reads
+//the others one by one
+func (s *Stub) readRegisters() string {
+	var b strings.Builder
+	for n := 0; n < regCount; n++ {
+		value, size, _ := s.getRegister(n)
+		b.WriteString(encode(value, size))
+	}
+	return b.String()
+}
+
+//writeRegisters carries out G, which writes the registers of g
+func (s *Stub) writeRegisters(data string) string {
+	for n := 0; n < regCount && len(data) >= 16; n++ {
+		value, ok := decode(data[:16])
+		if !ok {
+			return "E01"
+		}
+		s.setRegister(n, value)
+		data = data[16:]
+	}
+	return "OK"
+}
+
+//readRegister answers p for register n in hex
+func (s *Stub) readRegister(args string) string {
+	n, err := strconv.ParseUint(args, 16, 16)
+	if err != nil {
+		return "E01"
+	}
+	value, size, ok := s.getRegister(int(n))
+	if !ok {
+		return "E01"
+	}
+	return encode(value, size)
+}
+
+//writeRegister carries out P for n=value in hex
+func (s *Stub) writeRegister(args string) string {
+	fields := strings.SplitN(args, "=", 2)
+	if len(fields) != 2 {
+		return "E01"
+	}
+	n, err := strconv.ParseUint(fields[0], 16, 16)
+	if err != nil {
+		return "E01"
+	}
+	value, ok := decode(fields[1])
+	if !ok || !s.setRegister(int(n), value) {
+		return "E01"
+	}
+	return "OK"
+}
@@ -1,10 +1,29 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"os"
+	"rvsim/bus"
+	"rvsim/clint"
 	"rvsim/cpu"
+	"rvsim/disasm"
+	"rvsim/gdb"
+	"rvsim/loader"
+	"rvsim/monitor"
+	"rvsim/pk"
+	"rvsim/plic"
+	"rvsim/ram"
+	"rvsim/trace"
+	"rvsim/uart"
+	"rvsim/virt"
+	"rvsim/virtio"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -12,57 +31,570 @@ const debug bool = false
 
 func main() {
 
-	filePtr := flag.String("f", "test/a.out", "<binary-filename> of executable")
+	filePtr := flag.String("f", "test/a.out", "<binary-filename> of executable, ELF64 or flat binary")
+	maxPtr := flag.Uint64("max", 0, "maximum number of instructions to execute, 0 for no limit")
+	memPtr := flag.String("mem", "128M", "memory size in bytes, K, M and G suffixes are accepted")
+	baseFlag := flag.String("membase", "0", "memory base address, flat binaries are loaded here")
+	fregsPtr := flag.Bool("fregs", false, "also dump the floating point registers")
+	pmpPtr := flag.Int("pmp", 16, "number of PMP entries, 0 to 64")
+	clintFlag := flag.String("clint", "", "address of a CLINT timer device, e.g. 0x2000000, empty for none")
+	plicFlag := flag.String("plic", "", "address of a PLIC interrupt controller, e.g. 0xc000000, empty for none")
+	uartFlag := flag.String("uart", "", "address of a 16550 UART, e.g. 0x10000000, empty for none")
+	serialFlag := flag.String("serial", "stdio", "UART connection: stdio, file:<path> for output only, pty or none")
+	driveFlag := flag.String("drive", "", "disk image of a virtio block device, <path>[,readonly|,overlay], empty for none")
+	trapsFlag := flag.Bool("traps", false, "the bare program handles its traps, exceptions, ecall and ebreak enter the handler in mtvec instead of ending the run, -machine virt always does")
+	pkFlag := flag.Bool("pk", false, "proxy kernel, carry out Linux system calls of the program such as write and exit on the host")
+	machineFlag := flag.String("machine", "bare", "machine to simulate: bare, memory and the devices given by flags, or virt, the QEMU virt layout")
+	biosFlag := flag.String("bios", "", "firmware for -machine virt, loaded at 0x80000000, defaults to -f")
+	kernelFlag := flag.String("kernel", "", "kernel for -machine virt, loaded at 0x80200000, empty for none")
+	appendFlag := flag.String("append", "console=ttyS0", "kernel command line for -machine virt")
+	mtimeFlag := flag.String("mtime", "instret", "how the CLINT mtime advances: instret, one tick per instruction, or wall, 10 MHz host time")
+	gdbFlag := flag.String("gdb", "", "wait for a GDB connection on [host]:port before running, the host defaults to 127.0.0.1")
+	monitorFlag := flag.Bool("monitor", false, "control the run from an interactive console on stdin, type help for its commands")
+	userFlag := flag.Bool("user", false, "Linux user mode, run the static Linux program -f with the arguments following the flags")
+	disasmFlag := flag.String("disasm", "", "disassemble the code of an ELF file or flat binary placed at -membase and exit")
+	traceFlag := flag.String("trace", "", "write a line for every retired instruction to this file, in the format of spike --log-commits")
+	tracePCFlag := flag.String("trace-pc", "", "only trace the instructions in the ranges <start>-<end>[,<start>-<end>...], the end is excluded")
+	traceLimitFlag := flag.String("trace-limit", "0", "stop tracing once the trace holds this many bytes, K, M and G suffixes are accepted, 0 for no limit")
 	flag.Parse()
 
+	memSize, err := parseSize(*memPtr)
+	if err != nil {
+		fmt.Println("Error parsing -mem: ", err)
+		os.Exit(1)
+	}
+	memBase, err := strconv.ParseUint(*baseFlag, 0, 64)
+	if err != nil {
+		fmt.Println("Error parsing -membase: ", err)
+		os.Exit(1)
+	}
+
+	if *disasmFlag != "" {
+		disassemble(*disasmFlag, memBase)
+	}
+
+	tracer := openTrace(*traceFlag, *tracePCFlag, *traceLimitFlag)
+
+	if *monitorFlag && *gdbFlag != "" {
+		fmt.Println("Error: -monitor and -gdb cannot be used together")
+		os.Exit(1)
+	}
+
+	if *pkFlag && *trapsFlag {
+		fmt.Println("Error: -pk and -traps cannot be used together")
+		os.Exit(1)
+	}
+
+	if *pmpPtr < 0 || *pmpPtr > cpu.MaxPMPEntries {
+		fmt.Println("Error: -pmp must be between 0 and", cpu.MaxPMPEntries)
+		os.Exit(1)
+	}
+
+	if *userFlag {
+		opts := cpu.Options{
+			MaxInstructions: *maxPtr,
+			PMPEntries:      *pmpPtr,
+			ExitConvention:  true,
+		}
+		runUser(*filePtr, flag.Args(), memSize, opts, tracer)
+	}
+
+	if *machineFlag == "virt" {
+		cfg := virt.Config{
+			MemSize:   memSize,
+			WallClock: *mtimeFlag == "wall",
+			Bootargs:  *appendFlag,
+		}
+		cfg.Out, cfg.In, err = openSerial(*serialFlag)
+		if err != nil {
+			fmt.Println("Error opening -serial: ", err)
+			os.Exit(1)
+		}
+		if *driveFlag != "" {
+			cfg.Disk, err = openDrive(*driveFlag)
+			if err != nil {
+				fmt.Println("Error opening -drive: ", err)
+				os.Exit(1)
+			}
+		}
+		firmware := *biosFlag
+		if firmware == "" {
+			firmware = *filePtr
+		}
+		opts := cpu.Options{
+			MaxInstructions: *maxPtr,
+			PMPEntries:      *pmpPtr,
+		}
+		hart, machine := bootVirt(cfg, firmware, *kernelFlag, opts)
+		run(hart, machine.Bus, *fregsPtr, *gdbFlag, *monitorFlag, tracer)
+	} else if *machineFlag != "bare" {
+		fmt.Println("Error: -machine must be bare or virt")
+		os.Exit(1)
+	}
+
 	data, err := ioutil.ReadFile(*filePtr)
 	if err != nil {
 		fmt.Println("Error reading binary file: ", err)
+		os.Exit(1)
 	}
 
 	if debug {
 		fmt.Println("HART DUMP, ", data)
 	}
-	//Initialize an fresh and empty cpu
-	cpu.Initialize(data)
+	//ELF files are placed at their segment addresses, flat binaries at the memory base
+	img, err := loader.Parse(data, memBase)
+	if err != nil {
+		fmt.Println("Error loading binary file: ", err)
+		os.Exit(1)
+	}
 
-	//Figure execution Hz
-	start := time.Now()
-	cycle := 0
-	//the fetch/decode/execute cycles
-	for {
+	//Place the program in a fresh and empty memory, mapped on the system bus
+	mem, err := ram.New(memBase, memSize)
+	if err != nil {
+		fmt.Println("Error creating memory: ", err)
+		os.Exit(1)
+	}
+	system := bus.New()
+	err = system.Map(memBase, memSize, mem)
+	if err != nil {
+		fmt.Println("Error mapping memory: ", err)
+		os.Exit(1)
+	}
+	err = img.Load(system)
+	if err != nil {
+		fmt.Println("Error loading program to memory: ", err)
+		os.Exit(1)
+	}
+
+	opts := cpu.Options{
+		Entry:        img.Entry,
+		StackPointer: memBase + memSize,
+
+		MaxInstructions: *maxPtr,
+		PMPEntries:      *pmpPtr,
+		//bare programs end with ecall unless they handle their traps
+		ExitConvention: !*trapsFlag,
+	}
+	opts.ImageStart, opts.ImageEnd = img.Bounds()
 
-		//Fetch
-		inst, err := cpu.Fetch()
+	//The proxy kernel gives the program a heap after the image and a stack with its arguments
+	if *pkFlag {
+		brk := (opts.ImageEnd + pk.PageSize - 1) &^ (pk.PageSize - 1)
+		limit := memBase + memSize - pk.StackSize
+		if limit < brk || memSize < pk.StackSize {
+			limit = brk
+		}
+		kernel := pk.New(system, brk, limit)
+		opts.StackPointer, err = kernel.SetupStack(memBase+memSize, img, []string{*filePtr}, nil)
 		if err != nil {
-			fmt.Println("Error Fetch inst from ram")
-			break
+			fmt.Println("Error creating stack: ", err)
+			os.Exit(1)
 		}
+		opts.Syscall = kernel.Syscall
+	}
 
-		cpu.IncPC()
+	//devices which advance with the hart
+	var ticks []func()
+	opts.Tick = func() {
+		for _, tick := range ticks {
+			tick()
+		}
+	}
 
-		if debug {
-			fmt.Println("HART cpu.pc, ", cpu.GetPC())
+	//The CLINT drives the time CSR and the machine timer and software interrupts
+	var timer *clint.CLINT
+	if *clintFlag != "" {
+		if *mtimeFlag != "instret" && *mtimeFlag != "wall" {
+			fmt.Println("Error: -mtime must be instret or wall")
+			os.Exit(1)
 		}
+		base := parseAddr("-clint", *clintFlag)
+		timer = clint.New(base, *mtimeFlag == "wall")
+		mapDevice(system, "CLINT", base, clint.Size, timer)
+		opts.Time = timer.Mtime
+		ticks = append(ticks, timer.Tick)
+	}
 
-		//Workaround to abort loop
-		if cpu.GetPC() == 4 && cycle > 0 {
-			if debug {
-				fmt.Println("HLT DUE TO END OF PROGAM")
-			}
-			break
+	//The PLIC collects the interrupt lines of devices
+	var irqs *plic.PLIC
+	if *plicFlag != "" {
+		base := parseAddr("-plic", *plicFlag)
+		irqs, err = plic.New(base, plic.DefaultSources)
+		if err != nil {
+			fmt.Println("Error creating PLIC: ", err)
+			os.Exit(1)
 		}
-		//Decode / Execute
-		err = cpu.Execute(inst)
+		mapDevice(system, "PLIC", base, plic.Size, irqs)
+	}
 
+	//The UART is the console of the program
+	if *uartFlag != "" {
+		base := parseAddr("-uart", *uartFlag)
+		out, in, err := openSerial(*serialFlag)
 		if err != nil {
-			fmt.Println("PANIC: ", err)
-			break
+			fmt.Println("Error opening -serial: ", err)
+			os.Exit(1)
 		}
-		cycle++
+		line := bus.NoIRQ
+		if irqs != nil {
+			line, _ = irqs.Line(uart.DefaultIRQ)
+		}
+		console := uart.New(base, out, in, line)
+		mapDevice(system, "UART", base, uart.Size, console)
+		ticks = append(ticks, console.Poll)
+	}
+
+	//The disk is a virtio block device
+	if *driveFlag != "" {
+		disk, err := openDrive(*driveFlag)
+		if err != nil {
+			fmt.Println("Error opening -drive: ", err)
+			os.Exit(1)
+		}
+		line := bus.NoIRQ
+		if irqs != nil {
+			line, _ = irqs.Line(virtio.DefaultIRQ)
+		}
+		mapDevice(system, "virtio block device", virtio.DefaultBase, virtio.Size, virtio.NewBlock(virtio.DefaultBase, system, line, disk))
+	}
+
+	hart := cpu.New(system, opts)
+	if timer != nil {
+		timer.AddHart(hart)
+	}
+	if irqs != nil {
+		irqs.AddHart(hart)
+	}
+	run(hart, system, *fregsPtr, *gdbFlag, *monitorFlag, tracer)
+}
+
+//run executes the program, shows the registers and exits with the status of
+//the program. With gdbAddr the program runs under the control of a debugger
+//until it detaches, with console under the control of the monitor. The
+//tracer, if not nil, follows the hart.
+func run(hart *cpu.CPU, system bus.Device, fregs bool, gdbAddr string, console bool, tracer *trace.Tracer) {
+	if tracer != nil {
+		tracer.Attach(hart)
 	}
-	fmt.Printf("CPU speed %.1f kHz", float64(cycle)/time.Since(start).Seconds()/1000)
+	//Figure execution Hz
+	begin := time.Now()
+	//the fetch/decode/execute cycles
+	var stop cpu.StopReason
+	switch {
+	case gdbAddr != "":
+		stop = debugGDB(hart, system, gdbAddr)
+	case console:
+		stop = runMonitor(hart, system, fregs)
+	default:
+		stop = hart.Run()
+	}
+	fmt.Printf("CPU speed %.1f kHz", float64(hart.Retired())/time.Since(begin).Seconds()/1000)
 	fmt.Println()
+	fmt.Println(stop)
+	closeTrace(tracer)
 	//Show all registers
-	cpu.DumpRegisters()
+	hart.DumpRegisters(fregs)
+	os.Exit(stop.ExitCode())
+}
+
+//runUser runs the Linux program path with args in memory at address 0, the
+//proxy kernel carries out its system calls and schedules its threads. It
+//exits with the status of the program.
+func runUser(path string, args []string, memSize uint64, opts cpu.Options, tracer *trace.Tracer) {
+	if memSize <= pk.StackSize {
+		fmt.Println("Error: -mem must be larger than the stack of", pk.StackSize, "bytes")
+		os.Exit(1)
+	}
+	mem, err := ram.New(0, memSize)
+	if err != nil {
+		fmt.Println("Error creating memory: ", err)
+		os.Exit(1)
+	}
+	system := bus.New()
+	mapDevice(system, "memory", 0, memSize, mem)
+	img := loadImage(system, "program", path, 0)
+
+	//the heap follows the image, mappings are placed below the stack
+	_, end := img.Bounds()
+	kernel := pk.New(system, end, memSize-pk.StackSize)
+	//-max counts the instructions of all threads
+	kernel.SetMaxInstructions(opts.MaxInstructions)
+	opts.MaxInstructions = 0
+	opts.Entry = img.Entry
+	opts.StackPointer, err = kernel.SetupStack(memSize, img, append([]string{path}, args...), os.Environ())
+	if err != nil {
+		fmt.Println("Error creating stack: ", err)
+		os.Exit(1)
+	}
+	opts.Syscall = kernel.Syscall
+	hart := cpu.New(system, opts)
+	if tracer != nil {
+		tracer.Attach(hart)
+	}
+	kernel.Start(hart)
+
+	stop := kernel.Run()
+	closeTrace(tracer)
+	if stop.Kind != cpu.StopExit {
+		fmt.Fprintln(os.Stderr, stop)
+	}
+	os.Exit(stop.ExitCode())
+}
+
+//runMonitor hands the hart to the console. The simulator ends when the
+//console quits, with the status of the program if it ended.
+func runMonitor(hart *cpu.CPU, system bus.Device, fregs bool) cpu.StopReason {
+	stop := monitor.New(hart, system, os.Stdin, os.Stdout, fregs).Run()
+	if stop == nil {
+		os.Exit(0)
+	}
+	return *stop
+}
+
+//debugGDB serves a debugger on addr, the program runs on once it detaches
+func debugGDB(hart *cpu.CPU, system bus.Device, addr string) cpu.StopReason {
+	if strings.HasPrefix(addr, ":") {
+		addr = "127.0.0.1" + addr
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		fmt.Println("Error listening for gdb: ", err)
+		os.Exit(1)
+	}
+	fmt.Println("Waiting for gdb on", l.Addr())
+	stop, err := gdb.New(hart, system).Serve(l)
+	l.Close()
+	if err == gdb.ErrKilled {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Println("Error serving gdb: ", err)
+		os.Exit(1)
+	}
+	if stop != nil {
+		return *stop
+	}
+	return hart.Run()
+}
+
+//openTrace creates the trace file of -trace with the pc ranges and the size
+//limit of -trace-pc and -trace-limit, it returns nil without a file
+func openTrace(path string, ranges string, limit string) *trace.Tracer {
+	if path == "" {
+		return nil
+	}
+	var pcs []trace.Range
+	if ranges != "" {
+		var err error
+		pcs, err = trace.ParseRanges(ranges)
+		if err != nil {
+			fmt.Println("Error parsing -trace-pc: ", err)
+			os.Exit(1)
+		}
+	}
+	size, err := parseSize(limit)
+	if err != nil {
+		fmt.Println("Error parsing -trace-limit: ", err)
+		os.Exit(1)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		fmt.Println("Error creating trace file: ", err)
+		os.Exit(1)
+	}
+	return trace.New(f, pcs, size)
+}
+
+//closeTrace writes out the rest of the trace, the file is closed on exit
+func closeTrace(tracer *trace.Tracer) {
+	if tracer == nil {
+		return
+	}
+	if err := tracer.Flush(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing trace: ", err)
+	}
+	if tracer.Full() {
+		fmt.Fprintln(os.Stderr, "Trace cut at the -trace-limit")
+	}
+}
+
+//disassemble prints the executable segments of the program at path and
+//exits, flat binaries are placed at base
+func disassemble(path string, base uint64) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Println("Error reading binary file: ", err)
+		os.Exit(1)
+	}
+	img, err := loader.Parse(data, base)
+	if err != nil {
+		fmt.Println("Error loading binary file: ", err)
+		os.Exit(1)
+	}
+	for _, s := range img.Segments {
+		if !s.Exec {
+			continue
+		}
+		for off := 0; off+2 <= len(s.Data); {
+			inst := uint64(s.Data[off]) | uint64(s.Data[off+1])<<8
+			length := int(disasm.Length(inst))
+			raw := fmt.Sprintf("%04x", inst)
+			//an instruction cut off by the end of the segment shows its first half
+			if length == 4 && off+4 <= len(s.Data) {
+				inst |= uint64(s.Data[off+2])<<16 | uint64(s.Data[off+3])<<24
+				raw = fmt.Sprintf("%08x", inst)
+			} else if length == 4 {
+				length = 2
+			}
+			text := disasm.Disassemble(inst, s.Vaddr+uint64(off))
+			if length == 2 && inst&0x3 == 0x3 {
+				text = fmt.Sprintf(".half 0x%04x", inst)
+			}
+			fmt.Printf("%8x:  %-8s  %s", s.Vaddr+uint64(off), raw, text)
+			fmt.Println()
+			off += length
+		}
+	}
+	os.Exit(0)
+}
+
+//bootVirt builds a virt machine, loads the firmware and the kernel and
+//returns its hart, which starts in the firmware with the device tree in a1
+func bootVirt(cfg virt.Config, firmware string, kernel string, opts cpu.Options) (*cpu.CPU, *virt.Machine) {
+	machine, err := virt.New(cfg)
+	if err != nil {
+		fmt.Println("Error creating virt machine: ", err)
+		os.Exit(1)
+	}
+	img := loadImage(machine.Bus, "firmware", firmware, virt.MemoryBase)
+	if kernel != "" {
+		loadImage(machine.Bus, "kernel", kernel, virt.KernelBase)
+	}
+	dtb, err := machine.LoadDeviceTree(1)
+	if err != nil {
+		fmt.Println("Error placing device tree: ", err)
+		os.Exit(1)
+	}
+
+	//the pc may go anywhere, the stack grows below the device tree
+	opts.Entry = img.Entry
+	opts.StackPointer = dtb
+	opts.DeviceTree = dtb
+	opts.Time = machine.Mtime
+	opts.Tick = machine.Tick
+	hart := cpu.New(machine.Bus, opts)
+	machine.AddHart(hart)
+	return hart, machine
+}
+
+//loadImage loads an ELF file or a flat binary placed at base, it exits on errors
+func loadImage(system *bus.Bus, name string, path string, base uint64) *loader.Image {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Printf("Error reading %s: %v", name, err)
+		fmt.Println()
+		os.Exit(1)
+	}
+	img, err := loader.Parse(data, base)
+	if err == nil {
+		err = img.Load(system)
+	}
+	if err != nil {
+		fmt.Printf("Error loading %s: %v", name, err)
+		fmt.Println()
+		os.Exit(1)
+	}
+	return img
+}
+
+//parseSize reads a byte count like 4096, 0x1000, 64K, 256M or 2G
+func parseSize(s string) (uint64, error) {
+	if s == "" {
+		return 0, errors.New("empty size")
+	}
+	shift := uint(0)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		shift = 10
+	case "M":
+		shift = 20
+	case "G":
+		shift = 30
+	}
+	if shift != 0 {
+		s = s[:len(s)-1]
+	}
+	size, err := strconv.ParseUint(s, 0, 64)
+	if err != nil {
+		return 0, err
+	}
+	if size<<shift>>shift != size {
+		return 0, fmt.Errorf("size %s too large", s)
+	}
+	return size << shift, nil
+}
+
+//parseAddr parses the address given with a flag, it exits on errors
+func parseAddr(name string, value string) uint64 {
+	addr, err := strconv.ParseUint(value, 0, 64)
+	if err != nil {
+		fmt.Printf("Error parsing %s: %v", name, err)
+		fmt.Println()
+		os.Exit(1)
+	}
+	return addr
+}
+
+//mapDevice places a device on the bus, it exits on errors
+func mapDevice(system *bus.Bus, name string, base uint64, size uint64, dev bus.Device) {
+	err := system.Map(base, size, dev)
+	if err != nil {
+		fmt.Printf("Error mapping %s: %v", name, err)
+		fmt.Println()
+		os.Exit(1)
+	}
+}
+
+//openSerial returns the output and input of the UART for a -serial value
+func openSerial(serial string) (io.Writer, io.Reader, error) {
+	switch {
+	case serial == "stdio":
+		return os.Stdout, os.Stdin, nil
+	case serial == "none":
+		return ioutil.Discard, nil, nil
+	case serial == "pty":
+		pty, path, err := uart.OpenPTY()
+		if err != nil {
+			return nil, nil, err
+		}
+		fmt.Println("UART connected to", path)
+		return pty, pty, nil
+	case strings.HasPrefix(serial, "file:"):
+		f, err := os.Create(strings.TrimPrefix(serial, "file:"))
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, nil, nil
+	}
+	return nil, nil, fmt.Errorf("unknown serial %q", serial)
+}
+
+//openDrive opens the disk image of a -drive value, the path may be followed
+//by ,readonly or ,overlay
+func openDrive(drive string) (*virtio.Disk, error) {
+	path := drive
+	mode := virtio.ReadWrite
+	if i := strings.LastIndex(drive, ","); i >= 0 {
+		path = drive[:i]
+		switch drive[i+1:] {
+		case "readonly":
+			mode = virtio.ReadOnly
+		case "overlay":
+			mode = virtio.Overlay
+		default:
+			return nil, fmt.Errorf("unknown drive option %q", drive[i+1:])
+		}
+	}
+	return virtio.OpenDisk(path, mode)
 }
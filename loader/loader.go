@@ -0,0 +1,163 @@
+package loader
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"rvsim/bus"
+)
+
+const debug bool = false
+
+//Segment is a chunk of the program placed in memory
+type Segment struct {
+	//Vaddr is the virtual address the segment is linked to
+	Vaddr uint64
+	//Paddr is the physical address the segment is loaded to
+	Paddr uint64
+	//Data holds the bytes from the file, MemSize-len(Data) bytes are zero filled
+	Data []uint8
+	//MemSize is the size of the segment in memory
+	MemSize uint64
+	//Exec is set for segments holding code, flat binaries are all code
+	Exec bool
+}
+
+//Image is a program ready to be placed in memory
+type Image struct {
+	//Entry is the address of the first instruction
+	Entry    uint64
+	Segments []Segment
+	//Phdr is the address of the ELF program headers in memory, 0 if they are
+	//not loaded. Phent is the size of one header and Phnum their number.
+	Phdr  uint64
+	Phent uint64
+	Phnum uint64
+}
+
+//Raw wraps a flat binary which is placed at base and started at its first byte
+func Raw(binary []uint8, base uint64) *Image {
+	return &Image{
+		Entry: base,
+		Segments: []Segment{{
+			Vaddr:   base,
+			Paddr:   base,
+			Data:    binary,
+			MemSize: uint64(len(binary)),
+			Exec:    true,
+		}},
+	}
+}
+
+//IsELF reports whether data starts with the ELF magic
+func IsELF(data []uint8) bool {
+	return bytes.HasPrefix(data, []uint8(elf.ELFMAG))
+}
+
+//Parse returns an ELF image if data is an ELF file, a raw image at base otherwise
+func Parse(data []uint8, base uint64) (*Image, error) {
+	if IsELF(data) {
+		return ELF(data)
+	}
+	return Raw(data, base), nil
+}
+
+//ELF parses a RISC-V ELF64 executable
+func ELF(data []uint8) (*Image, error) {
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse ELF file: %v", err)
+	}
+	defer f.Close()
+
+	if f.Class != elf.ELFCLASS64 {
+		return nil, fmt.Errorf("Unsupported ELF class %v, need ELFCLASS64", f.Class)
+	}
+	if f.Machine != elf.EM_RISCV {
+		return nil, fmt.Errorf("Unsupported ELF machine %v, need EM_RISCV", f.Machine)
+	}
+	if f.Data != elf.ELFDATA2LSB {
+		return nil, fmt.Errorf("Unsupported ELF data encoding %v, need ELFDATA2LSB", f.Data)
+	}
+	//position independent executables would need a load bias and relocations
+	if f.Type == elf.ET_DYN {
+		return nil, errors.New("Unsupported ELF type ET_DYN, position independent executables are not relocated, link with -static -no-pie")
+	}
+	if f.Type != elf.ET_EXEC {
+		return nil, fmt.Errorf("Unsupported ELF type %v, need an executable", f.Type)
+	}
+
+	//the program header table offset is not part of elf.FileHeader
+	phoff := binary.LittleEndian.Uint64(data[0x20:])
+	img := &Image{
+		Entry: f.Entry,
+		Phent: uint64(binary.LittleEndian.Uint16(data[0x36:])),
+		Phnum: uint64(len(f.Progs)),
+	}
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_PHDR {
+			img.Phdr = p.Vaddr
+		} else if img.Phdr == 0 && p.Type == elf.PT_LOAD && phoff >= p.Off && phoff-p.Off < p.Filesz {
+			img.Phdr = p.Vaddr + phoff - p.Off
+		}
+	}
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD || p.Memsz == 0 {
+			continue
+		}
+		if p.Filesz > p.Memsz {
+			return nil, errors.New("Corrupt ELF segment, file size exceeds memory size")
+		}
+		seg := Segment{
+			Vaddr:   p.Vaddr,
+			Paddr:   p.Paddr,
+			Data:    make([]uint8, p.Filesz),
+			MemSize: p.Memsz,
+			Exec:    p.Flags&elf.PF_X != 0,
+		}
+		if _, err := p.ReadAt(seg.Data, 0); err != nil {
+			return nil, fmt.Errorf("Could not read ELF segment at %#x: %v", p.Paddr, err)
+		}
+		if debug {
+			fmt.Printf("LOADER segment vaddr %#x paddr %#x filesz %#x memsz %#x", p.Vaddr, p.Paddr, p.Filesz, p.Memsz)
+			fmt.Println()
+		}
+		img.Segments = append(img.Segments, seg)
+	}
+	if len(img.Segments) == 0 {
+		return nil, errors.New("ELF file has no loadable segments")
+	}
+	return img, nil
+}
+
+//Bounds returns the lowest and the first address past the loaded image
+func (img *Image) Bounds() (uint64, uint64) {
+	var lo, hi uint64
+	for i, s := range img.Segments {
+		if i == 0 || s.Paddr < lo {
+			lo = s.Paddr
+		}
+		if s.Paddr+s.MemSize > hi {
+			hi = s.Paddr + s.MemSize
+		}
+	}
+	return lo, hi
+}
+
+//Load stores all segments into the device at their physical address and zero fills the rest
+func (img *Image) Load(dev bus.Device) error {
+	for _, s := range img.Segments {
+		for i := uint64(0); i < s.MemSize; i++ {
+			var value uint64
+			if i < uint64(len(s.Data)) {
+				value = uint64(s.Data[i])
+			}
+			if err := dev.Store(s.Paddr+i, 8, value); err != nil {
+				return fmt.Errorf("Could not load segment to %#x: %v", s.Paddr+i, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package monitor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"rvsim/bus"
+	"rvsim/cpu"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const debug bool = false
+
+//pollInterval is the number of instructions run between checks for ^C
+const pollInterval = 4096
+
+//listLength is the number of instructions list shows
+const listLength = 8
+
+//listBefore is the number of 32 bit instructions list shows before the pc
+const listBefore = 3
+
+//examineLength is the number of bytes x shows by default
+const examineLength = 64
+
+const help = `step [n]            s  execute n instructions, 1 by default
+continue            c  run until a breakpoint or the end of the program
+until <addr>        u  run until the pc reaches addr
+break [addr]        b  set a breakpoint at addr, without addr list them
+delete <addr>       d  remove the breakpoint at addr
+regs                r  show the registers
+reg <name> [value]     show or set a register: pc, priv, x0-x31, f0-f31 or an ABI name
+csr <addr> [value]     show or set the CSR at addr
+x <addr> [n]           show n bytes of memory at addr, 64 by default
+write <addr> <value> [size]
+                    w  write the size bytes of value to addr, size is 1, 2, 4 or 8 (default)
+list [addr]         l  show the instructions at addr or around the pc
+trap                   show the last trap
+help                h  show this help
+quit                q  leave the simulator
+An empty line repeats step and continue, ^C stops a running program.
+Addresses are virtual addresses of the program, numbers are decimal or 0x hex.`
+
+//Monitor is an interactive console which controls a hart. It reads commands
+//line by line, so it works on a plain terminal and with piped input.
+type Monitor struct {
+	hart *cpu.CPU
+	mem  bus.Device
+	in   *bufio.Scanner
+	out  io.Writer
+	//fregs shows the floating point registers with the others
+	fregs       bool
+	breakpoints map[uint64]bool
+	//stop is set once the program ended, it cannot run on
+	stop *cpu.StopReason
+	//interrupts delivers ^C while the program runs
+	interrupts chan os.Signal
+}
+
+//New returns a monitor for hart, which uses mem. It reads commands from in
+//and writes to out.
+func New(hart *cpu.CPU, mem bus.Device, in io.Reader, out io.Writer, fregs bool) *Monitor {
+	return &Monitor{
+		hart:        hart,
+		mem:         mem,
+		in:          bufio.NewScanner(in),
+		out:         out,
+		fregs:       fregs,
+		breakpoints: make(map[uint64]bool),
+		interrupts:  make(chan os.Signal, 1),
+	}
+}
+
+//Run reads and carries out commands until quit or the end of the input. It
+//returns why the program stopped, nil if it did not end.
+func (m *Monitor) Run() *cpu.StopReason {
+	signal.Notify(m.interrupts, os.Interrupt)
+	defer signal.Stop(m.interrupts)
+
+	m.where()
+	var last string
+	for {
+		fmt.Fprint(m.out, "(rvsim) ")
+		if !m.in.Scan() {
+			fmt.Fprintln(m.out)
+			return m.stop
+		}
+		line := strings.TrimSpace(m.in.Text())
+		if line == "" {
+			line = last
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if debug {
+			fmt.Println("MONITOR command", fields)
+		}
+		switch fields[0] {
+		case "q", "quit":
+			return m.stop
+		case "s", "step", "c", "continue":
+			last = line
+		default:
+			last = ""
+		}
+		if err := m.command(fields[0], fields[1:]); err != nil {
+			fmt.Fprintln(m.out, err)
+		}
+	}
+}
+
+//command carries out the command cmd with its arguments
+func (m *Monitor) command(cmd string, args []string) error {
+	switch cmd {
+	case "s", "step":
+		n := uint64(1)
+		if len(args) > 0 {
+			var err error
+			if n, err = parseNumber(args[0]); err != nil {
+				return err
+			}
+			if n == 0 {
+				return fmt.Errorf("Could not step 0 instructions")
+			}
+		}
+		m.run(func(i uint64) bool { return i == n })
+	case "c", "continue":
+		m.run(func(uint64) bool { return false })
+	case "u", "until":
+		if len(args) != 1 {
+			return fmt.Errorf("Usage: until <addr>")
+		}
+		addr, err := parseNumber(args[0])
+		if err != nil {
+			return err
+		}
+		m.run(func(uint64) bool { return m.hart.GetPC() == addr })
+	case "b", "break":
+		if len(args) == 0 {
+			m.listBreakpoints()
+			return nil
+		}
+		addr, err := parseNumber(args[0])
+		if err != nil {
+			return err
+		}
+		m.breakpoints[addr] = true
+		fmt.Fprintf(m.out, "Breakpoint at %#x", addr)
+		fmt.Fprintln(m.out)
+	case "d", "delete":
+		if len(args) != 1 {
+			return fmt.Errorf("Usage: delete <addr>")
+		}
+		addr, err := parseNumber(args[0])
+		if err != nil {
+			return err
+		}
+		if !m.breakpoints[addr] {
+			return fmt.Errorf("No breakpoint at %#x", addr)
+		}
+		delete(m.breakpoints, addr)
+	case "r", "regs":
+		m.hart.WriteRegisters(m.out, m.fregs)
+		fmt.Fprintf(m.out, "pc = %#x priv = %s", m.hart.GetPC(), privNames[m.hart.Priv()])
+		fmt.Fprintln(m.out)
+	case "reg":
+		return m.register(args)
+	case "csr":
+		return m.csr(args)
+	case "x":
+		return m.examine(args)
+	case "w", "write":
+		return m.write(args)
+	case "l", "list":
+		if len(args) == 0 {
+			addr, before := m.before(m.hart.GetPC())
+			m.list(addr, before+listLength-listBefore)
+			return nil
+		}
+		addr, err := parseNumber(args[0])
+		if err != nil {
+			return err
+		}
+		m.list(addr, listLength)
+	case "trap":
+		trap, ok := m.hart.LastTrap()
+		if !ok {
+			fmt.Fprintln(m.out, "No trap yet")
+			return nil
+		}
+		fmt.Fprintln(m.out, trap)
+	case "h", "help":
+		fmt.Fprintln(m.out, help)
+	default:
+		return fmt.Errorf("Unknown command %q, try help", cmd)
+	}
+	return nil
+}
+
+//run steps the hart until done returns true for the number of executed
+//instructions, it hits a breakpoint, the program ends or ^C
+func (m *Monitor) run(done func(i uint64) bool) {
+	if m.stop != nil {
+		fmt.Fprintln(m.out, "The program has ended:", m.stop)
+		return
+	}
+	//drop a ^C which came while no program ran
+	select {
+	case <-m.interrupts:
+	default:
+	}
+	for i := uint64(1); ; i++ {
+		if stop := m.hart.Step(); stop != nil {
+			m.stop = stop
+			fmt.Fprintln(m.out, stop)
+			return
+		}
+		if done(i) {
+			break
+		}
+		if m.breakpoints[m.hart.GetPC()] {
+			fmt.Fprintf(m.out, "Breakpoint at %#x", m.hart.GetPC())
+			fmt.Fprintln(m.out)
+			break
+		}
+		if i%pollInterval == 0 {
+			select {
+			case <-m.interrupts:
+				fmt.Fprintln(m.out, "Interrupted")
+				m.where()
+				return
+			default:
+			}
+		}
+	}
+	m.where()
+}
+
+//where shows the instruction at the pc
+func (m *Monitor) where() {
+	m.list(m.hart.GetPC(), 1)
+}
+
+//listBreakpoints shows the breakpoints in address order
+func (m *Monitor) listBreakpoints() {
+	var addrs []uint64
+	for addr := range m.breakpoints {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	if len(addrs) == 0 {
+		fmt.Fprintln(m.out, "No breakpoints")
+	}
+	for _, addr := range addrs {
+		fmt.Fprintf(m.out, "Breakpoint at %#x", addr)
+		fmt.Fprintln(m.out)
+	}
+}
+
+//parseNumber reads a decimal or 0x prefixed hex number
+func parseNumber(s string) (uint64, error) {
+	n, err := strconv.ParseUint(s, 0, 64)
+	if err != nil {
+		//negative values are register contents too
+		v, err2 := strconv.ParseInt(s, 0, 64)
+		if err2 != nil {
+			return 0, fmt.Errorf("Could not parse number %q", s)
+		}
+		n = uint64(v)
+	}
+	return n, nil
+}
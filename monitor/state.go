@@ -0,0 +1,258 @@
+package monitor
+
+import (
+	"fmt"
+	"rvsim/bus"
+	"rvsim/disasm"
+	"strings"
+)
+
+//privNames are the letters of the privilege levels
+var privNames = map[uint64]string{0: "U", 1: "S", 3: "M"}
+
+//register shows or sets the register named by args[0]
+func (m *Monitor) register(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return fmt.Errorf("Usage: reg <name> [value]")
+	}
+	name := strings.ToLower(args[0])
+	var value uint64
+	if len(args) == 2 {
+		var err error
+		if value, err = parseNumber(args[1]); err != nil {
+			return err
+		}
+	}
+	set := len(args) == 2
+
+	switch name {
+	case "pc":
+		if set {
+			m.hart.SetPC(value)
+		}
+		value = m.hart.GetPC()
+	case "priv":
+		if set {
+			m.hart.SetPriv(value)
+		}
+		value = m.hart.Priv()
+	default:
+		x, f := registerIndex(name)
+		switch {
+		case x >= 0:
+			if set {
+				m.hart.SetReg(x, value)
+			}
+			value = m.hart.GetReg(x)
+		case f >= 0:
+			if set {
+				m.hart.SetFReg(f, value)
+			}
+			value = m.hart.GetFReg(f)
+		default:
+			return fmt.Errorf("Unknown register %q", args[0])
+		}
+	}
+	fmt.Fprintf(m.out, "%s = %#x", name, value)
+	fmt.Fprintln(m.out)
+	return nil
+}
+
+//registerIndex returns the number of the integer register x or the floating
+//point register f called name, -1 for the other kind
+func registerIndex(name string) (x int, f int) {
+	for i := 0; i < 32; i++ {
+		switch name {
+		case fmt.Sprintf("x%d", i), disasm.RegName(i):
+			return i, -1
+		case fmt.Sprintf("f%d", i), disasm.FRegName(i):
+			return -1, i
+		}
+	}
+	if name == "fp" {
+		return 8, -1
+	}
+	return -1, -1
+}
+
+//csr shows or sets the CSR at args[0]
+func (m *Monitor) csr(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return fmt.Errorf("Usage: csr <addr> [value]")
+	}
+	addr, err := parseNumber(args[0])
+	if err != nil {
+		return err
+	}
+	if len(args) == 2 {
+		value, err := parseNumber(args[1])
+		if err != nil {
+			return err
+		}
+		m.hart.SetCSR(addr, value)
+	}
+	value, ok := m.hart.GetCSR(addr)
+	if !ok {
+		return fmt.Errorf("CSR %#x is not implemented", addr)
+	}
+	fmt.Fprintf(m.out, "csr %#x = %#x", addr, value)
+	fmt.Fprintln(m.out)
+	return nil
+}
+
+//examine shows memory in lines of 16 bytes
+func (m *Monitor) examine(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return fmt.Errorf("Usage: x <addr> [n]")
+	}
+	addr, err := parseNumber(args[0])
+	if err != nil {
+		return err
+	}
+	n := uint64(examineLength)
+	if len(args) == 2 {
+		if n, err = parseNumber(args[1]); err != nil {
+			return err
+		}
+	}
+	for i := uint64(0); i < n; i++ {
+		if i%16 == 0 {
+			if i != 0 {
+				fmt.Fprintln(m.out)
+			}
+			fmt.Fprintf(m.out, "0x%08x:", addr+i)
+		}
+		var b uint64
+		paddr, err := m.physical(addr+i, false)
+		if err == nil {
+			b, err = bus.Peek(m.mem, paddr, 8)
+		}
+		if err != nil {
+			fmt.Fprintln(m.out)
+			return err
+		}
+		fmt.Fprintf(m.out, " %02x", b)
+	}
+	fmt.Fprintln(m.out)
+	return nil
+}
+
+//write stores a value of 1, 2, 4 or 8 bytes
+func (m *Monitor) write(args []string) error {
+	if len(args) < 2 || len(args) > 3 {
+		return fmt.Errorf("Usage: write <addr> <value> [size]")
+	}
+	addr, err := parseNumber(args[0])
+	if err != nil {
+		return err
+	}
+	value, err := parseNumber(args[1])
+	if err != nil {
+		return err
+	}
+	size := uint64(8)
+	if len(args) == 3 {
+		if size, err = parseNumber(args[2]); err != nil {
+			return err
+		}
+	}
+	switch size {
+	case 1, 2, 4, 8:
+	default:
+		return fmt.Errorf("Could not write %d bytes, size must be 1, 2, 4 or 8", size)
+	}
+	//bytewise, the address needs no alignment
+	for i := uint64(0); i < size; i++ {
+		paddr, err := m.physical(addr+i, false)
+		if err != nil {
+			return err
+		}
+		if err := m.mem.Store(paddr, 8, value>>(8*i)&0xff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//physical returns the physical address the hart reaches at the virtual
+//address addr, with its fetches if fetch is set
+func (m *Monitor) physical(addr uint64, fetch bool) (uint64, error) {
+	paddr, ok := m.hart.Translate(addr, fetch)
+	if !ok {
+		return 0, fmt.Errorf("Address %#x is not mapped", addr)
+	}
+	return paddr, nil
+}
+
+//fetch reads the instruction at addr, 16 bit parcels as the hart does
+func (m *Monitor) fetch(addr uint64) (uint64, error) {
+	paddr, err := m.physical(addr, true)
+	if err != nil {
+		return 0, err
+	}
+	low, err := bus.Peek(m.mem, paddr, 16)
+	if err != nil || low&0x3 != 0x3 {
+		return low, err
+	}
+	//the parcels may lie on different pages
+	if paddr, err = m.physical(addr+2, true); err != nil {
+		return 0, err
+	}
+	high, err := bus.Peek(m.mem, paddr, 16)
+	return low | high<<16, err
+}
+
+//before returns the address of the instruction listBefore 32 bit words
+//before pc and the number of instructions up to pc. Instructions have no
+//fixed length, the first address decoding forward from lands on pc is taken,
+//pc itself if there is none.
+func (m *Monitor) before(pc uint64) (uint64, int) {
+	for back := uint64(4 * listBefore); back > 0; back -= 2 {
+		if back > pc {
+			continue
+		}
+		addr := pc - back
+		n := 0
+		for addr < pc {
+			inst, err := m.fetch(addr)
+			if err != nil {
+				break
+			}
+			addr += disasm.Length(inst)
+			n++
+		}
+		if addr == pc {
+			return pc - back, n
+		}
+	}
+	return pc, 0
+}
+
+//list shows n instructions from addr with their disassembly, the pc is
+//marked with => and breakpoints with *
+func (m *Monitor) list(addr uint64, n int) {
+	for i := 0; i < n; i++ {
+		inst, err := m.fetch(addr)
+		if err != nil {
+			fmt.Fprintf(m.out, "   0x%08x: %v", addr, err)
+			fmt.Fprintln(m.out)
+			return
+		}
+		mark := "  "
+		if addr == m.hart.GetPC() {
+			mark = "=>"
+		}
+		if m.breakpoints[addr] {
+			mark = mark[:1] + "*"
+		}
+		size := uint64(4)
+		text := fmt.Sprintf("%08x", inst)
+		if inst&0x3 != 0x3 {
+			size = 2
+			text = fmt.Sprintf("    %04x", inst)
+		}
+		fmt.Fprintf(m.out, "%s 0x%08x: %s  %s", mark, addr, text, disasm.Disassemble(inst, addr))
+		fmt.Fprintln(m.out)
+		addr += size
+	}
+}
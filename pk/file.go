@@ -0,0 +1,292 @@
+package pk
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+//Flags of openat and fcntl
+const (
+	openWriteOnly uint64 = 0x1
+	openReadWrite uint64 = 0x2
+	openCreate    uint64 = 0x40
+	openExclusive uint64 = 0x80
+	openTruncate  uint64 = 0x200
+	openAppend    uint64 = 0x400
+)
+
+//Commands of fcntl
+const (
+	fcntlDupFD        uint64 = 0
+	fcntlGetFD        uint64 = 1
+	fcntlSetFD        uint64 = 2
+	fcntlGetFL        uint64 = 3
+	fcntlSetFL        uint64 = 4
+	fcntlDupFDCloexec uint64 = 1030
+)
+
+//atFDCWD makes calls resolve relative paths against the working directory
+const atFDCWD uint64 = 0xffffffffffffff9c
+
+//selfExe is the link to the running program
+const selfExe = "/proc/self/exe"
+
+//pathMax is the longest path a program may pass
+const pathMax = 4096
+
+//ioChunk is the most bytes moved between host and guest at once
+const ioChunk = 64 * 1024
+
+//openFile is a descriptor of the program
+type openFile struct {
+	file  *os.File
+	flags uint64
+}
+
+//stdFiles are the descriptors a program starts with
+func stdFiles() map[uint64]*openFile {
+	return map[uint64]*openFile{
+		0: {file: os.Stdin, flags: openReadWrite},
+		1: {file: os.Stdout, flags: openReadWrite},
+		2: {file: os.Stderr, flags: openReadWrite},
+	}
+}
+
+//newFD returns the lowest free descriptor not below min
+func (k *Kernel) newFD(min uint64, f *openFile) uint64 {
+	fd := min
+	for k.files[fd] != nil {
+		fd++
+	}
+	k.files[fd] = f
+	return fd
+}
+
+//path reads the path at pathname, relative paths are resolved against dirfd
+func (k *Kernel) path(dirfd uint64, pathname uint64) (string, uint64) {
+	path, err := k.readString(pathname)
+	if err != nil {
+		return "", errEFAULT
+	}
+	if len(path) >= pathMax {
+		return "", errENAMETOOLONG
+	}
+	if path != "" && !filepath.IsAbs(path) && dirfd != atFDCWD {
+		dir, ok := k.files[dirfd]
+		if !ok {
+			return "", errEBADF
+		}
+		if dir.file == nil {
+			return "", errENOTDIR
+		}
+		path = filepath.Join(dir.file.Name(), path)
+	}
+	return path, 0
+}
+
+func (k *Kernel) openat(dirfd uint64, pathname uint64, flags uint64, mode uint64) uint64 {
+	path, e := k.path(dirfd, pathname)
+	if e != 0 {
+		return errno(e)
+	}
+	if path == selfExe {
+		path = k.exe
+	}
+
+	hostFlags := os.O_RDONLY
+	switch flags & 0x3 {
+	case openWriteOnly:
+		hostFlags = os.O_WRONLY
+	case openReadWrite:
+		hostFlags = os.O_RDWR
+	}
+	for _, f := range []struct {
+		linux uint64
+		host  int
+	}{
+		{openCreate, os.O_CREATE},
+		{openExclusive, os.O_EXCL},
+		{openTruncate, os.O_TRUNC},
+		{openAppend, os.O_APPEND},
+	} {
+		if flags&f.linux != 0 {
+			hostFlags |= f.host
+		}
+	}
+	file, err := os.OpenFile(path, hostFlags, os.FileMode(mode&0777))
+	if err != nil {
+		return errno(hostErrno(err))
+	}
+	return k.newFD(0, &openFile{file: file, flags: flags & (0x3 | openAppend)})
+}
+
+func (k *Kernel) close(fd uint64) uint64 {
+	f, ok := k.files[fd]
+	if !ok {
+		return errno(errEBADF)
+	}
+	delete(k.files, fd)
+	//duplicated descriptors share the host file, the standard streams stay
+	//open for the simulator
+	for _, other := range k.files {
+		if other.file == f.file {
+			return 0
+		}
+	}
+	if f.file != nil && f.file != os.Stdin && f.file != os.Stdout && f.file != os.Stderr {
+		if err := f.file.Close(); err != nil {
+			return errno(hostErrno(err))
+		}
+	}
+	return 0
+}
+
+func (k *Kernel) fcntl(fd uint64, cmd uint64) uint64 {
+	f, ok := k.files[fd]
+	if !ok {
+		return errno(errEBADF)
+	}
+	switch cmd {
+	case fcntlDupFD, fcntlDupFDCloexec:
+		return k.newFD(0, &openFile{file: f.file, flags: f.flags})
+	case fcntlGetFD, fcntlSetFD, fcntlSetFL:
+		//close on exec and the status flags have no effect
+		return 0
+	case fcntlGetFL:
+		return f.flags
+	}
+	return errno(errEINVAL)
+}
+
+func (k *Kernel) lseek(fd uint64, offset uint64, whence uint64) uint64 {
+	f, ok := k.files[fd]
+	if !ok {
+		return errno(errEBADF)
+	}
+	if f.file == nil {
+		return errno(errESPIPE)
+	}
+	if whence > io.SeekEnd {
+		return errno(errEINVAL)
+	}
+	pos, err := f.file.Seek(int64(offset), int(whence))
+	if err != nil {
+		return errno(hostErrno(err))
+	}
+	return uint64(pos)
+}
+
+func (k *Kernel) read(fd uint64, buf uint64, count uint64) uint64 {
+	f, ok := k.files[fd]
+	if !ok {
+		return errno(errEBADF)
+	}
+	if f.file == nil {
+		//eventfd counters are never read
+		return errno(errEAGAIN)
+	}
+	if count > ioChunk {
+		count = ioChunk
+	}
+	data := make([]byte, count)
+	n, err := f.file.Read(data)
+	if n == 0 && err != nil && err != io.EOF {
+		return errno(hostErrno(err))
+	}
+	if err := k.storeBytes(buf, data[:n]); err != nil {
+		return errno(errEFAULT)
+	}
+	return uint64(n)
+}
+
+func (k *Kernel) write(fd uint64, buf uint64, count uint64) uint64 {
+	f, ok := k.files[fd]
+	if !ok {
+		return errno(errEBADF)
+	}
+	if f.file == nil {
+		return count
+	}
+	if count > ioChunk {
+		count = ioChunk
+	}
+	data := make([]byte, count)
+	if err := k.loadBytes(buf, data); err != nil {
+		return errno(errEFAULT)
+	}
+	n, err := f.file.Write(data)
+	if n == 0 && err != nil {
+		return errno(hostErrno(err))
+	}
+	return uint64(n)
+}
+
+//vector carries out readv or writev with op, the array at iov holds iovcnt
+//pairs of base and length
+func (k *Kernel) vector(op func(uint64, uint64, uint64) uint64, fd uint64, iov uint64, iovcnt uint64) uint64 {
+	var total uint64
+	for i := uint64(0); i < iovcnt; i++ {
+		base, err := k.mem.Load(iov+16*i, 64)
+		if err != nil {
+			return errno(errEFAULT)
+		}
+		length, err := k.mem.Load(iov+16*i+8, 64)
+		if err != nil {
+			return errno(errEFAULT)
+		}
+		if length == 0 {
+			continue
+		}
+		n := op(fd, base, length)
+		if int64(n) < 0 {
+			if total > 0 {
+				return total
+			}
+			return n
+		}
+		total += n
+		//a short transfer ends the call
+		if n < length {
+			break
+		}
+	}
+	return total
+}
+
+func (k *Kernel) readlinkat(dirfd uint64, pathname uint64, buf uint64, size uint64) uint64 {
+	path, e := k.path(dirfd, pathname)
+	if e != 0 {
+		return errno(e)
+	}
+	target := k.exe
+	if path != selfExe {
+		var err error
+		target, err = os.Readlink(path)
+		if err != nil {
+			return errno(hostErrno(err))
+		}
+	}
+	//the result is not zero terminated and may be cut
+	if uint64(len(target)) > size {
+		target = target[:size]
+	}
+	if err := k.storeBytes(buf, []byte(target)); err != nil {
+		return errno(errEFAULT)
+	}
+	return uint64(len(target))
+}
+
+func (k *Kernel) getcwd(buf uint64, size uint64) uint64 {
+	dir, err := os.Getwd()
+	if err != nil {
+		return errno(hostErrno(err))
+	}
+	if uint64(len(dir))+1 > size {
+		return errno(errERANGE)
+	}
+	if err := k.storeBytes(buf, append([]byte(dir), 0)); err != nil {
+		return errno(errEFAULT)
+	}
+	return uint64(len(dir)) + 1
+}
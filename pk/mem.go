@@ -0,0 +1,182 @@
+package pk
+
+import (
+	"fmt"
+	"rvsim/bus"
+)
+
+//Flags of mmap
+const (
+	mapFixed     uint64 = 0x10
+	mapAnonymous uint64 = 0x20
+)
+
+//region is a mapping of the program at [start, end)
+type region struct {
+	start uint64
+	end   uint64
+}
+
+//zero clears the size bytes at addr. Memory releases whole pages, other
+//devices are cleared byte by byte.
+func (k *Kernel) zero(addr uint64, size uint64) error {
+	if z, ok := k.mem.(bus.Zeroer); ok {
+		return z.Zero(addr, size)
+	}
+	for end := addr + size; addr < end; addr++ {
+		if err := k.mem.Store(addr, 8, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//limit returns the end of the memory the heap may grow into
+func (k *Kernel) limit() uint64 {
+	if len(k.regions) > 0 {
+		return k.regions[0].start
+	}
+	return k.top
+}
+
+//setBrk moves the end of the heap to addr and returns the new end. The heap
+//stays as it is if addr is 0 or out of range, the program learns so from the
+//unchanged result.
+func (k *Kernel) setBrk(addr uint64) uint64 {
+	if addr < k.brkStart || pageAlign(addr) > k.limit() {
+		return k.brk
+	}
+	if addr < k.brk {
+		if err := k.zero(addr, k.brk-addr); err != nil {
+			return k.brk
+		}
+	}
+	k.brk = addr
+	return k.brk
+}
+
+//free reports if [start, end) lies between the heap and top and overlaps no
+//mapping
+func (k *Kernel) free(start uint64, end uint64) bool {
+	if start < pageAlign(k.brk) || end > k.top || end <= start {
+		return false
+	}
+	for _, r := range k.regions {
+		if start < r.end && r.start < end {
+			return false
+		}
+	}
+	return true
+}
+
+//place returns the highest free range of length bytes, 0 if there is none
+func (k *Kernel) place(length uint64) uint64 {
+	end := k.top
+	for i := len(k.regions) - 1; i >= -1; i-- {
+		start := pageAlign(k.brk)
+		if i >= 0 {
+			start = k.regions[i].end
+		}
+		if end >= start && end-start >= length {
+			return end - length
+		}
+		if i >= 0 {
+			end = k.regions[i].start
+		}
+	}
+	return 0
+}
+
+//insert adds the mapping [start, end), keeping the regions sorted
+func (k *Kernel) insert(start uint64, end uint64) {
+	i := 0
+	for i < len(k.regions) && k.regions[i].start < start {
+		i++
+	}
+	k.regions = append(k.regions, region{})
+	copy(k.regions[i+1:], k.regions[i:])
+	k.regions[i] = region{start: start, end: end}
+}
+
+func (k *Kernel) mmap(addr uint64, length uint64, flags uint64, fd uint64, offset uint64) uint64 {
+	if length == 0 || addr&(PageSize-1) != 0 || offset&(PageSize-1) != 0 {
+		return errno(errEINVAL)
+	}
+	length = pageAlign(length)
+	f, ok := k.files[fd]
+	if flags&mapAnonymous == 0 && (!ok || f.file == nil) {
+		return errno(errEBADF)
+	}
+
+	switch {
+	case flags&mapFixed != 0:
+		if addr < pageAlign(k.brk) || addr+length > k.top || addr+length < addr {
+			return errno(errENOMEM)
+		}
+		if ret := k.munmap(addr, length); ret != 0 {
+			return ret
+		}
+	case addr != 0 && k.free(addr, addr+length):
+		//the hint is taken when the range is free
+	default:
+		addr = k.place(length)
+		if addr == 0 {
+			return errno(errENOMEM)
+		}
+	}
+	k.insert(addr, addr+length)
+	if debug {
+		fmt.Printf("PK mmap %#x-%#x", addr, addr+length)
+		fmt.Println()
+	}
+
+	if flags&mapAnonymous == 0 {
+		//file mappings are copies, stores do not reach the file
+		data := make([]byte, ioChunk)
+		for done := uint64(0); done < length; {
+			n, err := f.file.ReadAt(data, int64(offset+done))
+			if n > 0 {
+				if uint64(n) > length-done {
+					n = int(length - done)
+				}
+				if err := k.storeBytes(addr+done, data[:n]); err != nil {
+					return errno(errEFAULT)
+				}
+				done += uint64(n)
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+	return addr
+}
+
+func (k *Kernel) munmap(addr uint64, length uint64) uint64 {
+	if length == 0 || addr&(PageSize-1) != 0 {
+		return errno(errEINVAL)
+	}
+	end := addr + pageAlign(length)
+	var kept []region
+	for _, r := range k.regions {
+		if end <= r.start || r.end <= addr {
+			kept = append(kept, r)
+			continue
+		}
+		//the unmapped part is cleared, the rest of the region stays
+		from, to := r.start, r.end
+		if from < addr {
+			kept = append(kept, region{start: from, end: addr})
+			from = addr
+		}
+		if to > end {
+			kept = append(kept, region{start: end, end: to})
+			to = end
+		}
+		if err := k.zero(from, to-from); err != nil {
+			return errno(errEFAULT)
+		}
+	}
+	k.regions = kept
+	return 0
+}
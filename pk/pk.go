@@ -0,0 +1,324 @@
+package pk
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"rvsim/bus"
+	"syscall"
+	"time"
+)
+
+const debug bool = false
+
+//System call numbers of the RISC-V Linux ABI
+const (
+	sysGetcwd           uint64 = 17
+	sysEventfd2         uint64 = 19
+	sysEpollCreate1     uint64 = 20
+	sysEpollCtl         uint64 = 21
+	sysEpollPwait       uint64 = 22
+	sysFcntl            uint64 = 25
+	sysIoctl            uint64 = 29
+	sysOpenat           uint64 = 56
+	sysClose            uint64 = 57
+	sysLseek            uint64 = 62
+	sysRead             uint64 = 63
+	sysWrite            uint64 = 64
+	sysReadv            uint64 = 65
+	sysWritev           uint64 = 66
+	sysReadlinkat       uint64 = 78
+	sysNewfstatat       uint64 = 79
+	sysFstat            uint64 = 80
+	sysExit             uint64 = 93
+	sysExitGroup        uint64 = 94
+	sysSetTIDAddress    uint64 = 96
+	sysFutex            uint64 = 98
+	sysSetRobustList    uint64 = 99
+	sysNanosleep        uint64 = 101
+	sysClockGettime     uint64 = 113
+	sysClockNanosleep   uint64 = 115
+	sysSchedGetaffinity uint64 = 123
+	sysSchedYield       uint64 = 124
+	sysKill             uint64 = 129
+	sysTkill            uint64 = 130
+	sysTgkill           uint64 = 131
+	sysSigaltstack      uint64 = 132
+	sysRtSigaction      uint64 = 134
+	sysRtSigprocmask    uint64 = 135
+	sysUname            uint64 = 160
+	sysGettimeofday     uint64 = 169
+	sysGetpid           uint64 = 172
+	sysGetppid          uint64 = 173
+	sysGetuid           uint64 = 174
+	sysGeteuid          uint64 = 175
+	sysGetgid           uint64 = 176
+	sysGetegid          uint64 = 177
+	sysGettid           uint64 = 178
+	sysBrk              uint64 = 214
+	sysMunmap           uint64 = 215
+	sysClone            uint64 = 220
+	sysMmap             uint64 = 222
+	sysMprotect         uint64 = 226
+	sysMadvise          uint64 = 233
+	sysGetrandom        uint64 = 278
+)
+
+//Linux error numbers, calls return them negated
+const (
+	errEPERM        uint64 = 1
+	errENOENT       uint64 = 2
+	errEIO          uint64 = 5
+	errEBADF        uint64 = 9
+	errEAGAIN       uint64 = 11
+	errENOMEM       uint64 = 12
+	errEACCES       uint64 = 13
+	errEFAULT       uint64 = 14
+	errEEXIST       uint64 = 17
+	errENOTDIR      uint64 = 20
+	errEISDIR       uint64 = 21
+	errEINVAL       uint64 = 22
+	errENOTTY       uint64 = 25
+	errESPIPE       uint64 = 29
+	errERANGE       uint64 = 34
+	errENAMETOOLONG uint64 = 36
+	errENOSYS       uint64 = 38
+	errETIMEDOUT    uint64 = 110
+)
+
+//PageSize is the page size programs see, the heap starts page aligned
+const PageSize uint64 = 4096
+
+//StackSize is the memory kept free for the stack at the end of memory, the
+//heap and mappings may not grow into it
+const StackSize uint64 = 8 * 1024 * 1024
+
+//pid is the process id of the program, its main thread has the same id
+const pid uint64 = 1000
+
+//Kernel is a proxy kernel, it carries out the system calls of a program
+//against the host. The program sees the host files, standard streams and
+//clocks, its memory is managed by the kernel.
+type Kernel struct {
+	mem bus.Device
+	//files maps the descriptors of the program to host files
+	files map[uint64]*openFile
+	//exe is the path of the program, set up with its stack
+	exe string
+	//brk is the end of the heap, it starts at brkStart. The memory between
+	//the heap and top which is not mapped is kept cleared.
+	brk      uint64
+	brkStart uint64
+	//top is the end of the memory for the heap and the mappings
+	top uint64
+	//regions are the mappings, sorted by address
+	regions []region
+	//threads of the program, current is the one running
+	threads []*thread
+	current *thread
+	nextTID uint64
+	//yielded ends the quantum of the running thread
+	yielded bool
+	//exited is set when the program has ended
+	exited bool
+	start  time.Time
+	//maxInstructions stops the run after this many instructions of all
+	//threads, 0 for no limit, retired counts them
+	maxInstructions uint64
+	retired         uint64
+}
+
+//New returns a kernel for a program in mem whose heap starts at brk. The
+//heap and the mappings use the memory up to top.
+func New(mem bus.Device, brk uint64, top uint64) *Kernel {
+	brk = pageAlign(brk)
+	top &^= PageSize - 1
+	if top < brk {
+		top = brk
+	}
+	return &Kernel{
+		mem:      mem,
+		files:    stdFiles(),
+		brk:      brk,
+		brkStart: brk,
+		top:      top,
+		nextTID:  pid + 1,
+		start:    time.Now(),
+	}
+}
+
+//pageAlign rounds addr up to the next page boundary
+func pageAlign(addr uint64) uint64 {
+	return (addr + PageSize - 1) &^ (PageSize - 1)
+}
+
+//errno returns the negated error number for the result register
+func errno(e uint64) uint64 {
+	return -e
+}
+
+//hostErrnos maps host errors to Linux error numbers
+var hostErrnos = []struct {
+	host  syscall.Errno
+	linux uint64
+}{
+	{syscall.ENOENT, errENOENT},
+	{syscall.EBADF, errEBADF},
+	{syscall.EACCES, errEACCES},
+	{syscall.EEXIST, errEEXIST},
+	{syscall.ENOTDIR, errENOTDIR},
+	{syscall.EISDIR, errEISDIR},
+	{syscall.EINVAL, errEINVAL},
+	{syscall.ESPIPE, errESPIPE},
+}
+
+//hostErrno maps a host error to a Linux error number, EIO if there is no match
+func hostErrno(err error) uint64 {
+	for _, e := range hostErrnos {
+		if errors.Is(err, e.host) {
+			return e.linux
+		}
+	}
+	return errEIO
+}
+
+//Syscall carries out call num with the arguments args, it is a cpu.Options.Syscall
+//handler. Exit calls return a *cpu.Exit, failed calls a negated error number.
+func (k *Kernel) Syscall(num uint64, args [6]uint64) (uint64, error) {
+	if debug {
+		fmt.Printf("PK syscall %d args %#x", num, args)
+		fmt.Println()
+	}
+	switch num {
+	case sysGetcwd:
+		return k.getcwd(args[0], args[1]), nil
+	case sysEventfd2:
+		return k.eventfd(), nil
+	case sysEpollCreate1:
+		return k.epollCreate(), nil
+	case sysEpollCtl:
+		return k.epollCtl(args[0], args[1], args[2]), nil
+	case sysEpollPwait:
+		return k.epollPwait(args[0]), nil
+	case sysFcntl:
+		return k.fcntl(args[0], args[1]), nil
+	case sysIoctl:
+		//no descriptor is a terminal the program may control
+		if _, ok := k.files[args[0]]; !ok {
+			return errno(errEBADF), nil
+		}
+		return errno(errENOTTY), nil
+	case sysOpenat:
+		return k.openat(args[0], args[1], args[2], args[3]), nil
+	case sysClose:
+		return k.close(args[0]), nil
+	case sysLseek:
+		return k.lseek(args[0], args[1], args[2]), nil
+	case sysRead:
+		return k.read(args[0], args[1], args[2]), nil
+	case sysWrite:
+		return k.write(args[0], args[1], args[2]), nil
+	case sysReadv:
+		return k.vector(k.read, args[0], args[1], args[2]), nil
+	case sysWritev:
+		return k.vector(k.write, args[0], args[1], args[2]), nil
+	case sysReadlinkat:
+		return k.readlinkat(args[0], args[1], args[2], args[3]), nil
+	case sysNewfstatat:
+		return k.newfstatat(args[0], args[1], args[2], args[3]), nil
+	case sysFstat:
+		return k.fstat(args[0], args[1]), nil
+	case sysExit:
+		return k.exit(int(int32(args[0])), false)
+	case sysExitGroup:
+		return k.exit(int(int32(args[0])), true)
+	case sysSetTIDAddress:
+		if k.current != nil {
+			k.current.clearTID = args[0]
+		}
+		return k.gettid(), nil
+	case sysFutex:
+		return k.futex(args[0], args[1], args[2], args[3]), nil
+	case sysSetRobustList, sysSigaltstack, sysRtSigaction, sysMprotect, sysMadvise:
+		//signals are never delivered and all memory is accessible
+		return 0, nil
+	case sysRtSigprocmask:
+		return k.sigprocmask(args[2], args[3]), nil
+	case sysNanosleep, sysClockNanosleep, sysSchedYield:
+		//sleeping lets the other threads run
+		k.yield()
+		return 0, nil
+	case sysClockGettime:
+		return k.clockGettime(args[0], args[1]), nil
+	case sysSchedGetaffinity:
+		return k.schedGetaffinity(args[1], args[2]), nil
+	case sysKill, sysTkill, sysTgkill:
+		return 0, nil
+	case sysUname:
+		return k.uname(args[0]), nil
+	case sysGettimeofday:
+		return k.gettimeofday(args[0]), nil
+	case sysGetpid:
+		return pid, nil
+	case sysGetppid:
+		return 1, nil
+	case sysGetuid, sysGeteuid:
+		return uint64(os.Getuid()), nil
+	case sysGetgid, sysGetegid:
+		return uint64(os.Getgid()), nil
+	case sysGettid:
+		return k.gettid(), nil
+	case sysBrk:
+		return k.setBrk(args[0]), nil
+	case sysMunmap:
+		return k.munmap(args[0], args[1]), nil
+	case sysClone:
+		return k.clone(args[0], args[1], args[2], args[3], args[4]), nil
+	case sysMmap:
+		return k.mmap(args[0], args[1], args[3], args[4], args[5]), nil
+	case sysGetrandom:
+		return k.getrandom(args[0], args[1]), nil
+	}
+	if debug {
+		fmt.Println("PK unsupported syscall ", num)
+	}
+	return errno(errENOSYS), nil
+}
+
+//readString reads the zero terminated string at addr
+func (k *Kernel) readString(addr uint64) (string, error) {
+	var s []byte
+	for len(s) < pathMax {
+		b, err := k.mem.Load(addr+uint64(len(s)), 8)
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			break
+		}
+		s = append(s, byte(b))
+	}
+	return string(s), nil
+}
+
+//loadBytes fills p from guest memory at addr
+func (k *Kernel) loadBytes(addr uint64, p []byte) error {
+	for i := range p {
+		b, err := k.mem.Load(addr+uint64(i), 8)
+		if err != nil {
+			return err
+		}
+		p[i] = byte(b)
+	}
+	return nil
+}
+
+//storeBytes writes p to guest memory at addr
+func (k *Kernel) storeBytes(addr uint64, p []byte) error {
+	for i, b := range p {
+		if err := k.mem.Store(addr+uint64(i), 8, uint64(b)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package pk
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"rvsim/loader"
+)
+
+//Types of the auxiliary vector entries
+const (
+	atNull   uint64 = 0
+	atPhdr   uint64 = 3
+	atPhent  uint64 = 4
+	atPhnum  uint64 = 5
+	atPagesz uint64 = 6
+	atBase   uint64 = 7
+	atEntry  uint64 = 9
+	atUID    uint64 = 11
+	atEUID   uint64 = 12
+	atGID    uint64 = 13
+	atEGID   uint64 = 14
+	atHwcap  uint64 = 16
+	atClktck uint64 = 17
+	atSecure uint64 = 23
+	atRandom uint64 = 25
+	atExecfn uint64 = 31
+)
+
+//hwcap has a bit for each extension letter of RV64IMAFDC
+const hwcap uint64 = 1<<('I'-'A') | 1<<('M'-'A') | 1<<('A'-'A') | 1<<('F'-'A') | 1<<('D'-'A') | 1<<('C'-'A')
+
+//clockTicks is the tick rate of times reported in AT_CLKTCK
+const clockTicks uint64 = 100
+
+//SetupStack writes the initial stack of the program img below top, as the
+//Linux ABI lays it out: argc, the argv and envp pointers, the auxiliary vector
+//and above them the strings. It returns the stack pointer, 16 byte aligned.
+func (k *Kernel) SetupStack(top uint64, img *loader.Image, argv []string, envp []string) (uint64, error) {
+	if len(argv) > 0 {
+		if exe, err := filepath.Abs(argv[0]); err == nil {
+			k.exe = exe
+		}
+	}
+
+	//the strings and the random bytes go to the top
+	sp := top
+	store := func(p []byte) (uint64, error) {
+		sp -= uint64(len(p))
+		return sp, k.storeBytes(sp, p)
+	}
+	pointers := func(strs []string) ([]uint64, error) {
+		var addrs []uint64
+		for _, s := range strs {
+			addr, err := store(append([]byte(s), 0))
+			if err != nil {
+				return nil, err
+			}
+			addrs = append(addrs, addr)
+		}
+		return addrs, nil
+	}
+	argvAddrs, err := pointers(argv)
+	if err != nil {
+		return 0, err
+	}
+	envpAddrs, err := pointers(envp)
+	if err != nil {
+		return 0, err
+	}
+	var seed [16]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		return 0, err
+	}
+	random, err := store(seed[:])
+	if err != nil {
+		return 0, err
+	}
+
+	var words []uint64
+	words = append(words, uint64(len(argv)))
+	words = append(words, argvAddrs...)
+	words = append(words, 0)
+	words = append(words, envpAddrs...)
+	words = append(words, 0)
+	if img.Phdr != 0 {
+		words = append(words, atPhdr, img.Phdr, atPhent, img.Phent, atPhnum, img.Phnum)
+	}
+	words = append(words,
+		atPagesz, PageSize,
+		atBase, 0,
+		atEntry, img.Entry,
+		atUID, uint64(os.Getuid()),
+		atEUID, uint64(os.Getuid()),
+		atGID, uint64(os.Getgid()),
+		atEGID, uint64(os.Getgid()),
+		atHwcap, hwcap,
+		atClktck, clockTicks,
+		atSecure, 0,
+		atRandom, random,
+	)
+	if len(argvAddrs) > 0 {
+		words = append(words, atExecfn, argvAddrs[0])
+	}
+	words = append(words, atNull, 0)
+
+	sp = (sp - 8*uint64(len(words))) &^ 0xf
+	for i, w := range words {
+		if err := k.mem.Store(sp+8*uint64(i), 64, w); err != nil {
+			return 0, err
+		}
+	}
+	return sp, nil
+}
@@ -0,0 +1,94 @@
+package pk
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+)
+
+//Clocks of clock_gettime, all others count from the start of the program
+const clockRealtime uint64 = 0
+
+//utsFields are the fields of struct utsname, each 65 bytes long
+var utsFields = []string{"Linux", "rvsim", "6.1.0", "#1", "riscv64", "(none)"}
+
+//utsFieldSize is the size of a field of struct utsname
+const utsFieldSize = 65
+
+func (k *Kernel) uname(buf uint64) uint64 {
+	uts := make([]byte, len(utsFields)*utsFieldSize)
+	for i, f := range utsFields {
+		copy(uts[i*utsFieldSize:], f)
+	}
+	if err := k.storeBytes(buf, uts); err != nil {
+		return errno(errEFAULT)
+	}
+	return 0
+}
+
+func (k *Kernel) getrandom(buf uint64, length uint64) uint64 {
+	if length > ioChunk {
+		length = ioChunk
+	}
+	data := make([]byte, length)
+	if _, err := rand.Read(data); err != nil {
+		return errno(errEIO)
+	}
+	if err := k.storeBytes(buf, data); err != nil {
+		return errno(errEFAULT)
+	}
+	return length
+}
+
+//storeTime writes sec and the sub second part as a pair of 64 bit words
+func (k *Kernel) storeTime(addr uint64, sec uint64, sub uint64) uint64 {
+	var t [16]byte
+	binary.LittleEndian.PutUint64(t[0:], sec)
+	binary.LittleEndian.PutUint64(t[8:], sub)
+	if err := k.storeBytes(addr, t[:]); err != nil {
+		return errno(errEFAULT)
+	}
+	return 0
+}
+
+func (k *Kernel) clockGettime(clock uint64, tp uint64) uint64 {
+	if clock == clockRealtime {
+		now := time.Now()
+		return k.storeTime(tp, uint64(now.Unix()), uint64(now.Nanosecond()))
+	}
+	since := time.Since(k.start)
+	return k.storeTime(tp, uint64(since/time.Second), uint64(since%time.Second))
+}
+
+func (k *Kernel) gettimeofday(tv uint64) uint64 {
+	//a NULL tv is allowed, the time zone argument is ignored
+	if tv == 0 {
+		return 0
+	}
+	now := time.Now()
+	return k.storeTime(tv, uint64(now.Unix()), uint64(now.Nanosecond()/1000))
+}
+
+func (k *Kernel) sigprocmask(oldset uint64, size uint64) uint64 {
+	//no signal is ever blocked
+	if size > 128 {
+		return errno(errEINVAL)
+	}
+	if oldset != 0 {
+		if err := k.storeBytes(oldset, make([]byte, size)); err != nil {
+			return errno(errEFAULT)
+		}
+	}
+	return 0
+}
+
+func (k *Kernel) schedGetaffinity(size uint64, mask uint64) uint64 {
+	//the threads share a single hart
+	if size < 8 {
+		return errno(errEINVAL)
+	}
+	if err := k.mem.Store(mask, 64, 1); err != nil {
+		return errno(errEFAULT)
+	}
+	return 8
+}
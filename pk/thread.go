@@ -0,0 +1,209 @@
+package pk
+
+import (
+	"errors"
+	"rvsim/cpu"
+)
+
+//Flags of clone
+const (
+	cloneVM            uint64 = 0x100
+	cloneSetTLS        uint64 = 0x80000
+	cloneParentSetTID  uint64 = 0x100000
+	cloneChildClearTID uint64 = 0x200000
+	cloneChildSetTID   uint64 = 0x1000000
+)
+
+//Operations of futex, without the private flag
+const (
+	futexWait       uint64 = 0
+	futexWake       uint64 = 1
+	futexWaitBitset uint64 = 9
+	futexWakeBitset uint64 = 10
+	futexPrivate    uint64 = 0x80
+)
+
+//quantum is the number of instructions a thread runs before the next one
+//takes over
+const quantum = 10000
+
+//Register numbers of the thread state
+const (
+	regSP = 2
+	regTP = 4
+	regA0 = 10
+)
+
+//thread is a thread of the program, it runs on a hart of its own
+type thread struct {
+	hart *cpu.CPU
+	tid  uint64
+	//clearTID is cleared and woken when the thread exits
+	clearTID uint64
+	//waiting is set while the thread waits on the futex at futex, timeout
+	//tells if the wait ends when all threads wait
+	waiting bool
+	futex   uint64
+	timeout bool
+	exited  bool
+}
+
+//Start makes hart the main thread of the program
+func (k *Kernel) Start(hart *cpu.CPU) {
+	k.threads = []*thread{{hart: hart, tid: pid}}
+}
+
+//SetMaxInstructions stops the run after max instructions of all threads
+//together, 0 for no limit. The harts should not have limits of their own.
+func (k *Kernel) SetMaxInstructions(max uint64) {
+	k.maxInstructions = max
+}
+
+//Run runs the threads of the program in turn until it exits or stops
+func (k *Kernel) Run() cpu.StopReason {
+	for {
+		ran := false
+		for _, t := range k.threads {
+			if t.exited || t.waiting {
+				continue
+			}
+			ran = true
+			k.current = t
+			k.yielded = false
+			for i := 0; i < quantum && !t.waiting && !k.yielded; i++ {
+				if k.maxInstructions != 0 && k.retired >= k.maxInstructions {
+					return cpu.StopReason{Kind: cpu.StopLimit, PC: t.hart.GetPC()}
+				}
+				retired := t.hart.Retired()
+				stop := t.hart.Step()
+				k.retired += t.hart.Retired() - retired
+				if stop == nil {
+					continue
+				}
+				//an exiting thread leaves the others running
+				if stop.Kind != cpu.StopExit || k.exited {
+					return *stop
+				}
+				break
+			}
+		}
+		k.current = nil
+		if ran {
+			continue
+		}
+		//all threads wait, sleeping ones wake up and give up
+		woken := false
+		for _, t := range k.threads {
+			if t.waiting && t.timeout {
+				t.waiting = false
+				t.hart.SetReg(regA0, errno(errETIMEDOUT))
+				woken = true
+			}
+		}
+		if !woken {
+			return cpu.StopReason{Kind: cpu.StopError, PC: k.threads[0].hart.GetPC(), Err: errors.New("Deadlock, all threads wait")}
+		}
+	}
+}
+
+//yield ends the quantum of the running thread
+func (k *Kernel) yield() {
+	k.yielded = true
+}
+
+func (k *Kernel) gettid() uint64 {
+	if k.current == nil {
+		return pid
+	}
+	return k.current.tid
+}
+
+func (k *Kernel) clone(flags uint64, stack uint64, ptid uint64, tls uint64, ctid uint64) uint64 {
+	//only threads are supported, new processes are not
+	if flags&cloneVM == 0 || k.current == nil {
+		return errno(errENOSYS)
+	}
+	tid := k.nextTID
+	k.nextTID++
+	child := &thread{hart: k.current.hart.Clone(tid), tid: tid}
+	child.hart.SetReg(regA0, 0)
+	if stack != 0 {
+		child.hart.SetReg(regSP, stack)
+	}
+	if flags&cloneSetTLS != 0 {
+		child.hart.SetReg(regTP, tls)
+	}
+	if flags&cloneParentSetTID != 0 {
+		if err := k.mem.Store(ptid, 32, tid); err != nil {
+			return errno(errEFAULT)
+		}
+	}
+	if flags&cloneChildSetTID != 0 {
+		if err := k.mem.Store(ctid, 32, tid); err != nil {
+			return errno(errEFAULT)
+		}
+	}
+	if flags&cloneChildClearTID != 0 {
+		child.clearTID = ctid
+	}
+	k.threads = append(k.threads, child)
+	return tid
+}
+
+func (k *Kernel) futex(addr uint64, op uint64, val uint64, timeout uint64) uint64 {
+	switch op &^ futexPrivate {
+	case futexWait, futexWaitBitset:
+		if k.current == nil {
+			return errno(errENOSYS)
+		}
+		value, err := k.mem.Load(addr, 32)
+		if err != nil {
+			return errno(errEFAULT)
+		}
+		if uint32(value) != uint32(val) {
+			return errno(errEAGAIN)
+		}
+		k.current.waiting = true
+		k.current.futex = addr
+		k.current.timeout = timeout != 0
+		return 0
+	case futexWake, futexWakeBitset:
+		return k.wake(addr, val)
+	}
+	return errno(errENOSYS)
+}
+
+//wake wakes up to n threads waiting on the futex at addr and returns their number
+func (k *Kernel) wake(addr uint64, n uint64) uint64 {
+	var woken uint64
+	for _, t := range k.threads {
+		if woken == n {
+			break
+		}
+		if t.waiting && t.futex == addr {
+			t.waiting = false
+			woken++
+		}
+	}
+	return woken
+}
+
+//exit ends the running thread with code, or with group the whole program.
+//The program ends with its last thread.
+func (k *Kernel) exit(code int, group bool) (uint64, error) {
+	if !group && k.current != nil {
+		k.current.exited = true
+		if k.current.clearTID != 0 {
+			if err := k.mem.Store(k.current.clearTID, 32, 0); err == nil {
+				k.wake(k.current.clearTID, 1)
+			}
+		}
+		for _, t := range k.threads {
+			if !t.exited {
+				return 0, &cpu.Exit{Code: code}
+			}
+		}
+	}
+	k.exited = true
+	return 0, &cpu.Exit{Code: code}
+}
@@ -0,0 +1,282 @@
+package plic
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"rvsim/bus"
+)
+
+const debug bool = false
+
+//Register offsets of the SiFive PLIC
+const (
+	priorityOffset  uint64 = 0x0
+	pendingOffset   uint64 = 0x1000
+	enableOffset    uint64 = 0x2000
+	enableStride    uint64 = 0x80
+	contextOffset   uint64 = 0x200000
+	contextStride   uint64 = 0x1000
+	thresholdOffset uint64 = 0x0
+	claimOffset     uint64 = 0x4
+)
+
+//Size of the PLIC address space
+const Size uint64 = 0x4000000
+
+//DefaultBase is where SiFive boards and the virt machine place the PLIC
+const DefaultBase uint64 = 0xc000000
+
+//DefaultSources is the number of sources of the virt machine
+const DefaultSources = 96
+
+//MaxSources is the highest number of interrupt sources, source 0 does not exist
+const MaxSources = 1024
+
+//priorityMask holds the 7 implemented priority levels, 0 never interrupts
+const priorityMask uint32 = 0x7
+
+//Interrupt numbers, the bits in mip
+const (
+	irqSEIP uint = 9
+	irqMEIP uint = 11
+)
+
+//Hart is the interrupt input of a hart
+type Hart interface {
+	SetPending(irq uint, level bool)
+}
+
+//context is a hart in one privilege mode, it has its own enables and threshold
+type context struct {
+	hart      Hart
+	irq       uint
+	enable    []uint32
+	threshold uint32
+}
+
+//PLIC is the platform level interrupt controller. It collects the level
+//triggered interrupt lines of devices and delivers them to the machine and
+//supervisor external interrupt of each hart.
+type PLIC struct {
+	base     uint64
+	sources  int
+	priority []uint32
+	//level is the state of the device lines, pending the bits of the pending
+	//registers, claimed marks interrupts in service
+	level    []bool
+	pending  []uint32
+	claimed  []bool
+	contexts []*context
+}
+
+//New returns a PLIC mapped at base with sources interrupt sources, numbered 1 to sources-1
+func New(base uint64, sources int) (*PLIC, error) {
+	if sources < 2 || sources > MaxSources {
+		return nil, fmt.Errorf("Could not create PLIC with %d sources", sources)
+	}
+	return &PLIC{
+		base:     base,
+		sources:  sources,
+		priority: make([]uint32, sources),
+		level:    make([]bool, sources),
+		pending:  make([]uint32, (sources+31)/32),
+		claimed:  make([]bool, sources),
+	}, nil
+}
+
+//AddHart connects the next hart, it gets a machine and a supervisor mode context
+func (p *PLIC) AddHart(h Hart) {
+	for _, irq := range []uint{irqMEIP, irqSEIP} {
+		p.contexts = append(p.contexts, &context{hart: h, irq: irq, enable: make([]uint32, len(p.pending))})
+	}
+}
+
+//line is the interrupt line of one source
+type line struct {
+	p      *PLIC
+	source int
+}
+
+func (l line) Raise() { l.p.setLevel(l.source, true) }
+func (l line) Lower() { l.p.setLevel(l.source, false) }
+
+//Line returns the interrupt line of source
+func (p *PLIC) Line(source int) (bus.IRQLine, error) {
+	if source < 1 || source >= p.sources {
+		return nil, fmt.Errorf("Could not connect PLIC source %d", source)
+	}
+	return line{p: p, source: source}, nil
+}
+
+//setLevel follows a device line, the interrupt is pending while the line is
+//raised and no hart has claimed it
+func (p *PLIC) setLevel(source int, level bool) {
+	p.level[source] = level
+	p.setPending(source, level && !p.claimed[source])
+	p.update()
+}
+
+func (p *PLIC) setPending(source int, pending bool) {
+	if pending {
+		p.pending[source/32] |= 1 << (source % 32)
+	} else {
+		p.pending[source/32] &^= 1 << (source % 32)
+	}
+}
+
+//best returns the pending and enabled source with the highest priority above
+//the threshold of ctx, the lowest number wins a tie. 0 means none.
+func (p *PLIC) best(ctx *context) int {
+	best, prio := 0, ctx.threshold
+	for i, word := range p.pending {
+		word &= ctx.enable[i]
+		for word != 0 {
+			bit := bits.TrailingZeros32(word)
+			word &^= 1 << bit
+			source := i*32 + bit
+			if p.priority[source] > prio {
+				best, prio = source, p.priority[source]
+			}
+		}
+	}
+	return best
+}
+
+//update signals the external interrupt of every context which has an interrupt to claim
+func (p *PLIC) update() {
+	for _, ctx := range p.contexts {
+		ctx.hart.SetPending(ctx.irq, p.best(ctx) != 0)
+	}
+}
+
+//claim returns the interrupt ctx should service next and marks it in service
+func (p *PLIC) claim(ctx *context) uint32 {
+	source := p.best(ctx)
+	if source != 0 {
+		p.claimed[source] = true
+		p.setPending(source, false)
+		p.update()
+	}
+	return uint32(source)
+}
+
+//complete ends the service of source, a line which is still raised is pending again
+func (p *PLIC) complete(ctx *context, source uint32) {
+	if source == 0 || int(source) >= p.sources || ctx.enable[source/32]&(1<<(source%32)) == 0 {
+		return
+	}
+	p.claimed[source] = false
+	p.setPending(int(source), p.level[source])
+	p.update()
+}
+
+//Load value, reading the claim register claims the interrupt
+func (p *PLIC) Load(addr uint64, size uint64) (uint64, error) {
+	if debug {
+		fmt.Println("PLIC Load addr, size", addr, size)
+	}
+	return p.read(addr, size, true)
+}
+
+//Peek reads like Load, the claim register shows the interrupt a claim would
+//return without claiming it
+func (p *PLIC) Peek(addr uint64, size uint64) (uint64, error) {
+	return p.read(addr, size, false)
+}
+
+//read returns a register, claim tells if a read of the claim register claims
+func (p *PLIC) read(addr uint64, size uint64, claim bool) (uint64, error) {
+	if size != 32 {
+		return 0, errors.New("Could not access PLIC register with this size")
+	}
+	off := addr - p.base
+	switch {
+	case off < pendingOffset:
+		if source := (off - priorityOffset) / 4; source < uint64(p.sources) {
+			return uint64(p.priority[source]), nil
+		}
+	case off < enableOffset:
+		if word := (off - pendingOffset) / 4; word < uint64(len(p.pending)) {
+			return uint64(p.pending[word]), nil
+		}
+	case off < contextOffset:
+		ctx, word := p.enableWord(off)
+		if ctx != nil {
+			return uint64(ctx.enable[word]), nil
+		}
+	default:
+		ctx, reg := p.contextRegister(off)
+		switch {
+		case ctx == nil:
+		case reg == thresholdOffset:
+			return uint64(ctx.threshold), nil
+		case reg == claimOffset && claim:
+			return uint64(p.claim(ctx)), nil
+		case reg == claimOffset:
+			return uint64(p.best(ctx)), nil
+		}
+	}
+	//reserved registers read as zero
+	return 0, nil
+}
+
+//Store value
+func (p *PLIC) Store(addr uint64, size uint64, value uint64) error {
+	if debug {
+		fmt.Println("PLIC Store addr, size, value ", addr, size, value)
+	}
+	if size != 32 {
+		return errors.New("Could not access PLIC register with this size")
+	}
+	off := addr - p.base
+	switch {
+	case off < pendingOffset:
+		//source 0 does not exist, its priority stays 0
+		if source := (off - priorityOffset) / 4; source != 0 && source < uint64(p.sources) {
+			p.priority[source] = uint32(value) & priorityMask
+		}
+	case off < enableOffset:
+		//the pending bits are read only
+	case off < contextOffset:
+		ctx, word := p.enableWord(off)
+		if ctx != nil {
+			ctx.enable[word] = uint32(value)
+			if word == 0 {
+				ctx.enable[0] &^= 0x1
+			}
+		}
+	default:
+		ctx, reg := p.contextRegister(off)
+		switch {
+		case ctx == nil:
+			return nil
+		case reg == thresholdOffset:
+			ctx.threshold = uint32(value) & priorityMask
+		case reg == claimOffset:
+			p.complete(ctx, uint32(value))
+			return nil
+		}
+	}
+	p.update()
+	return nil
+}
+
+//enableWord returns the context and word index of an enable register
+func (p *PLIC) enableWord(off uint64) (*context, uint64) {
+	index := (off - enableOffset) / enableStride
+	word := (off - enableOffset) % enableStride / 4
+	if index >= uint64(len(p.contexts)) || word >= uint64(len(p.pending)) {
+		return nil, 0
+	}
+	return p.contexts[index], word
+}
+
+//contextRegister returns the context and register offset of a threshold or claim register
+func (p *PLIC) contextRegister(off uint64) (*context, uint64) {
+	index := (off - contextOffset) / contextStride
+	if index >= uint64(len(p.contexts)) {
+		return nil, 0
+	}
+	return p.contexts[index], (off - contextOffset) % contextStride
+}
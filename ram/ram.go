@@ -1,145 +1,199 @@
 package ram
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 )
 
 const debug bool = false
 
-//MemorySize defines the  memory size for the cpu
-const MemorySize uint64 = 1024 * 1024 * 128
+//DefaultSize defines the default memory size for the cpu
+const DefaultSize uint64 = 1024 * 1024 * 128
 
-//RAM defining the data section which will contain the radius and height variables .
+//pageSize is the granularity the backing store is allocated with
+const pageSize uint64 = 4096
+
+//RAM is memory of a given size placed at a base address. The backing store is
+//allocated page by page on the first store, untouched memory reads as zero.
 type RAM struct {
-	dram [MemorySize]uint8
+	base uint64
+	size uint64
+	//pages maps the page number to the allocated pages only, so the cost
+	//grows with the memory the program touches rather than the size
+	pages map[uint64]*[pageSize]uint8
+	//last and lastPage cache the most recently used page, lastPage is nil
+	//while the cache is empty
+	last     uint64
+	lastPage *[pageSize]uint8
+}
+
+//New returns memory of size bytes starting at base
+func New(base uint64, size uint64) (*RAM, error) {
+	if size == 0 {
+		return nil, errors.New("Memory size must not be 0")
+	}
+	if base+size-1 < base {
+		return nil, fmt.Errorf("Memory at %#x with size %#x exceeds the address space", base, size)
+	}
+	return &RAM{
+		base:  base,
+		size:  size,
+		pages: make(map[uint64]*[pageSize]uint8),
+	}, nil
 }
 
-// Using the methods here
-// tankDimension interface
+//Base returns the first address of the memory
+func (r *RAM) Base() uint64 {
+	return r.base
+}
+
+//Size returns the size of the memory in bytes
+func (r *RAM) Size() uint64 {
+	return r.size
+}
+
+//Peek reads like Load, memory has no side effects
+func (r *RAM) Peek(addr uint64, size uint64) (uint64, error) {
+	return r.Load(addr, size)
+}
 
 //Load value
 func (r *RAM) Load(addr uint64, size uint64) (uint64, error) {
 	if debug {
 		fmt.Println("RAM Load addr, size", addr, size)
 	}
-	if addr > MemorySize {
-		return 0, errors.New("Segmentation Fault")
+	offset, err := r.offset(addr, size)
+	if err != nil {
+		return 0, err
+	}
+	page := r.lookup(offset / pageSize)
+	index := offset % pageSize
+	if index+size/8 > pageSize {
+		//the access crosses a page boundary
+		var value uint64
+		for i := uint64(0); i < size/8; i++ {
+			value |= r.load8(offset+i) << (8 * i)
+		}
+		return value, nil
+	}
+	if page == nil {
+		return 0, nil
 	}
 	switch size {
 	case 8:
-		return r.load8(addr), nil
+		return uint64(page[index]), nil
 	case 16:
-		return r.load16(addr), nil
+		return uint64(binary.LittleEndian.Uint16(page[index:])), nil
 	case 32:
-		return r.load32(addr), nil
-	case 64:
-		return r.load64(addr), nil
+		return uint64(binary.LittleEndian.Uint32(page[index:])), nil
 	default:
-		return 0, errors.New("Could not read memory size as requested")
-
+		return binary.LittleEndian.Uint64(page[index:]), nil
 	}
-
 }
 
 //Store value
 func (r *RAM) Store(addr uint64, size uint64, value uint64) error {
 	if debug {
-		fmt.Println("RAM Store addr, MemorySize, size, value ", addr, MemorySize, size, value)
+		fmt.Println("RAM Store addr, size, value ", addr, size, value)
 	}
-	if addr > MemorySize {
-		return errors.New("Segmentation Fault")
+	offset, err := r.offset(addr, size)
+	if err != nil {
+		return err
 	}
+	index := offset % pageSize
+	if index+size/8 > pageSize {
+		//the access crosses a page boundary
+		for i := uint64(0); i < size/8; i++ {
+			r.page(offset + i)[(offset+i)%pageSize] = uint8(value >> (8 * i))
+		}
+		return nil
+	}
+	page := r.page(offset)
 	switch size {
 	case 8:
-		r.store8(addr, value)
-		return nil
+		page[index] = uint8(value)
 	case 16:
-		r.store16(addr, value)
-		return nil
+		binary.LittleEndian.PutUint16(page[index:], uint16(value))
 	case 32:
-		r.store32(addr, value)
-		return nil
-	case 64:
-		r.store64(addr, value)
-		return nil
+		binary.LittleEndian.PutUint32(page[index:], uint32(value))
 	default:
-		return errors.New("Could not write memory size as requested")
+		binary.LittleEndian.PutUint64(page[index:], value)
 	}
+	return nil
 }
 
-func (r *RAM) load8(addr uint64) uint64 {
-	if debug {
-		fmt.Println("RAM Load8 addr", uint(addr))
+//Zero clears size bytes at addr, whole pages give their backing store back
+func (r *RAM) Zero(addr uint64, size uint64) error {
+	if size == 0 {
+		return nil
 	}
-	var index uint = uint(addr)
-	return uint64(r.dram[index])
-}
-
-func (r *RAM) load16(addr uint64) uint64 {
-	if debug {
-		fmt.Println("RAM Load16 addr", uint(addr))
+	if addr < r.base || size > r.size || addr-r.base > r.size-size {
+		return errors.New("Segmentation Fault")
 	}
-	var index uint = uint(addr)
-	return (uint64(r.dram[index]) | (uint64(r.dram[index+1]) << 8))
-}
-
-func (r *RAM) load32(addr uint64) uint64 {
-	if debug {
-		fmt.Println("RAM Load32 addr", uint(addr))
+	offset := addr - r.base
+	for size > 0 {
+		index := offset % pageSize
+		n := pageSize - index
+		if n > size {
+			n = size
+		}
+		page := r.lookup(offset / pageSize)
+		if n == pageSize {
+			delete(r.pages, offset/pageSize)
+			r.lastPage = nil
+		} else if page != nil {
+			for i := index; i < index+n; i++ {
+				page[i] = 0
+			}
+		}
+		offset += n
+		size -= n
 	}
-	var index uint = uint(addr)
-	return (uint64(r.dram[index]) | (uint64(r.dram[index+1]) << 8) | (uint64(r.dram[index+2]) << 16) | (uint64(r.dram[index+3]) << 24))
+	return nil
 }
 
-func (r *RAM) load64(addr uint64) uint64 {
-	if debug {
-		fmt.Println("RAM Load64 addr", uint(addr))
+//offset checks the access and returns its offset from base
+func (r *RAM) offset(addr uint64, size uint64) (uint64, error) {
+	switch size {
+	case 8, 16, 32, 64:
+	default:
+		return 0, errors.New("Could not access memory size as requested")
 	}
-	var index uint = uint(addr)
-	return (uint64(r.dram[index]) | (uint64(r.dram[index+1]) << 8) | (uint64(r.dram[index+2]) << 16) | (uint64(r.dram[index+3]) << 24) | (uint64(r.dram[index+4]) << 32) | (uint64(r.dram[index+5]) << 40) | (uint64(r.dram[index+6]) << 48) | (uint64(r.dram[index+7]) << 56))
-}
-
-func (r *RAM) store8(addr uint64, value uint64) {
-	if debug {
-		fmt.Println("RAM Store8 addr, value ", addr, value)
+	if addr < r.base || size/8 > r.size || addr-r.base > r.size-size/8 {
+		return 0, errors.New("Segmentation Fault")
 	}
-	var index uint = uint(addr)
-	r.dram[index] = uint8((value & 0xff))
+	return addr - r.base, nil
 }
 
-func (r *RAM) store16(addr uint64, value uint64) {
-	if debug {
-		fmt.Println("RAM Store16 addr, value ", addr, value)
+//lookup returns page number n, nil if it was never stored to
+func (r *RAM) lookup(n uint64) *[pageSize]uint8 {
+	if r.lastPage != nil && r.last == n {
+		return r.lastPage
+	}
+	page := r.pages[n]
+	if page != nil {
+		r.last, r.lastPage = n, page
 	}
-	var index uint = uint(addr)
-	r.dram[index] = uint8(((value) & 0xff))
-	r.dram[index+1] = uint8(((value >> 8) & 0xff))
+	return page
 }
 
-func (r *RAM) store32(addr uint64, value uint64) {
-	if debug {
-		fmt.Println("RAM Store32 addr, value ", addr, value)
+//load8 reads the byte at offset without allocating its page
+func (r *RAM) load8(offset uint64) uint64 {
+	page := r.lookup(offset / pageSize)
+	if page == nil {
+		return 0
 	}
-	var index uint = uint(addr)
-	r.dram[index] = uint8(((value) & 0xff))
-	r.dram[index+1] = uint8(((value >> 8) & 0xff))
-	r.dram[index+2] = uint8(((value >> 16) & 0xff))
-	r.dram[index+3] = uint8(((value >> 24) & 0xff))
+	return uint64(page[offset%pageSize])
 }
 
-func (r *RAM) store64(addr uint64, value uint64) {
-	if debug {
-		fmt.Println("RAM Store64 addr, value ", addr, value)
-	}
-	var index uint = uint(addr)
-	r.dram[index] = uint8(((value) & 0xff))
-	r.dram[index+1] = uint8(((value >> 8) & 0xff))
-	r.dram[index+2] = uint8(((value >> 16) & 0xff))
-	r.dram[index+3] = uint8(((value >> 24) & 0xff))
-	r.dram[index+4] = uint8(((value >> 32) & 0xff))
-	r.dram[index+5] = uint8(((value >> 40) & 0xff))
-	r.dram[index+6] = uint8(((value >> 48) & 0xff))
-	r.dram[index+7] = uint8(((value >> 56) & 0xff))
-	r.dram[index+5] = uint8(((value >> 48) & 0xff))
+//page returns the page holding offset, allocating it on first use
+func (r *RAM) page(offset uint64) *[pageSize]uint8 {
+	page := r.lookup(offset / pageSize)
+	if page == nil {
+		page = new([pageSize]uint8)
+		r.pages[offset/pageSize] = page
+		r.last, r.lastPage = offset/pageSize, page
+	}
+	return page
 }
@@ -0,0 +1,229 @@
+package rvc
+
+import "errors"
+
+const debug bool = false
+
+//RV64C, every compressed instruction is expanded into its 32 bit base
+//equivalent. The hart executes and the disassembler shows that one.
+
+//ErrIllegal is returned for illegal and reserved compressed encodings
+var ErrIllegal = errors.New("Could not execute compressed instruction. Illegal or reserved encoding")
+
+//Encoders for the base instruction formats
+
+func encodeR(opcode, rd, funct3, rs1, rs2, funct7 uint64) uint64 {
+	return funct7<<25 | rs2<<20 | rs1<<15 | funct3<<12 | rd<<7 | opcode
+}
+
+func encodeI(opcode, rd, funct3, rs1, imm uint64) uint64 {
+	return (imm&0xfff)<<20 | rs1<<15 | funct3<<12 | rd<<7 | opcode
+}
+
+func encodeS(opcode, funct3, rs1, rs2, imm uint64) uint64 {
+	return ((imm>>5)&0x7f)<<25 | rs2<<20 | rs1<<15 | funct3<<12 | (imm&0x1f)<<7 | opcode
+}
+
+func encodeB(funct3, rs1, rs2, imm uint64) uint64 {
+	return ((imm>>12)&0x1)<<31 | ((imm>>5)&0x3f)<<25 | rs2<<20 | rs1<<15 | funct3<<12 | ((imm>>1)&0xf)<<8 | ((imm>>11)&0x1)<<7 | 0x63
+}
+
+func encodeU(opcode, rd, imm uint64) uint64 {
+	return imm&0xfffff000 | rd<<7 | opcode
+}
+
+func encodeJ(rd, imm uint64) uint64 {
+	return ((imm>>20)&0x1)<<31 | ((imm>>1)&0x3ff)<<21 | ((imm>>11)&0x1)<<20 | ((imm>>12)&0xff)<<12 | rd<<7 | 0x6f
+}
+
+//bit returns bit pos of c moved to position to
+func bit(c uint64, pos uint, to uint) uint64 {
+	return ((c >> pos) & 0x1) << to
+}
+
+//sext sign extends the lower bits of value
+func sext(value uint64, bits uint) uint64 {
+	return uint64(int64(value<<(64-bits)) >> (64 - bits))
+}
+
+//Expand returns the 32 bit instruction a compressed instruction stands for
+func Expand(c uint64) (uint64, error) {
+	c &= 0xffff
+	if c == 0 {
+		return 0, ErrIllegal
+	}
+	funct3 := (c >> 13) & 0x7
+	//full register fields
+	rd := (c >> 7) & 0x1f
+	rs2 := (c >> 2) & 0x1f
+	//x8-x15 register fields of the 3 bit formats
+	rdp := ((c >> 2) & 0x7) + 8
+	rs1p := ((c >> 7) & 0x7) + 8
+	//the 6 bit immediate of CI instructions, imm[5] at bit 12
+	imm6 := bit(c, 12, 5) | (c>>2)&0x1f
+
+	switch c & 0x3 {
+	case 0x0:
+		//uimm[5:3] at bits 12:10 of CL/CS instructions, shared by all sizes
+		uimm53 := (c >> 7) & 0x38
+		//uimm[7:6] at bits 6:5 for doubles
+		uimmD := uimm53 | (c<<1)&0xc0
+		//uimm[2] at bit 6 and uimm[6] at bit 5 for words
+		uimmW := uimm53 | bit(c, 6, 2) | bit(c, 5, 6)
+		switch funct3 {
+		case 0x0:
+			//c.addi4spn
+			nzuimm := (c>>7)&0x30 | (c>>1)&0x3c0 | bit(c, 6, 2) | bit(c, 5, 3)
+			if nzuimm == 0 {
+				return 0, ErrIllegal
+			}
+			return encodeI(0x13, rdp, 0x0, 2, nzuimm), nil
+		case 0x1:
+			//c.fld
+			return encodeI(0x07, rdp, 0x3, rs1p, uimmD), nil
+		case 0x2:
+			//c.lw
+			return encodeI(0x03, rdp, 0x2, rs1p, uimmW), nil
+		case 0x3:
+			//c.ld
+			return encodeI(0x03, rdp, 0x3, rs1p, uimmD), nil
+		case 0x5:
+			//c.fsd
+			return encodeS(0x27, 0x3, rs1p, rdp, uimmD), nil
+		case 0x6:
+			//c.sw
+			return encodeS(0x23, 0x2, rs1p, rdp, uimmW), nil
+		case 0x7:
+			//c.sd
+			return encodeS(0x23, 0x3, rs1p, rdp, uimmD), nil
+		}
+	case 0x1:
+		switch funct3 {
+		case 0x0:
+			//c.addi, c.nop for rd 0
+			return encodeI(0x13, rd, 0x0, rd, sext(imm6, 6)), nil
+		case 0x1:
+			//c.addiw
+			if rd == 0 {
+				return 0, ErrIllegal
+			}
+			return encodeI(0x1b, rd, 0x0, rd, sext(imm6, 6)), nil
+		case 0x2:
+			//c.li
+			return encodeI(0x13, rd, 0x0, 0, sext(imm6, 6)), nil
+		case 0x3:
+			if rd == 2 {
+				//c.addi16sp, nzimm[9|4|6|8:7|5]
+				nzimm := bit(c, 12, 9) | bit(c, 6, 4) | bit(c, 5, 6) | (c<<4)&0x180 | bit(c, 2, 5)
+				if nzimm == 0 {
+					return 0, ErrIllegal
+				}
+				return encodeI(0x13, 2, 0x0, 2, sext(nzimm, 10)), nil
+			}
+			//c.lui
+			if imm6 == 0 {
+				return 0, ErrIllegal
+			}
+			return encodeU(0x37, rd, sext(imm6<<12, 18)), nil
+		case 0x4:
+			switch (c >> 10) & 0x3 {
+			case 0x0:
+				//c.srli
+				return encodeI(0x13, rs1p, 0x5, rs1p, imm6), nil
+			case 0x1:
+				//c.srai
+				return encodeI(0x13, rs1p, 0x5, rs1p, imm6|0x400), nil
+			case 0x2:
+				//c.andi
+				return encodeI(0x13, rs1p, 0x7, rs1p, sext(imm6, 6)), nil
+			}
+			switch bit(c, 12, 2) | (c>>5)&0x3 {
+			case 0x0:
+				//c.sub
+				return encodeR(0x33, rs1p, 0x0, rs1p, rdp, 0x20), nil
+			case 0x1:
+				//c.xor
+				return encodeR(0x33, rs1p, 0x4, rs1p, rdp, 0x00), nil
+			case 0x2:
+				//c.or
+				return encodeR(0x33, rs1p, 0x6, rs1p, rdp, 0x00), nil
+			case 0x3:
+				//c.and
+				return encodeR(0x33, rs1p, 0x7, rs1p, rdp, 0x00), nil
+			case 0x4:
+				//c.subw
+				return encodeR(0x3b, rs1p, 0x0, rs1p, rdp, 0x20), nil
+			case 0x5:
+				//c.addw
+				return encodeR(0x3b, rs1p, 0x0, rs1p, rdp, 0x00), nil
+			}
+		case 0x5:
+			//c.j, offset[11|4|9:8|10|6|7|3:1|5]
+			offset := bit(c, 12, 11) | bit(c, 11, 4) | (c>>1)&0x300 | bit(c, 8, 10) | bit(c, 7, 6) | bit(c, 6, 7) | (c>>2)&0xe | bit(c, 2, 5)
+			return encodeJ(0, sext(offset, 12)), nil
+		case 0x6, 0x7:
+			//c.beqz, c.bnez, offset[8|4:3] and offset[7:6|2:1|5]
+			offset := bit(c, 12, 8) | (c>>7)&0x18 | (c<<1)&0xc0 | (c>>2)&0x6 | bit(c, 2, 5)
+			return encodeB(funct3-0x6, rs1p, 0, sext(offset, 9)), nil
+		}
+	case 0x2:
+		switch funct3 {
+		case 0x0:
+			//c.slli
+			return encodeI(0x13, rd, 0x1, rd, imm6), nil
+		case 0x1:
+			//c.fldsp, uimm[5|4:3|8:6]
+			uimm := bit(c, 12, 5) | (c>>2)&0x18 | (c<<4)&0x1c0
+			return encodeI(0x07, rd, 0x3, 2, uimm), nil
+		case 0x2:
+			//c.lwsp, uimm[5|4:2|7:6]
+			if rd == 0 {
+				return 0, ErrIllegal
+			}
+			uimm := bit(c, 12, 5) | (c>>2)&0x1c | (c<<4)&0xc0
+			return encodeI(0x03, rd, 0x2, 2, uimm), nil
+		case 0x3:
+			//c.ldsp, uimm[5|4:3|8:6]
+			if rd == 0 {
+				return 0, ErrIllegal
+			}
+			uimm := bit(c, 12, 5) | (c>>2)&0x18 | (c<<4)&0x1c0
+			return encodeI(0x03, rd, 0x3, 2, uimm), nil
+		case 0x4:
+			if (c>>12)&0x1 == 0 {
+				if rs2 == 0 {
+					//c.jr
+					if rd == 0 {
+						return 0, ErrIllegal
+					}
+					return encodeI(0x67, 0, 0x0, rd, 0), nil
+				}
+				//c.mv
+				return encodeR(0x33, rd, 0x0, 0, rs2, 0x00), nil
+			}
+			if rs2 == 0 {
+				if rd == 0 {
+					//c.ebreak
+					return 0x00100073, nil
+				}
+				//c.jalr
+				return encodeI(0x67, 1, 0x0, rd, 0), nil
+			}
+			//c.add
+			return encodeR(0x33, rd, 0x0, rd, rs2, 0x00), nil
+		case 0x5:
+			//c.fsdsp, uimm[5:3|8:6]
+			uimm := (c>>7)&0x38 | (c>>1)&0x1c0
+			return encodeS(0x27, 0x3, 2, rs2, uimm), nil
+		case 0x6:
+			//c.swsp, uimm[5:2|7:6]
+			uimm := (c>>7)&0x3c | (c>>1)&0xc0
+			return encodeS(0x23, 0x2, 2, rs2, uimm), nil
+		case 0x7:
+			//c.sdsp, uimm[5:3|8:6]
+			uimm := (c>>7)&0x38 | (c>>1)&0x1c0
+			return encodeS(0x23, 0x3, 2, rs2, uimm), nil
+		}
+	}
+	return 0, ErrIllegal
+}
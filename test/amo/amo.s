@@ -0,0 +1,8 @@
+main:
+  addi x25, x0, 0x100
+  addi x26, x0, 5
+  sd x26, 0(x25)
+  amoadd.d x28, x26, (x25)
+  lr.d x29, (x25)
+  sc.d x30, x26, (x25)
+  sc.d x31, x26, (x25)
@@ -0,0 +1,7 @@
+main:
+  addi x25, x0, 5
+  csrw mscratch, x25
+  csrrsi x28, mscratch, 2
+  csrrci x29, mscratch, 1
+  csrr x30, mscratch
+  csrr x31, instret
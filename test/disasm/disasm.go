@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+func main() {
+
+	prg := "hart.go"
+	inst := "test/disasm/disasm.bin"
+	cmd := exec.Command("go", "run", prg, "-disasm", inst)
+	stdout, err := cmd.Output()
+
+	if err != nil {
+		fmt.Printf("failed exec: %s ", inst)
+		return
+	}
+
+	for _, line := range []string{
+		"       2:  4515      li      a0, 5\n",
+		"      1e:  011032b3  snez    t0, a7\n",
+		"      3a:  12345c37  lui     s8, 0x12345\n",
+		"      50:  d945      beqz    a0, 0x0\n",
+		"      64:  8082      ret\n",
+		"      6e:  0310000f  fence   rw, w\n",
+		"      7e:  10416073  csrsi   sie, 2\n",
+		"      8a:  002027f3  frrm    a5\n",
+		"      9a:  0708b7af  amoadd.d.aqrl a5, a6, (a7)\n",
+		"      ae:  12f716d3  fmul.d  fa3, fa4, fa5, rtz\n",
+		"      e2:  c2279753  fcvt.l.d a4, fa5, rtz\n",
+		"     100:  12050073  sfence.vma a0\n",
+		"     104:  713d      addi    sp, sp, -32\n",
+		"     114:  0000      .half 0x0000\n",
+		"     116:  ffffffff  .word 0xffffffff\n",
+	} {
+		if !strings.Contains(string(stdout), line) {
+			fmt.Printf("failed test: %s", inst)
+			fmt.Println()
+			return
+		}
+	}
+
+	fmt.Printf("passed test: %s", inst)
+	fmt.Println()
+}
@@ -0,0 +1,80 @@
+main:
+  nop
+  li a0, 5
+  mv a1, a0
+  add a2, a0, a1
+  sub a3, a2, a0
+  neg a4, a3
+  sext.w a5, a4
+  not a6, a5
+  seqz a7, a6
+  snez t0, a7
+  slli t1, t0, 33
+  srai t2, t1, 3
+  addiw s0, s1, -7
+  sraiw s1, s0, 2
+  mulh s2, s3, s4
+  divuw s5, s6, s7
+  lui s8, 0x12345
+  auipc s9, 0x1
+  ld s10, -16(sp)
+  lbu s11, 3(gp)
+  sd ra, 8(sp)
+  sw tp, -4(t3)
+  beqz a0, main
+  bltu t4, t5, main
+  blez t6, main
+  jal main
+  j main
+  jalr t0
+  jr t1
+  ret
+  jalr a0, 12(a1)
+  fence
+  fence rw, w
+  fence.i
+  csrr a0, mstatus
+  csrw mtvec, a1
+  csrsi sie, 2
+  csrrw a2, mscratch, a3
+  rdcycle a4
+  frrm a5
+  fsflags a6
+  lr.d.aq a0, (a1)
+  sc.w.rl a2, a3, (a4)
+  amoadd.d.aqrl a5, a6, (a7)
+  amomaxu.w t0, t1, (t2)
+  flw ft0, 4(a0)
+  fsd fs1, -8(sp)
+  fadd.s fa0, fa1, fa2
+  fmul.d fa3, fa4, fa5, rtz
+  fmadd.d fs0, fs1, fs2, fs3
+  fnmsub.s ft8, ft9, ft10, ft11
+  fsqrt.d ft1, ft2
+  fmv.d ft3, ft4
+  fneg.s ft5, ft6
+  fabs.d ft7, fs4
+  fsgnjx.s fs5, fs6, fs7
+  fmin.d fs8, fs9, fs10
+  flt.s a0, fa0, fa1
+  fclass.d a1, fa2
+  fmv.x.w a2, fa3
+  fmv.d.x fa4, a3
+  fcvt.l.d a4, fa5, rtz
+  fcvt.s.wu fa6, a5
+  fcvt.d.s fa7, fs11
+  ecall
+  ebreak
+  mret
+  sret
+  wfi
+  sfence.vma a0
+  c.addi16sp sp, -32
+  c.lwsp a0, 12(sp)
+  c.sdsp a1, 16(sp)
+  c.beqz a2, main
+  c.j main
+  c.jr ra
+  c.fld fa0, 8(a1)
+  c.unimp
+  .word 0xffffffff
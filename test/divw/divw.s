@@ -0,0 +1,8 @@
+main:
+  lui x25, 0x80000
+  addi x26, x0, -1
+  addi x27, x0, 5
+  divw x28, x25, x26
+  remw x29, x25, x26
+  divuw x30, x25, x0
+  remuw x31, x27, x0
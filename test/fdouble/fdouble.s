@@ -0,0 +1,11 @@
+main:
+  addi x25, x0, 3
+  addi x26, x0, 2
+  fcvt.d.l f1, x25
+  fcvt.d.l f2, x26
+  fdiv.d f3, f1, f2
+  fmul.d f4, f3, f2
+  fcvt.l.d x28, f3
+  fcvt.l.d x29, f3, rtz
+  feq.d x30, f4, f1
+  fmv.x.d x31, f3
@@ -0,0 +1,8 @@
+main:
+  addi x25, x0, -1
+  fcvt.s.w f1, x25
+  fsqrt.s f2, f1
+  fclass.s x28, f2
+  fmv.x.w x29, f1
+  fcvt.wu.s x30, f1
+  fclass.s x31, f1
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// const debug bool = true
+
+//exchange sends a packet and returns the reply, acknowledgments are skipped
+func exchange(conn net.Conn, r *bufio.Reader, pkt string) string {
+	var sum byte
+	for i := 0; i < len(pkt); i++ {
+		sum += pkt[i]
+	}
+	fmt.Fprintf(conn, "$%s#%02x", pkt, sum)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := r.ReadString('$'); err != nil {
+		return "timeout"
+	}
+	reply, err := r.ReadString('#')
+	if err != nil {
+		return "timeout"
+	}
+	r.Discard(2)
+	conn.Write([]byte("+"))
+	return strings.TrimSuffix(reply, "#")
+}
+
+func main() {
+
+	prg := "hart.go"
+	inst := "test/gdb/gdb.bin"
+	cmd := exec.Command("go", "run", prg, "-gdb", ":0", "-f", inst)
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		fmt.Printf("failed exec: %s ", inst)
+		return
+	}
+	defer cmd.Wait()
+
+	//the stub prints its address once it listens
+	lines := bufio.NewReader(stdout)
+	line, err := lines.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "Waiting for gdb on ") {
+		fmt.Printf("failed exec: %s ", inst)
+		return
+	}
+	conn, err := net.Dial("tcp", strings.TrimSpace(strings.TrimPrefix(line, "Waiting for gdb on ")))
+	if err != nil {
+		fmt.Printf("failed exec: %s ", inst)
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	steps := []struct{ send, want string }{
+		{"qSupported:multiprocess+;swbreak+;hwbreak+", "PacketSize=4000;qXfer:features:read+;swbreak+;hwbreak+;QStartNoAckMode+;vContSupported+"},
+		{"?", "S05"},
+		{"vCont;", "E01"},
+		{"Z0,8,4", "OK"},
+		{"c", "T05swbreak:;"},
+		//pc and a1
+		{"p20", "0800000000000000"},
+		{"Pb=0a00000000000000", "OK"},
+		{"s", "S05"},
+		{"pc", "0b00000000000000"},
+		{"Z2,28,8", "OK"},
+		{"c", "T05watch:28;"},
+		{"m28,8", "0b00000000000000"},
+		{"M28,1:0c", "OK"},
+		{"z2,28,8", "OK"},
+		{"c", "W0c"},
+	}
+	for _, step := range steps {
+		if reply := exchange(conn, r, step.send); reply != step.want {
+			fmt.Printf("failed test: %s %s got %s", inst, step.send, reply)
+			fmt.Println()
+			return
+		}
+	}
+	regs := exchange(conn, r, "g")
+	xml := exchange(conn, r, "qXfer:features:read:target.xml:0,fff")
+	exchange(conn, r, "D")
+	if len(regs) == 33*16 && strings.HasPrefix(regs[10*16:], "0c00000000000000") &&
+		strings.Contains(xml, `<reg name="pc" bitsize="64" type="code_ptr" regnum="32"/>`) {
+		fmt.Printf("passed test: %s", inst)
+		fmt.Println()
+		return
+	}
+
+	fmt.Printf("failed test: %s", inst)
+	fmt.Println()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// const debug bool = true
+
+func main() {
+
+	prg := "hart.go"
+	inst := "test/minstret/minstret.bin"
+	// cmd := exec.Command("pwd")
+	cmd := exec.Command("go", "run", prg, "-max", "100", "-f", inst)
+	stdout, err := cmd.Output()
+
+	// the run ends at the limit with status 2, go run then fails with status 1
+	if exit, ok := err.(*exec.ExitError); !ok || exit.ExitCode() != 1 {
+		fmt.Printf("failed exec: %s ", inst)
+		return
+	}
+
+	if strings.Contains(string(stdout), "HLT instruction limit reached") &&
+		strings.Contains(string(stdout), "0x1e ( t5 ) = 0x4	0x1f ( t6 ) = 0x3") {
+		fmt.Printf("passed test: %s", inst)
+		fmt.Println()
+		return
+	}
+
+	fmt.Printf("failed test: %s", inst)
+	fmt.Println()
+}
@@ -0,0 +1,8 @@
+main:
+  li x31, 3
+  csrw minstret, x31
+  csrr x30, minstret
+  # clearing minstret does not escape -max
+1:
+  csrw minstret, zero
+  j 1b
@@ -0,0 +1,15 @@
+.option norvc
+main:
+  # without trap handlers misaligned loads and stores are split into bytes
+  la t0, data
+  li t1, 0x1122334455667788
+  sd t1, 1(t0)
+  ld x31, 1(t0)
+  lw x30, 3(t0)
+  lhu x29, 7(t0)
+  li a7, 93
+  li a0, 0
+  ecall
+data:
+  .dword 0
+  .dword 0
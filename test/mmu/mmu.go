@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// const debug bool = true
+
+func main() {
+
+	prg := "hart.go"
+	inst := "test/mmu/mmu.bin"
+	// cmd := exec.Command("pwd")
+	cmd := exec.Command("go", "run", prg, "-traps", "-f", inst)
+	stdout, err := cmd.Output()
+
+	if err != nil {
+		fmt.Printf("failed exec: %s ", inst)
+		return
+	}
+
+	if strings.Contains(string(stdout), "0x09 ( s1 ) = 0x1234	") &&
+		strings.Contains(string(stdout), "0x12 ( s2 ) = 0xc0	0x13 ( s3 ) = 0xd	") &&
+		strings.Contains(string(stdout), "0x14 ( s4 ) = 0x40001000	0x15 ( s5 ) = 0x1	0x16 ( s6 ) = 0x0	") {
+		fmt.Printf("passed test: %s", inst)
+		fmt.Println()
+		return
+	}
+
+	fmt.Printf("failed test: %s", inst)
+	fmt.Println()
+}
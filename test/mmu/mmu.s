@@ -0,0 +1,61 @@
+.option norvc
+main:
+  la t0, mhandler
+  csrw mtvec, t0
+  # S and U-mode may access all memory
+  li t0, -1
+  csrw pmpaddr0, t0
+  li t0, 0x1f
+  csrw pmpcfg0, t0
+  # Sv39 root table at 0x10000, a 1 GiB identity page for the program
+  li t0, 0x10000
+  li t1, 0xcf
+  sd t1, 0(t0)
+  # 0x40000000 maps to 0x20000 through two more levels, A and D are clear
+  li t1, (0x11 << 10) | 1
+  sd t1, 8(t0)
+  li t0, 0x11000
+  li t1, (0x12 << 10) | 1
+  sd t1, 0(t0)
+  li t0, 0x12000
+  li t1, (0x20 << 10) | 0x7
+  sd t1, 0(t0)
+  li t0, (8 << 60) | 0x10
+  csrw satp, t0
+  sfence.vma
+  # enter S-mode at supervisor
+  li t0, 0x1800
+  csrc mstatus, t0
+  li t0, 0x800
+  csrs mstatus, t0
+  la t0, supervisor
+  csrw mepc, t0
+  mret
+mhandler:
+  csrr s3, mcause
+  csrr s4, mtval
+  j done
+supervisor:
+  li t0, 0x40000000
+  li t1, 0x1234
+  sd t1, 0(t0)
+  # read it back through the identity mapping
+  li t2, 0x20000
+  ld s1, 0(t2)
+  # the walk set A and D
+  li t2, 0x12000
+  ld s2, 0(t2)
+  andi s2, s2, 0xc0
+  # reservations hold physical addresses, a store to the identity alias
+  # breaks the one of the mapping and sc through the alias succeeds
+  li t2, 0x20000
+  lr.d t1, (t0)
+  sd t1, 0(t2)
+  sc.d s5, t1, (t0)
+  lr.d t1, (t0)
+  sc.d s6, t1, (t2)
+  # the next page is not mapped
+  li t1, 0x1000
+  add t0, t0, t1
+  ld t1, 0(t0)
+done:
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// const debug bool = true
+
+func main() {
+
+	prg := "hart.go"
+	inst := "test/monitor/monitor.bin"
+	cmd := exec.Command("go", "run", prg, "-monitor", "-f", inst)
+	cmd.Stdin = strings.NewReader(strings.Join([]string{
+		"b 0x8",
+		"c",
+		"reg a1 10",
+		"s",
+		"reg a2",
+		"step 0",
+		"until 0x18",
+		"l",
+		"x 0x28 8",
+		"write 0x28 0x0c 1",
+		"csr 0x340 5",
+		"trap",
+		"c",
+		"c",
+		"q",
+	}, "\n"))
+	stdout, err := cmd.Output()
+
+	// the program exits with status 12, go run then fails with status 1
+	if exit, ok := err.(*exec.ExitError); !ok || exit.ExitCode() != 1 {
+		fmt.Printf("failed exec: %s ", inst)
+		return
+	}
+
+	if strings.Contains(string(stdout), "Breakpoint at 0x8\n=* 0x00000008: 00b50633  add     a2, a0, a1\n") &&
+		strings.Contains(string(stdout), "a1 = 0xa\n") &&
+		strings.Contains(string(stdout), "=> 0x0000000c: 00000297  auipc   t0, 0x0\n") &&
+		strings.Contains(string(stdout), "a2 = 0xb\n") &&
+		strings.Contains(string(stdout), "Could not step 0 instructions\n") &&
+		strings.Contains(string(stdout), "   0x00000014: 00c2b023  sd      a2, 0(t0)\n=> 0x00000018: 0002b503  ld      a0, 0(t0)\n") &&
+		strings.Contains(string(stdout), "=> 0x00000018: 0002b503  ld      a0, 0(t0)\n") &&
+		strings.Contains(string(stdout), "0x00000028: 0b 00 00 00 00 00 00 00\n") &&
+		strings.Contains(string(stdout), "csr 0x340 = 0x5\n") &&
+		strings.Contains(string(stdout), "No trap yet\n") &&
+		strings.Contains(string(stdout), "HLT exit(12) at pc 0x20\n") &&
+		strings.Contains(string(stdout), "The program has ended: HLT exit(12) at pc 0x20\n") &&
+		strings.Contains(string(stdout), "0x0a ( a0 ) = 0xc	") {
+		fmt.Printf("passed test: %s", inst)
+		fmt.Println()
+		return
+	}
+
+	fmt.Printf("failed test: %s", inst)
+	fmt.Println()
+}
@@ -0,0 +1,15 @@
+.option norvc
+# the monitor stops at bp, changes a1, steps over the add and runs until the load
+main:
+  li a0, 1
+  li a1, 2
+bp:
+  add a2, a0, a1
+  la t0, data
+  sd a2, 0(t0)
+  ld a0, 0(t0)
+  li a7, 93
+  ecall
+  nop
+data:
+  .dword 0
@@ -0,0 +1,7 @@
+main:
+  addi x25, x0, -7
+  addi x26, x0, 2
+  div x28, x25, x26
+  rem x29, x25, x26
+  remu x30, x25, x0
+  mulhu x31, x25, x26
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// const debug bool = true
+
+func main() {
+
+	prg := "hart.go"
+	inst := "test/peek/peek.bin"
+	cmd := exec.Command("go", "run", prg, "-monitor", "-membase", "0x80000000", "-uart", "0x10000000", "-serial", "none", "-f", inst)
+	cmd.Stdin = strings.NewReader(strings.Join([]string{
+		"b 0x80000014",
+		"c",
+		"x 0x10000000 1",
+		"x 0x10000005 1",
+		"c",
+		"q",
+	}, "\n"))
+	stdout, err := cmd.Output()
+
+	if err != nil {
+		fmt.Printf("failed exec: %s ", inst)
+		return
+	}
+
+	// reading the registers in the monitor leaves the byte in the FIFO
+	if strings.Contains(string(stdout), "0x10000000: 5a\n") &&
+		strings.Contains(string(stdout), "0x10000005: 61\n") &&
+		strings.Contains(string(stdout), "0x14 ( s4 ) = 0x5a	0x15 ( s5 ) = 0x60	") {
+		fmt.Printf("passed test: %s", inst)
+		fmt.Println()
+		return
+	}
+
+	fmt.Printf("failed test: %s", inst)
+	fmt.Println()
+}
@@ -0,0 +1,12 @@
+.option norvc
+# the monitor looks at the UART before the program reads the received byte
+main:
+  li s0, 0x10000000
+  # in loopback mode a transmitted byte is received
+  li t0, 0x10
+  sb t0, 4(s0)
+  li t0, 0x5a
+  sb t0, 0(s0)
+bp:
+  lbu s4, 0(s0)
+  lbu s5, 5(s0)
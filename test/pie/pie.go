@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// const debug bool = true
+
+func main() {
+
+	prg := "hart.go"
+	inst := "test/pie/pie.elf"
+	// the header of a position independent RISC-V executable without segments
+	dir, err := ioutil.TempDir("", "rvsim")
+	if err != nil {
+		fmt.Printf("failed exec: %s ", inst)
+		return
+	}
+	defer os.RemoveAll(dir)
+	header := make([]byte, 64)
+	copy(header, "\x7fELF\x02\x01\x01")
+	binary.LittleEndian.PutUint16(header[0x10:], 3)
+	binary.LittleEndian.PutUint16(header[0x12:], 0xf3)
+	binary.LittleEndian.PutUint32(header[0x14:], 1)
+	binary.LittleEndian.PutUint16(header[0x34:], 64)
+	binary.LittleEndian.PutUint16(header[0x36:], 56)
+	binary.LittleEndian.PutUint16(header[0x3a:], 64)
+	elf := filepath.Join(dir, "pie.elf")
+	if ioutil.WriteFile(elf, header, 0644) != nil {
+		fmt.Printf("failed exec: %s ", inst)
+		return
+	}
+	// cmd := exec.Command("pwd")
+	cmd := exec.Command("go", "run", prg, "-f", elf)
+	stdout, err := cmd.Output()
+
+	// the loader refuses the file, go run then fails with status 1
+	if exit, ok := err.(*exec.ExitError); !ok || exit.ExitCode() != 1 {
+		fmt.Printf("failed exec: %s ", inst)
+		return
+	}
+
+	if strings.Contains(string(stdout), "Unsupported ELF type ET_DYN") {
+		fmt.Printf("passed test: %s", inst)
+		fmt.Println()
+		return
+	}
+
+	fmt.Printf("failed test: %s", inst)
+	fmt.Println()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// const debug bool = true
+
+func main() {
+
+	prg := "hart.go"
+	inst := "test/pk/pk.bin"
+	// cmd := exec.Command("pwd")
+	cmd := exec.Command("go", "run", prg, "-pk", "-f", inst)
+	stdout, err := cmd.Output()
+
+	// the program exits with status 7, go run then fails with status 1
+	if exit, ok := err.(*exec.ExitError); !ok || exit.ExitCode() != 1 {
+		fmt.Printf("failed exec: %s ", inst)
+		return
+	}
+
+	if strings.HasPrefix(string(stdout), "pk ok\n") &&
+		strings.Contains(string(stdout), "HLT exit(7)") &&
+		strings.Contains(string(stdout), "0x09 ( s1 ) = 0x1	") &&
+		strings.Contains(string(stdout), "0x12 ( s2 ) = 0x6	") &&
+		strings.Contains(string(stdout), "0x14 ( s4 ) = 0x1000	0x15 ( s5 ) = 0x0	0x16 ( s6 ) = 0xfffffffffffffffe	0x17 ( s7 ) = 0x0	") &&
+		strings.Contains(string(stdout), "0x18 ( s8 ) = 0xfffffffffffffff7	0x19 ( s9 ) = 0x1	0x1a ( s10) = 0x206e6f6974706f2e	") {
+		fmt.Printf("passed test: %s", inst)
+		fmt.Println()
+		return
+	}
+
+	fmt.Printf("failed test: %s", inst)
+	fmt.Println()
+}
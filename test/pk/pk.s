@@ -0,0 +1,83 @@
+.option norvc
+main:
+  # argc
+  ld s1, 0(sp)
+  # write to stdout
+  li a0, 1
+  la a1, message
+  li a2, 6
+  li a7, 64
+  ecall
+  mv s2, a0
+  # the heap starts after the program, grow it by a page
+  li a0, 0
+  li a7, 214
+  ecall
+  mv s3, a0
+  li t0, 4096
+  add a0, s3, t0
+  li a7, 214
+  ecall
+  sub s4, a0, s3
+  # fstat of stdout
+  li a0, 1
+  mv a1, s3
+  li a7, 80
+  ecall
+  mv s5, a0
+  # a missing file
+  li a0, -100
+  la a1, missing
+  li a2, 0
+  li a7, 56
+  ecall
+  mv s6, a0
+  # read the start of this source
+  li a0, -100
+  la a1, source
+  li a2, 0
+  li a7, 56
+  ecall
+  mv s11, a0
+  mv a0, s11
+  mv a1, s3
+  li a2, 8
+  li a7, 63
+  ecall
+  ld s10, 0(s3)
+  mv a0, s11
+  li a7, 57
+  ecall
+  mv s7, a0
+  # closing it again fails
+  mv a0, s11
+  li a7, 57
+  ecall
+  mv s8, a0
+  # the time of day
+  mv a0, s3
+  li a1, 0
+  li a7, 169
+  ecall
+  ld t0, 0(s3)
+  snez s9, t0
+  # a NULL tv leaves memory at 0 alone
+  ld t1, 0(zero)
+  li a0, 0
+  li a1, 0
+  li a7, 169
+  ecall
+  ld t2, 0(zero)
+  xor t0, t1, t2
+  or t0, t0, a0
+  seqz t0, t0
+  and s9, s9, t0
+  li a0, 7
+  li a7, 93
+  ecall
+message:
+  .ascii "pk ok\n"
+missing:
+  .ascii "/nonexistent/rvsim\0\0\0\0\0"
+source:
+  .ascii "test/pk/pk.s\0\0\0\0"
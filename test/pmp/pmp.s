@@ -0,0 +1,51 @@
+.option norvc
+main:
+  la t0, mhandler
+  csrw mtvec, t0
+  # entry 0: TOR [0, 0x20000) read and execute, the program
+  li t0, 0x20000 >> 2
+  csrw pmpaddr0, t0
+  # entry 1: NAPOT 4 KiB at 0x30000 read only
+  li t0, (0x30000 >> 2) | 0x1ff
+  csrw pmpaddr1, t0
+  # entry 2: NA4 at 0x40000 read and write
+  li t0, 0x40000 >> 2
+  csrw pmpaddr2, t0
+  # entry 3: locked NA4 at 0x50000 without access, also for M-mode
+  li t0, 0x50000 >> 2
+  csrw pmpaddr3, t0
+  li t0, 0x9013190d
+  csrw pmpcfg0, t0
+  # the locked entry keeps its configuration
+  li t0, 0x1f000000
+  csrs pmpcfg0, t0
+  csrr s5, pmpcfg0
+  li t0, 0x50000
+  sw zero, 0(t0)
+  # enter U-mode at user
+  li t0, 0x1800
+  csrc mstatus, t0
+  la t0, user
+  csrw mepc, t0
+  mret
+mhandler:
+  # collect the causes in s1, end the program on ecall
+  csrr t3, mcause
+  slli s1, s1, 4
+  or s1, s1, t3
+  li t4, 8
+  beq t3, t4, done
+  csrr t5, mepc
+  addi t5, t5, 4
+  csrw mepc, t5
+  mret
+user:
+  li t0, 0x30000
+  lw t1, 0(t0)
+  sw t1, 0(t0)
+  li t0, 0x40000
+  sw t1, 0(t0)
+  lw t1, 4(t0)
+  ecall
+  nop
+done:
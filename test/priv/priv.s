@@ -0,0 +1,53 @@
+.option norvc
+main:
+  la t0, mhandler
+  csrw mtvec, t0
+  # S and U-mode may access all memory
+  li t0, -1
+  csrw pmpaddr0, t0
+  li t0, 0x1f
+  csrw pmpcfg0, t0
+  la t0, shandler
+  csrw stvec, t0
+  # delegate illegal instructions and ecall from U-mode
+  li t0, 0x104
+  csrw medeleg, t0
+  # enter S-mode at supervisor
+  li t0, 0x1800
+  csrc mstatus, t0
+  li t0, 0x800
+  csrs mstatus, t0
+  la t0, supervisor
+  csrw mepc, t0
+  mret
+mhandler:
+  # M-mode collects the causes in s2 and ends the program
+  csrr t3, mcause
+  slli s2, s2, 4
+  or s2, s2, t3
+  j done
+shandler:
+  # S-mode collects the causes in s1, passes ecall on to M-mode
+  csrr t3, scause
+  slli s1, s1, 4
+  or s1, s1, t3
+  li t4, 8
+  beq t3, t4, 1f
+  csrr t5, sepc
+  addi t5, t5, 4
+  csrw sepc, t5
+  sret
+1:
+  ecall
+supervisor:
+  # enter U-mode at user
+  li t0, 0x100
+  csrc sstatus, t0
+  la t0, user
+  csrw sepc, t0
+  sret
+user:
+  csrr t0, sstatus
+  wfi
+  ecall
+done:
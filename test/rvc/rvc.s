@@ -0,0 +1,9 @@
+main:
+  c.li x28, 5
+  c.addi x28, 1
+  c.mv x29, x28
+  c.add x29, x28
+  c.slli x29, 2
+  c.lui x30, 1
+  c.addiw x30, -1
+  c.li x31, -1
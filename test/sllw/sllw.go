@@ -21,7 +21,7 @@ func main() {
 		return
 	}
 
-	if strings.Contains(string(stdout), "0x1e ( t5 ) = 0x15	0x1f ( t6 ) = 0x17") {
+	if strings.Contains(string(stdout), "0x1e ( t5 ) = 0x15	0x1f ( t6 ) = 0x54") {
 		fmt.Printf("passed test: %s", inst)
 		fmt.Println()
 		return
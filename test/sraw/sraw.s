@@ -0,0 +1,9 @@
+main:
+  addi x25, x0, -7
+  addi x26, x0, 2
+  addi x27, x0, 3
+  slli x27, x27, 31
+  sub x28, x26, x25
+  sraiw x29, x27, 4
+  sraw x30, x25, x26
+  sraw x31, x27, x26
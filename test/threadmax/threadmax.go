@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// const debug bool = true
+
+func main() {
+
+	prg := "hart.go"
+	inst := "test/threadmax/threadmax.bin"
+	log, err := ioutil.TempFile("", "trace")
+	if err != nil {
+		fmt.Printf("failed exec: %s ", inst)
+		return
+	}
+	log.Close()
+	defer os.Remove(log.Name())
+
+	cmd := exec.Command("go", "run", prg, "-user", "-max", "30000", "-trace", log.Name(), "-f", inst)
+	_, err = cmd.Output()
+
+	// the limit ends the run with status 2, go run then fails with status 1
+	exit, ok := err.(*exec.ExitError)
+	if !ok || exit.ExitCode() != 1 {
+		fmt.Printf("failed exec: %s ", inst)
+		return
+	}
+	trace, err := ioutil.ReadFile(log.Name())
+	if err != nil {
+		fmt.Printf("failed exec: %s ", inst)
+		return
+	}
+
+	// -max counts the instructions of both threads together
+	if strings.Contains(string(exit.Stderr), "HLT instruction limit reached") &&
+		strings.Count(string(trace), "\n") == 30000 &&
+		strings.Contains(string(trace), "core1001:") {
+		fmt.Printf("passed test: %s", inst)
+		fmt.Println()
+		return
+	}
+
+	fmt.Printf("failed test: %s", inst)
+	fmt.Println()
+}
@@ -0,0 +1,12 @@
+.option norvc
+# two threads spin until -max ends the run
+main:
+  li a0, 0x100
+  addi a1, sp, -1024
+  li a2, 0
+  li a3, 0
+  li a4, 0
+  li a7, 220
+  ecall
+1:
+  j 1b
@@ -0,0 +1,35 @@
+.option norvc
+main:
+  la t0, mhandler
+  csrw mtvec, t0
+  li s0, 0x2000000
+  # enable the software and timer interrupt
+  li t0, 0x88
+  csrs mie, t0
+  csrsi mstatus, 0x8
+  # raise the software interrupt
+  li t0, 1
+  sw t0, 0(s0)
+  # the timer fires 100 ticks from now
+  li t1, 0xbff8
+  add t1, s0, t1
+  ld t2, 0(t1)
+  addi t2, t2, 100
+  li t1, 0x4000
+  add t1, s0, t1
+  sd t2, 0(t1)
+1:
+  wfi
+  j 1b
+mhandler:
+  # collect the causes in s1
+  csrr s2, mcause
+  andi t3, s2, 0xf
+  slli s1, s1, 4
+  or s1, s1, t3
+  li t4, 7
+  beq t3, t4, done
+  # clear the software interrupt
+  sw zero, 0(s0)
+  mret
+done:
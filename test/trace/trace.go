@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+func main() {
+
+	prg := "hart.go"
+	inst := "test/trace/trace.bin"
+	log, err := ioutil.TempFile("", "trace")
+	if err != nil {
+		fmt.Printf("failed exec: %s ", inst)
+		return
+	}
+	log.Close()
+	defer os.Remove(log.Name())
+
+	cmd := exec.Command("go", "run", prg, "-f", inst, "-trace", log.Name(), "-trace-pc", "0x0-0x20")
+	if err := cmd.Run(); err != nil {
+		fmt.Printf("failed exec: %s ", inst)
+		return
+	}
+	trace, err := ioutil.ReadFile(log.Name())
+	if err != nil {
+		fmt.Printf("failed exec: %s ", inst)
+		return
+	}
+
+	for _, line := range []string{
+		"core   0: 3 0x0000000000000000 (0x4515) x10 0x0000000000000005\tli      a0, 5\n",
+		"core   0: 3 0x0000000000000002 (0x0001)\tnop\n",
+		"core   0: 3 0x0000000000000004 (0x340515f3) x11 0x0000000000000000 c832_mscratch 0x0000000000000005\tcsrrw   a1, mscratch, a0\n",
+		"core   0: 3 0x0000000000000010 (0x00a2b62f) x12 0x0000000000000007 mem 0x0000000000000030 mem 0x0000000000000030 0x000000000000000c\tamoadd.d a2, a0, (t0)\n",
+		"core   0: 3 0x0000000000000014 (0xd2257553) f10 0x4014000000000000 c768_mstatus 0x8000000a00006000\tfcvt.d.l fa0, a0\n",
+		"core   0: 3 0x0000000000000018 (0x1a0575d3) c1_fflags 0x0000000000000008 f11 0x7ff0000000000000\tfdiv.d  fa1, fa0, ft0\n",
+		"core   0: 3 0x000000000000001c (0x00a280a3) mem 0x0000000000000031 0x05\tsb      a0, 1(t0)\n",
+	} {
+		if !strings.Contains(string(trace), line) {
+			fmt.Printf("failed test: %s", inst)
+			fmt.Println()
+			return
+		}
+	}
+	//the instructions after the range are not traced
+	if strings.Contains(string(trace), "0x0000000000000020") {
+		fmt.Printf("failed test: %s", inst)
+		fmt.Println()
+		return
+	}
+
+	fmt.Printf("passed test: %s", inst)
+	fmt.Println()
+}
@@ -0,0 +1,17 @@
+# one instruction of each kind of trace line
+main:
+  c.li a0, 5
+  c.nop
+.option norvc
+  csrrw a1, mscratch, a0
+  la t0, data
+  amoadd.d a2, a0, (t0)
+  fcvt.d.l fa0, a0
+  fdiv.d fa1, fa0, ft0
+  sb a0, 1(t0)
+  li a7, 93
+  li a0, 0
+  ecall
+.balign 8
+data:
+  .dword 7
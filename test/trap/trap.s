@@ -0,0 +1,29 @@
+.option norvc
+main:
+  la t0, handler
+  csrw mtvec, t0
+  j start
+handler:
+  # collect the causes in s1, one hex digit each, and skip the instruction
+  csrr t3, mcause
+  slli s1, s1, 4
+  or s1, s1, t3
+  csrr t4, mtval
+  csrr t5, mepc
+  addi t5, t5, 4
+  csrw mepc, t5
+  mret
+start:
+  unimp
+  ecall
+  lw t1, 1(sp)
+  li t2, -8
+  ld t1, 0(t2)
+  sd t1, 3(sp)
+  sd t1, 0(t2)
+  ebreak
+  # a trap drops the lr reservation, the sc fails
+  addi s2, sp, -16
+  lr.d t1, (s2)
+  ecall
+  sc.d s3, t1, (s2)
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// const debug bool = true
+
+func main() {
+
+	prg := "hart.go"
+	inst := "test/uart/uart.bin"
+	// cmd := exec.Command("pwd")
+	cmd := exec.Command("go", "run", prg, "-membase", "0x80000000", "-uart", "0x10000000", "-plic", "0xc000000", "-f", inst)
+	stdout, err := cmd.Output()
+
+	if err != nil {
+		fmt.Printf("failed exec: %s ", inst)
+		return
+	}
+
+	if strings.HasPrefix(string(stdout), "Hello\n") &&
+		strings.Contains(string(stdout), "0x09 ( s1 ) = 0xa	") &&
+		strings.Contains(string(stdout), "0x12 ( s2 ) = 0x2	") &&
+		strings.Contains(string(stdout), "0x13 ( s3 ) = 0x61	") &&
+		strings.Contains(string(stdout), "0x14 ( s4 ) = 0x5a	") {
+		fmt.Printf("passed test: %s", inst)
+		fmt.Println()
+		return
+	}
+
+	fmt.Printf("failed test: %s", inst)
+	fmt.Println()
+}
@@ -0,0 +1,50 @@
+.option norvc
+main:
+  la t0, mhandler
+  csrw mtvec, t0
+  li s0, 0x10000000
+  # print a greeting
+  la t1, greeting
+1:
+  lbu t2, 0(t1)
+  beqz t2, 2f
+  sb t2, 0(s0)
+  addi t1, t1, 1
+  j 1b
+2:
+  # in loopback mode a transmitted byte is received
+  li t0, 0x10
+  sb t0, 4(s0)
+  li t0, 0x5a
+  sb t0, 0(s0)
+  lbu s3, 5(s0)
+  lbu s4, 0(s0)
+  sb zero, 4(s0)
+  # route source 10 to machine mode of hart 0
+  li s5, 0xc000000
+  li t0, 1
+  sw t0, 40(s5)
+  li t1, 0x2000
+  add t1, s5, t1
+  li t0, 0x400
+  sw t0, 0(t1)
+  li t0, 0x800
+  csrs mie, t0
+  csrsi mstatus, 0x8
+  # the empty transmitter interrupts
+  li t0, 0x2
+  sb t0, 1(s0)
+3:
+  wfi
+  j 3b
+mhandler:
+  li t1, 0x200004
+  add t1, s5, t1
+  lw s1, 0(t1)
+  lbu s2, 2(s0)
+  sb zero, 1(s0)
+  sw s1, 0(t1)
+  j done
+greeting:
+  .ascii "Hello\n\0\0"
+done:
@@ -0,0 +1,127 @@
+.option norvc
+# every check exits with its own code on failure
+main:
+  # argc and the first argument
+  ld t0, 0(sp)
+  li t1, 3
+  li a0, 10
+  bne t0, t1, fail
+  ld t0, 16(sp)
+  lbu t0, 0(t0)
+  li t1, 120
+  li a0, 11
+  bne t0, t1, fail
+  # map two anonymous pages
+  li a0, 0
+  li a1, 0x2000
+  li a2, 3
+  li a3, 0x22
+  li a4, -1
+  li a5, 0
+  li a7, 222
+  ecall
+  mv s2, a0
+  slli t0, s2, 52
+  li a0, 12
+  bnez t0, fail
+  # uname, the system name comes first
+  mv a0, s2
+  li a7, 160
+  ecall
+  mv t2, a0
+  li a0, 13
+  bnez t2, fail
+  ld t0, 0(s2)
+  li t1, 0x78756e694c
+  li a0, 14
+  bne t0, t1, fail
+  # random bytes
+  mv a0, s2
+  li a1, 16
+  li a2, 0
+  li a7, 278
+  ecall
+  mv t2, a0
+  li t1, 16
+  li a0, 15
+  bne t2, t1, fail
+  # the monotonic clock
+  li a0, 1
+  mv a1, s2
+  li a7, 113
+  ecall
+  mv t2, a0
+  li a0, 16
+  bnez t2, fail
+  # a thread with its stack at the end of the mapping, it sets the flag
+  # at the start of the mapping and wakes the main thread
+  sd zero, 0(s2)
+  li a0, 0x100100
+  li t0, 0x2000
+  add a1, s2, t0
+  addi a2, s2, 8
+  li a3, 0
+  li a4, 0
+  li a7, 220
+  ecall
+  beqz a0, child
+  mv s3, a0
+  lw t0, 8(s2)
+  li a0, 17
+  bne t0, s3, fail
+  li t1, 1001
+  li a0, 18
+  bne s3, t1, fail
+wait:
+  lw t0, 0(s2)
+  bnez t0, woken
+  mv a0, s2
+  li a1, 0x80
+  li a2, 0
+  li a3, 0
+  li a7, 98
+  ecall
+  j wait
+woken:
+  li t1, 42
+  li a0, 19
+  bne t0, t1, fail
+  # unmap the pages again
+  mv a0, s2
+  li a1, 0x2000
+  li a7, 215
+  ecall
+  mv t2, a0
+  li a0, 20
+  bnez t2, fail
+  li a0, 1
+  la a1, message
+  li a2, 8
+  li a7, 64
+  ecall
+  li a0, 5
+  li a7, 94
+  ecall
+child:
+  # the flag is 42 if the thread sees its own id
+  li a7, 178
+  ecall
+  li t1, 1001
+  li t0, 42
+  beq a0, t1, 1f
+  li t0, 1
+1:
+  sw t0, 0(s2)
+  mv a0, s2
+  li a1, 0x81
+  li a2, 1
+  li a7, 98
+  ecall
+  li a0, 0
+  li a7, 93
+  ecall
+fail:
+  li a7, 94
+  ecall
+message:
+  .ascii "user ok\n"
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// const debug bool = true
+
+func main() {
+
+	prg := "hart.go"
+	inst := "test/virt/virt.bin"
+	// cmd := exec.Command("pwd")
+	cmd := exec.Command("go", "run", prg, "-machine", "virt", "-max", "1000", "-f", inst)
+	stdout, err := cmd.Output()
+
+	// the instruction limit ends the run with status 2, go run then fails with status 1
+	if exit, ok := err.(*exec.ExitError); !ok || exit.ExitCode() != 1 {
+		fmt.Printf("failed exec: %s ", inst)
+		return
+	}
+
+	if strings.HasPrefix(string(stdout), "virt\n") &&
+		strings.Contains(string(stdout), "0x09 ( s1 ) = 0x0	") &&
+		strings.Contains(string(stdout), "0x12 ( s2 ) = 0x87e00000	0x13 ( s3 ) = 0xedfe0dd0	") {
+		fmt.Printf("passed test: %s", inst)
+		fmt.Println()
+		return
+	}
+
+	fmt.Printf("failed test: %s", inst)
+	fmt.Println()
+}
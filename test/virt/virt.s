@@ -0,0 +1,22 @@
+.option norvc
+main:
+  # the hart id and the device tree
+  mv s1, a0
+  mv s2, a1
+  lwu s3, 0(a1)
+  fence
+  fence.i
+  li s0, 0x10000000
+  la t1, greeting
+1:
+  lbu t2, 0(t1)
+  beqz t2, 2f
+  sb t2, 0(s0)
+  addi t1, t1, 1
+  j 1b
+2:
+  # the guest handles its own traps, spin until -max ends the run
+  wfi
+  j 2b
+greeting:
+  .ascii "virt\n\0\0\0"
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// const debug bool = true
+
+func main() {
+
+	prg := "hart.go"
+	inst := "test/virtio/virtio.bin"
+	// a disk of 4 sectors, sector 1 starts with a marker
+	dir, err := ioutil.TempDir("", "rvsim")
+	if err != nil {
+		fmt.Printf("failed exec: %s ", inst)
+		return
+	}
+	defer os.RemoveAll(dir)
+	disk := make([]byte, 4*512)
+	copy(disk[512:], "rvsimdsk")
+	img := filepath.Join(dir, "virtio.img")
+	if ioutil.WriteFile(img, disk, 0644) != nil {
+		fmt.Printf("failed exec: %s ", inst)
+		return
+	}
+	// cmd := exec.Command("pwd")
+	cmd := exec.Command("go", "run", prg, "-membase", "0x80000000", "-drive", img+",overlay", "-f", inst)
+	stdout, err := cmd.Output()
+
+	if err != nil {
+		fmt.Printf("failed exec: %s ", inst)
+		return
+	}
+
+	// the overlay keeps the image unchanged
+	after, err := ioutil.ReadFile(img)
+	if err == nil && bytes.Equal(after, disk) &&
+		strings.Contains(string(stdout), "0x09 ( s1 ) = 0x6b73646d69737672	") &&
+		strings.Contains(string(stdout), "0x12 ( s2 ) = 0x0	0x13 ( s3 ) = 0x201	") &&
+		strings.Contains(string(stdout), "0x14 ( s4 ) = 0x1122334455667788	0x15 ( s5 ) = 0x692e6f6974726976	") &&
+		strings.Contains(string(stdout), "0x17 ( s7 ) = 0x0	") &&
+		strings.Contains(string(stdout), "0x19 ( s9 ) = 0x1	0x1a ( s10) = 0x1	0x1b ( s11) = 0x1	") {
+		fmt.Printf("passed test: %s", inst)
+		fmt.Println()
+		return
+	}
+
+	fmt.Printf("failed test: %s", inst)
+	fmt.Println()
+}
@@ -0,0 +1,148 @@
+.option norvc
+main:
+  li s0, 0x10001000
+  # the queue memory
+  li s6, 0x80100000
+  addi s8, s6, 0x7f0
+  addi s8, s8, 0x10
+  lw t0, 0(s0)
+  li t1, 0x74726976
+  bne t0, t1, fail
+  # acknowledge, driver
+  li t0, 3
+  sw t0, 0x70(s0)
+  # accept VERSION_1 only
+  li t0, 1
+  sw t0, 0x24(s0)
+  sw t0, 0x20(s0)
+  sw zero, 0x24(s0)
+  sw zero, 0x20(s0)
+  li t0, 11
+  sw t0, 0x70(s0)
+  lw t0, 0x70(s0)
+  andi t0, t0, 8
+  beqz t0, fail
+  # queue 0 with 8 entries
+  sw zero, 0x30(s0)
+  li t0, 8
+  sw t0, 0x38(s0)
+  sw s6, 0x80(s0)
+  sw zero, 0x84(s0)
+  addi t0, s6, 0x100
+  sw t0, 0x90(s0)
+  sw zero, 0x94(s0)
+  addi t0, s6, 0x200
+  sw t0, 0xa0(s0)
+  sw zero, 0xa4(s0)
+  li t0, 1
+  sw t0, 0x44(s0)
+  # driver ok
+  li t0, 15
+  sw t0, 0x70(s0)
+  # read sector 1
+  li a0, 0
+  li a1, 1
+  addi a2, s6, 0x400
+  li a3, 512
+  li a4, 2
+  jal request
+  mv s2, a0
+  mv s3, a1
+  ld s1, 0x400(s6)
+  # write sector 2
+  li t0, 0x1122334455667788
+  sd t0, 0x600(s6)
+  li a0, 1
+  li a1, 2
+  addi a2, s6, 0x600
+  li a3, 512
+  li a4, 0
+  jal request
+  mv s7, a0
+  # read it back
+  li a0, 0
+  li a1, 2
+  mv a2, s8
+  li a3, 512
+  li a4, 2
+  jal request
+  ld s4, 0(s8)
+  # the serial number
+  li a0, 8
+  li a1, 0
+  mv a2, s8
+  li a3, 20
+  li a4, 2
+  jal request
+  ld s5, 0(s8)
+  # a read of almost 4 GiB fails before any data is moved
+  li a0, 0
+  li a1, 0
+  mv a2, s8
+  li a3, 0xfffffff0
+  li a4, 2
+  jal request
+  mv s10, a0
+  # sector 2^55 + 1 would wrap to byte offset 512
+  li a0, 0
+  li a1, 0x80000000000001
+  mv a2, s8
+  li a3, 512
+  li a4, 2
+  jal request
+  mv s11, a0
+  lw s9, 0x60(s0)
+  j done
+# request sends a request of type a0 for sector a1 with a3 bytes of data at
+# a2, a4 is 2 if the device writes the data. It returns the status in a0 and
+# the number of bytes written by the device in a1.
+request:
+  sw a0, 0x300(s6)
+  sw zero, 0x304(s6)
+  sd a1, 0x308(s6)
+  li t0, 0xff
+  sb t0, 0x310(s6)
+  # descriptor 0 is the header
+  addi t0, s6, 0x300
+  sd t0, 0(s6)
+  li t0, 16
+  sw t0, 8(s6)
+  li t0, 1
+  sh t0, 12(s6)
+  sh t0, 14(s6)
+  # descriptor 1 the data
+  sd a2, 16(s6)
+  sw a3, 24(s6)
+  ori t0, a4, 1
+  sh t0, 28(s6)
+  li t0, 2
+  sh t0, 30(s6)
+  # descriptor 2 the status
+  addi t0, s6, 0x310
+  sd t0, 32(s6)
+  li t0, 1
+  sw t0, 40(s6)
+  li t0, 2
+  sh t0, 44(s6)
+  sh zero, 46(s6)
+  # make the chain available and notify
+  lhu t1, 0x102(s6)
+  andi t2, t1, 7
+  slli t2, t2, 1
+  add t2, t2, s6
+  sh zero, 0x104(t2)
+  addi t1, t1, 1
+  sh t1, 0x102(s6)
+  sw zero, 0x50(s0)
+  # the used entry
+  lhu t1, 0x202(s6)
+  addi t1, t1, -1
+  andi t1, t1, 7
+  slli t1, t1, 3
+  add t1, t1, s6
+  lw a1, 0x208(t1)
+  lbu a0, 0x310(s6)
+  ret
+fail:
+  li s1, -1
+done:
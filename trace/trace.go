@@ -0,0 +1,161 @@
+package trace
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"rvsim/cpu"
+	"rvsim/disasm"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const debug bool = false
+
+//Range is the address range [Start, End)
+type Range struct {
+	Start uint64
+	End   uint64
+}
+
+//ParseRanges reads comma separated ranges like 0x80000000-0x80001000, the
+//end address is excluded
+func ParseRanges(s string) ([]Range, error) {
+	var ranges []Range
+	for _, field := range strings.Split(s, ",") {
+		bounds := strings.Split(field, "-")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("Could not parse range %q, need <start>-<end>", field)
+		}
+		start, err := strconv.ParseUint(bounds[0], 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse range %q: %v", field, err)
+		}
+		end, err := strconv.ParseUint(bounds[1], 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse range %q: %v", field, err)
+		}
+		if end <= start {
+			return nil, fmt.Errorf("Could not parse range %q, the end is not above the start", field)
+		}
+		ranges = append(ranges, Range{Start: start, End: end})
+	}
+	return ranges, nil
+}
+
+//Tracer writes a line for every retired instruction of the harts attached
+//to it, in the format of spike --log-commits: the hart, the privilege level,
+//the pc, the instruction, the register writes and the memory accesses. The
+//disassembly follows the spike fields after a tab.
+type Tracer struct {
+	w *bufio.Writer
+	//ranges limits the trace to the instructions within, all are traced if empty
+	ranges []Range
+	//limit is the most bytes written, 0 for no limit
+	limit uint64
+	size  uint64
+	//full is set once a line did not fit within the limit
+	full bool
+	err  error
+	//writes holds the register writes of a line while they are sorted
+	writes []cpu.Write
+}
+
+//New returns a tracer which writes to w, limited to the pc ranges and to
+//limit bytes unless it is 0
+func New(w io.Writer, ranges []Range, limit uint64) *Tracer {
+	return &Tracer{w: bufio.NewWriter(w), ranges: ranges, limit: limit}
+}
+
+//Attach traces the instructions of hart and the harts cloned from it
+func (t *Tracer) Attach(hart *cpu.CPU) {
+	hart.SetCommitHook(t.commit)
+}
+
+//Full reports if lines were dropped at the size limit
+func (t *Tracer) Full() bool {
+	return t.full
+}
+
+//Flush writes the buffered lines, it returns the first write error
+func (t *Tracer) Flush() error {
+	if err := t.w.Flush(); t.err == nil {
+		t.err = err
+	}
+	return t.err
+}
+
+//traced reports if the instruction at pc belongs to the trace
+func (t *Tracer) traced(pc uint64) bool {
+	if len(t.ranges) == 0 {
+		return true
+	}
+	for _, r := range t.ranges {
+		if pc >= r.Start && pc < r.End {
+			return true
+		}
+	}
+	return false
+}
+
+//writeKey orders the register writes like spike, which keys them by the
+//register number or CSR address shifted left by 4 and or'ed with the type
+func writeKey(w cpu.Write) uint64 {
+	switch w.Kind {
+	case 'f':
+		return w.Num<<4 | 1
+	case 'c':
+		return w.Num<<4 | 4
+	default:
+		return w.Num << 4
+	}
+}
+
+//commit writes the line of a retired instruction
+func (t *Tracer) commit(hart *cpu.CPU, c *cpu.Commit) {
+	if t.full || t.err != nil || !t.traced(c.PC) {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "core%4d: %d 0x%016x", c.Hart, c.Priv, c.PC)
+	if disasm.Length(c.Inst) == 2 {
+		fmt.Fprintf(&b, " (0x%04x)", c.Inst)
+	} else {
+		fmt.Fprintf(&b, " (0x%08x)", c.Inst)
+	}
+	t.writes = append(t.writes[:0], c.Writes...)
+	sort.Slice(t.writes, func(i, j int) bool {
+		return writeKey(t.writes[i]) < writeKey(t.writes[j])
+	})
+	for _, w := range t.writes {
+		switch w.Kind {
+		case 'x':
+			fmt.Fprintf(&b, " x%-2d 0x%016x", w.Num, hart.GetReg(int(w.Num)))
+		case 'f':
+			fmt.Fprintf(&b, " f%-2d 0x%016x", w.Num, hart.GetFReg(int(w.Num)))
+		case 'c':
+			value, _ := hart.GetCSR(w.Num)
+			fmt.Fprintf(&b, " c%d_%s 0x%016x", w.Num, disasm.CSRName(w.Num), value)
+		}
+	}
+	//spike lists the loads before the stores
+	for _, a := range c.Accesses {
+		if !a.Store {
+			fmt.Fprintf(&b, " mem 0x%016x", a.Addr)
+		}
+	}
+	for _, a := range c.Accesses {
+		if a.Store {
+			fmt.Fprintf(&b, " mem 0x%016x 0x%0*x", a.Addr, int(a.Size/4), a.Value)
+		}
+	}
+	b.WriteString("\t" + disasm.Disassemble(c.Inst, c.PC) + "\n")
+
+	if t.limit != 0 && t.size+uint64(b.Len()) > t.limit {
+		t.full = true
+		return
+	}
+	t.size += uint64(b.Len())
+	_, t.err = t.w.WriteString(b.String())
+}
@@ -0,0 +1,13 @@
+// +build !linux
+
+package uart
+
+import (
+	"errors"
+	"os"
+)
+
+//OpenPTY is only supported on Linux
+func OpenPTY() (*os.File, string, error) {
+	return nil, "", errors.New("Could not open a pty, only supported on Linux")
+}
@@ -0,0 +1,275 @@
+package uart
+
+import (
+	"fmt"
+	"io"
+	"rvsim/bus"
+)
+
+const debug bool = false
+
+//Size of the UART address space
+const Size uint64 = 0x100
+
+//DefaultBase and DefaultIRQ are the address and PLIC source of the UART on the virt machine
+const (
+	DefaultBase uint64 = 0x10000000
+	DefaultIRQ         = 10
+)
+
+//Register offsets, the divisor latch replaces RBR/THR and IER while LCR.DLAB is set
+const (
+	regRBR uint64 = 0
+	regTHR uint64 = 0
+	regDLL uint64 = 0
+	regIER uint64 = 1
+	regDLM uint64 = 1
+	regIIR uint64 = 2
+	regFCR uint64 = 2
+	regLCR uint64 = 3
+	regMCR uint64 = 4
+	regLSR uint64 = 5
+	regMSR uint64 = 6
+	regSCR uint64 = 7
+)
+
+//Register bits
+const (
+	ierRDA  uint8 = 0x01
+	ierTHRE uint8 = 0x02
+	ierRLS  uint8 = 0x04
+
+	iirNone    uint8 = 0x01
+	iirTHRE    uint8 = 0x02
+	iirRDA     uint8 = 0x04
+	iirRLS     uint8 = 0x06
+	iirFIFO    uint8 = 0xc0
+	fcrEnable  uint8 = 0x01
+	fcrClearRx uint8 = 0x02
+	lcrDLAB    uint8 = 0x80
+	mcrLoop    uint8 = 0x10
+
+	lsrDR   uint8 = 0x01
+	lsrOE   uint8 = 0x02
+	lsrTHRE uint8 = 0x20
+	lsrTEMT uint8 = 0x40
+
+	//msrDefault reports carrier, data set ready and clear to send
+	msrDefault uint8 = 0xb0
+)
+
+//fifoSize is the depth of the receive FIFO
+const fifoSize = 16
+
+//pollPeriod is the number of ticks between checks for host input
+const pollPeriod = 1024
+
+//UART is a NS16550A compatible serial port. Transmitted bytes go to out
+//right away, bytes read from in are received through a 16 byte FIFO.
+type UART struct {
+	base uint64
+	irq  bus.IRQLine
+	out  io.Writer
+	//input is filled from in by a goroutine and drained into rx by Poll
+	input chan byte
+	rx    []uint8
+	ticks uint64
+
+	ier, lcr, mcr, scr, fcr uint8
+	dll, dlm                uint8
+	//overrun is set when input was dropped, it is cleared by reading LSR
+	overrun bool
+	//thre is the transmitter holding register empty interrupt, cleared by
+	//reading it from IIR or by writing THR
+	thre bool
+}
+
+//New returns a UART at base which writes to out and, if in is not nil, reads from in
+func New(base uint64, out io.Writer, in io.Reader, irq bus.IRQLine) *UART {
+	u := &UART{
+		base: base,
+		irq:  irq,
+		out:  out,
+	}
+	if in != nil {
+		u.input = make(chan byte, 4096)
+		go u.read(in)
+	}
+	return u
+}
+
+//read passes host input to the simulation
+func (u *UART) read(in io.Reader) {
+	buf := make([]byte, 256)
+	for {
+		n, err := in.Read(buf)
+		for _, b := range buf[:n] {
+			u.input <- b
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+//Poll moves host input into the receive FIFO, the hart calls it before every instruction
+func (u *UART) Poll() {
+	u.ticks++
+	if u.input == nil || u.ticks%pollPeriod != 0 || len(u.rx) >= fifoSize || u.mcr&mcrLoop != 0 {
+		return
+	}
+	for len(u.rx) < fifoSize {
+		select {
+		case b := <-u.input:
+			u.rx = append(u.rx, b)
+		default:
+			u.update()
+			return
+		}
+	}
+	u.update()
+}
+
+//receive puts a byte into the receive FIFO
+func (u *UART) receive(b uint8) {
+	if len(u.rx) >= fifoSize {
+		u.overrun = true
+		return
+	}
+	u.rx = append(u.rx, b)
+}
+
+//iir returns the highest priority interrupt
+func (u *UART) iir() uint8 {
+	switch {
+	case u.ier&ierRLS != 0 && u.overrun:
+		return iirRLS
+	case u.ier&ierRDA != 0 && len(u.rx) > 0:
+		return iirRDA
+	case u.ier&ierTHRE != 0 && u.thre:
+		return iirTHRE
+	}
+	return iirNone
+}
+
+//update drives the interrupt line
+func (u *UART) update() {
+	if u.iir() != iirNone {
+		u.irq.Raise()
+	} else {
+		u.irq.Lower()
+	}
+}
+
+//Load value
+func (u *UART) Load(addr uint64, size uint64) (uint64, error) {
+	if debug {
+		fmt.Println("UART Load addr, size", addr, size)
+	}
+	value := u.register(addr, true)
+	u.update()
+	return uint64(value), nil
+}
+
+//Peek reads like Load but leaves the FIFO and the interrupt state alone
+func (u *UART) Peek(addr uint64, size uint64) (uint64, error) {
+	return uint64(u.register(addr, false)), nil
+}
+
+//register returns the value of a register, consume tells if the read takes
+//a received byte and clears the THRE interrupt and the overrun
+func (u *UART) register(addr uint64, consume bool) uint8 {
+	var value uint8
+	switch addr - u.base {
+	case regRBR:
+		if u.lcr&lcrDLAB != 0 {
+			value = u.dll
+		} else if len(u.rx) > 0 {
+			value = u.rx[0]
+			if consume {
+				u.rx = u.rx[1:]
+			}
+		}
+	case regIER:
+		if u.lcr&lcrDLAB != 0 {
+			value = u.dlm
+		} else {
+			value = u.ier
+		}
+	case regIIR:
+		value = u.iir()
+		if value == iirTHRE && consume {
+			u.thre = false
+		}
+		if u.fcr&fcrEnable != 0 {
+			value |= iirFIFO
+		}
+	case regLCR:
+		value = u.lcr
+	case regMCR:
+		value = u.mcr
+	case regLSR:
+		//bytes are sent right away, the transmitter is always empty
+		value = lsrTHRE | lsrTEMT
+		if len(u.rx) > 0 {
+			value |= lsrDR
+		}
+		if u.overrun {
+			value |= lsrOE
+			if consume {
+				u.overrun = false
+			}
+		}
+	case regMSR:
+		if u.mcr&mcrLoop == 0 {
+			value = msrDefault
+		}
+	case regSCR:
+		value = u.scr
+	}
+	return value
+}
+
+//Store value
+func (u *UART) Store(addr uint64, size uint64, value uint64) error {
+	if debug {
+		fmt.Println("UART Store addr, size, value ", addr, size, value)
+	}
+	b := uint8(value)
+	switch addr - u.base {
+	case regTHR:
+		if u.lcr&lcrDLAB != 0 {
+			u.dll = b
+			break
+		}
+		if u.mcr&mcrLoop != 0 {
+			u.receive(b)
+		} else if _, err := u.out.Write([]byte{b}); err != nil {
+			return err
+		}
+		u.thre = true
+	case regIER:
+		if u.lcr&lcrDLAB != 0 {
+			u.dlm = b
+			break
+		}
+		//enabling the THRE interrupt reports the empty transmitter
+		if b&ierTHRE != 0 && u.ier&ierTHRE == 0 {
+			u.thre = true
+		}
+		u.ier = b & 0x0f
+	case regFCR:
+		u.fcr = b
+		if b&fcrClearRx != 0 {
+			u.rx = u.rx[:0]
+		}
+	case regLCR:
+		u.lcr = b
+	case regMCR:
+		u.mcr = b & 0x1f
+	case regSCR:
+		u.scr = b
+	}
+	u.update()
+	return nil
+}
@@ -0,0 +1,259 @@
+package virt
+
+import (
+	"fmt"
+	"io"
+	"rvsim/bus"
+	"rvsim/clint"
+	"rvsim/fdt"
+	"rvsim/plic"
+	"rvsim/ram"
+	"rvsim/uart"
+	"rvsim/virtio"
+)
+
+const debug bool = false
+
+//Memory layout of the virt machine, the same as QEMU's
+const (
+	//MemoryBase is the start of RAM, firmware is loaded here
+	MemoryBase uint64 = 0x80000000
+	//KernelBase is where the firmware expects the kernel
+	KernelBase uint64 = 0x80200000
+)
+
+//uartClock is the input clock of the UART in Hz
+const uartClock = 3686400
+
+//fdtAlign is the alignment of the device tree at the end of RAM
+const fdtAlign uint64 = 0x200000
+
+//phandles of the interrupt controllers in the device tree, the controller
+//of hart i has phandleCPUIntc+i
+const (
+	phandlePLIC    uint32 = 1
+	phandleCPUIntc uint32 = 2
+)
+
+//Interrupt numbers, the bits in mip
+const (
+	irqMSIP uint32 = 3
+	irqMTIP uint32 = 7
+	irqSEIP uint32 = 9
+	irqMEIP uint32 = 11
+)
+
+//Config describes the machine to build
+type Config struct {
+	//MemSize is the size of RAM in bytes
+	MemSize uint64
+	//WallClock lets mtime follow the host clock instead of the retired instructions
+	WallClock bool
+	//Out and In connect the UART, In may be nil
+	Out io.Writer
+	In  io.Reader
+	//Disk backs a virtio block device, nil for none
+	Disk *virtio.Disk
+	//Bootargs is the kernel command line
+	Bootargs string
+}
+
+//Machine is a virt machine: RAM, CLINT, PLIC, a UART and a virtio block
+//device on one bus
+type Machine struct {
+	Bus   *bus.Bus
+	RAM   *ram.RAM
+	CLINT *clint.CLINT
+	PLIC  *plic.PLIC
+	UART  *uart.UART
+	//Block is nil without a disk
+	Block *virtio.MMIO
+
+	bootargs string
+}
+
+//mapping places a device on the bus
+type mapping struct {
+	base uint64
+	size uint64
+	dev  bus.Device
+}
+
+//New assembles a machine
+func New(cfg Config) (*Machine, error) {
+	m := &Machine{Bus: bus.New(), bootargs: cfg.Bootargs}
+	var err error
+	m.RAM, err = ram.New(MemoryBase, cfg.MemSize)
+	if err != nil {
+		return nil, err
+	}
+	m.CLINT = clint.New(clint.DefaultBase, cfg.WallClock)
+	m.PLIC, err = plic.New(plic.DefaultBase, plic.DefaultSources)
+	if err != nil {
+		return nil, err
+	}
+	line, err := m.PLIC.Line(uart.DefaultIRQ)
+	if err != nil {
+		return nil, err
+	}
+	m.UART = uart.New(uart.DefaultBase, cfg.Out, cfg.In, line)
+
+	devices := []mapping{
+		{MemoryBase, cfg.MemSize, m.RAM},
+		{clint.DefaultBase, clint.Size, m.CLINT},
+		{plic.DefaultBase, plic.Size, m.PLIC},
+		{uart.DefaultBase, uart.Size, m.UART},
+	}
+	if cfg.Disk != nil {
+		line, err := m.PLIC.Line(virtio.DefaultIRQ)
+		if err != nil {
+			return nil, err
+		}
+		m.Block = virtio.NewBlock(virtio.DefaultBase, m.Bus, line, cfg.Disk)
+		devices = append(devices, mapping{virtio.DefaultBase, virtio.Size, m.Block})
+	}
+	for _, d := range devices {
+		if err := m.Bus.Map(d.base, d.size, d.dev); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+//Hart is a hart of the machine, it receives interrupts from the CLINT and PLIC
+type Hart interface {
+	SetPending(irq uint, level bool)
+}
+
+//AddHart connects the next hart to the interrupt controllers
+func (m *Machine) AddHart(h Hart) {
+	m.CLINT.AddHart(h)
+	m.PLIC.AddHart(h)
+}
+
+//Tick advances the devices, the hart calls it before every instruction
+func (m *Machine) Tick() {
+	m.CLINT.Tick()
+	m.UART.Poll()
+}
+
+//Mtime returns the time of the CLINT, it backs the time CSR
+func (m *Machine) Mtime() uint64 {
+	return m.CLINT.Mtime()
+}
+
+//LoadDeviceTree describes the machine with harts harts in a device tree
+//blob, stores it at the end of RAM and returns its address
+func (m *Machine) LoadDeviceTree(harts int) (uint64, error) {
+	blob, err := m.DeviceTree(harts)
+	if err != nil {
+		return 0, err
+	}
+	if uint64(len(blob)) > m.RAM.Size() {
+		return 0, fmt.Errorf("Could not place device tree of %d bytes in memory", len(blob))
+	}
+	addr := (MemoryBase + m.RAM.Size() - uint64(len(blob))) &^ (fdtAlign - 1)
+	if addr < MemoryBase {
+		addr = MemoryBase + m.RAM.Size() - uint64(len(blob))
+	}
+	if debug {
+		fmt.Printf("VIRT device tree at %#x size %#x", addr, len(blob))
+		fmt.Println()
+	}
+	for i, b := range blob {
+		if err := m.RAM.Store(addr+uint64(i), 8, uint64(b)); err != nil {
+			return 0, err
+		}
+	}
+	return addr, nil
+}
+
+//DeviceTree returns the device tree blob of the machine with harts harts
+func (m *Machine) DeviceTree(harts int) ([]byte, error) {
+	t := fdt.New()
+	t.BeginNode("")
+	t.PropertyCells("#address-cells", 2)
+	t.PropertyCells("#size-cells", 2)
+	t.PropertyStrings("compatible", "riscv-virtio")
+	t.PropertyStrings("model", "riscv-virtio,rvsim")
+
+	t.BeginNode("chosen")
+	t.PropertyStrings("bootargs", m.bootargs)
+	t.PropertyStrings("stdout-path", fmt.Sprintf("/soc/serial@%x", uart.DefaultBase))
+	t.EndNode()
+
+	t.BeginNode(fmt.Sprintf("memory@%x", MemoryBase))
+	t.PropertyStrings("device_type", "memory")
+	t.PropertyU64s("reg", MemoryBase, m.RAM.Size())
+	t.EndNode()
+
+	var clintIRQs, plicIRQs []uint32
+	t.BeginNode("cpus")
+	t.PropertyCells("#address-cells", 1)
+	t.PropertyCells("#size-cells", 0)
+	t.PropertyCells("timebase-frequency", uint32(clint.Frequency))
+	for i := 0; i < harts; i++ {
+		intc := phandleCPUIntc + uint32(i)
+		t.BeginNode(fmt.Sprintf("cpu@%x", i))
+		t.PropertyStrings("device_type", "cpu")
+		t.PropertyCells("reg", uint32(i))
+		t.PropertyStrings("status", "okay")
+		t.PropertyStrings("compatible", "riscv")
+		t.PropertyStrings("riscv,isa", "rv64imafdc_zicsr_zifencei")
+		t.PropertyStrings("mmu-type", "riscv,sv48")
+		t.BeginNode("interrupt-controller")
+		t.PropertyCells("#interrupt-cells", 1)
+		t.PropertyEmpty("interrupt-controller")
+		t.PropertyStrings("compatible", "riscv,cpu-intc")
+		t.PropertyCells("phandle", intc)
+		t.EndNode()
+		t.EndNode()
+		clintIRQs = append(clintIRQs, intc, irqMSIP, intc, irqMTIP)
+		plicIRQs = append(plicIRQs, intc, irqMEIP, intc, irqSEIP)
+	}
+	t.EndNode()
+
+	t.BeginNode("soc")
+	t.PropertyCells("#address-cells", 2)
+	t.PropertyCells("#size-cells", 2)
+	t.PropertyStrings("compatible", "simple-bus")
+	t.PropertyEmpty("ranges")
+
+	t.BeginNode(fmt.Sprintf("clint@%x", clint.DefaultBase))
+	t.PropertyStrings("compatible", "sifive,clint0", "riscv,clint0")
+	t.PropertyU64s("reg", clint.DefaultBase, clint.Size)
+	t.PropertyCells("interrupts-extended", clintIRQs...)
+	t.EndNode()
+
+	t.BeginNode(fmt.Sprintf("plic@%x", plic.DefaultBase))
+	t.PropertyStrings("compatible", "sifive,plic-1.0.0", "riscv,plic0")
+	t.PropertyU64s("reg", plic.DefaultBase, plic.Size)
+	t.PropertyCells("#address-cells", 0)
+	t.PropertyCells("#interrupt-cells", 1)
+	t.PropertyEmpty("interrupt-controller")
+	t.PropertyCells("riscv,ndev", plic.DefaultSources-1)
+	t.PropertyCells("interrupts-extended", plicIRQs...)
+	t.PropertyCells("phandle", phandlePLIC)
+	t.EndNode()
+
+	t.BeginNode(fmt.Sprintf("serial@%x", uart.DefaultBase))
+	t.PropertyStrings("compatible", "ns16550a")
+	t.PropertyU64s("reg", uart.DefaultBase, uart.Size)
+	t.PropertyCells("clock-frequency", uartClock)
+	t.PropertyCells("interrupt-parent", phandlePLIC)
+	t.PropertyCells("interrupts", uart.DefaultIRQ)
+	t.EndNode()
+
+	if m.Block != nil {
+		t.BeginNode(fmt.Sprintf("virtio_mmio@%x", virtio.DefaultBase))
+		t.PropertyStrings("compatible", "virtio,mmio")
+		t.PropertyU64s("reg", virtio.DefaultBase, virtio.Size)
+		t.PropertyCells("interrupt-parent", phandlePLIC)
+		t.PropertyCells("interrupts", virtio.DefaultIRQ)
+		t.EndNode()
+	}
+	t.EndNode()
+
+	t.EndNode()
+	return t.Blob()
+}
@@ -0,0 +1,151 @@
+package virtio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path/filepath"
+	"rvsim/bus"
+)
+
+//deviceBlock is the virtio device type of block devices
+const deviceBlock uint32 = 2
+
+//Block device feature bits
+const (
+	featureBlockRO    uint64 = 1 << 5
+	featureBlockFlush uint64 = 1 << 9
+)
+
+//Request types
+const (
+	blockIn    uint32 = 0
+	blockOut   uint32 = 1
+	blockFlush uint32 = 4
+	blockGetID uint32 = 8
+)
+
+//Request status values
+const (
+	blockOK     uint8 = 0
+	blockIOErr  uint8 = 1
+	blockUnsupp uint8 = 2
+)
+
+//blockIDSize is the length of the serial number returned for GET_ID
+const blockIDSize = 20
+
+//blockChunk is the most bytes moved between guest and disk at once
+const blockChunk = 64 * 1024
+
+//block is a virtio block device with a single request queue
+type block struct {
+	disk *Disk
+}
+
+//NewBlock returns a virtio-mmio block device at base for disk. The device
+//accesses its virtqueues through mem and interrupts through irq.
+func NewBlock(base uint64, mem bus.Device, irq bus.IRQLine, disk *Disk) *MMIO {
+	return newMMIO(base, mem, irq, &block{disk: disk})
+}
+
+func (b *block) deviceID() uint32 {
+	return deviceBlock
+}
+
+func (b *block) features() uint64 {
+	if b.disk.ReadOnly() {
+		return featureBlockFlush | featureBlockRO
+	}
+	return featureBlockFlush
+}
+
+//config holds the capacity in sectors
+func (b *block) config() []byte {
+	config := make([]byte, 8)
+	binary.LittleEndian.PutUint64(config, b.disk.Size()/SectorSize)
+	return config
+}
+
+func (b *block) queues() int {
+	return 1
+}
+
+//process handles a request: a header of type, reserved and sector, the data
+//and a status byte written by the device
+func (b *block) process(q int, c *chain) {
+	var header [16]byte
+	if _, err := io.ReadFull(c, header[:]); err != nil || c.size(true) == 0 {
+		//no room for a status, the request is dropped
+		return
+	}
+	kind := binary.LittleEndian.Uint32(header[0:])
+	sector := binary.LittleEndian.Uint64(header[8:])
+	//the last writable byte is the status
+	length := c.size(true) - 1
+	status := blockOK
+	var err error
+	switch kind {
+	case blockIn:
+		err = b.transfer(c, sector, length, false)
+	case blockOut:
+		err = b.transfer(c, sector, c.size(false)-uint64(len(header)), true)
+	case blockFlush:
+		err = b.disk.Flush()
+	case blockGetID:
+		id := make([]byte, blockIDSize)
+		copy(id, filepath.Base(b.disk.Name()))
+		if length < blockIDSize {
+			id = id[:length]
+		}
+		_, err = c.Write(id)
+	default:
+		status = blockUnsupp
+	}
+	if err != nil {
+		if debug {
+			fmt.Println("VIRTIO block request failed: ", err)
+		}
+		status = blockIOErr
+	}
+	//the status follows the data
+	c.wpos = length
+	c.Write([]byte{status})
+}
+
+//transfer moves length bytes between the chain and the disk starting at
+//sector, in chunks of at most blockChunk bytes. Requests beyond the end of
+//the disk are rejected before any data is moved.
+func (b *block) transfer(c *chain, sector uint64, length uint64, write bool) error {
+	sectors := b.disk.Size() / SectorSize
+	if sector > sectors || length > (sectors-sector)*SectorSize {
+		return fmt.Errorf("Could not access %d bytes at sector %d, beyond the end of the disk", length, sector)
+	}
+	off := sector * SectorSize
+	size := length
+	if size > blockChunk {
+		size = blockChunk
+	}
+	data := make([]byte, size)
+	for length > 0 {
+		n := length
+		if n > blockChunk {
+			n = blockChunk
+		}
+		var err error
+		if write {
+			if _, err = io.ReadFull(c, data[:n]); err == nil {
+				err = b.disk.WriteAt(data[:n], off)
+			}
+		} else {
+			if err = b.disk.ReadAt(data[:n], off); err == nil {
+				_, err = c.Write(data[:n])
+			}
+		}
+		if err != nil {
+			return err
+		}
+		off, length = off+n, length-n
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package virtio
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+//SectorSize is the unit of block device sizes and requests
+const SectorSize = 512
+
+//DiskMode selects how a disk image is opened
+type DiskMode int
+
+const (
+	//ReadWrite writes guest changes to the image
+	ReadWrite DiskMode = iota
+	//ReadOnly rejects writes, the guest sees a read only device
+	ReadOnly
+	//Overlay keeps guest changes in host memory, the image is not modified
+	Overlay
+)
+
+//Disk is a host disk image. The size is rounded down to whole sectors.
+type Disk struct {
+	file *os.File
+	mode DiskMode
+	size uint64
+	//overlay holds the sectors written in Overlay mode
+	overlay map[uint64]*[SectorSize]byte
+}
+
+//OpenDisk opens the image at path
+func OpenDisk(path string, mode DiskMode) (*Disk, error) {
+	flag := os.O_RDWR
+	if mode != ReadWrite {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	d := &Disk{
+		file: file,
+		mode: mode,
+		size: uint64(info.Size()) / SectorSize * SectorSize,
+	}
+	if mode == Overlay {
+		d.overlay = make(map[uint64]*[SectorSize]byte)
+	}
+	return d, nil
+}
+
+//Size returns the size of the disk in bytes
+func (d *Disk) Size() uint64 {
+	return d.size
+}
+
+//ReadOnly reports if the guest may not write the disk
+func (d *Disk) ReadOnly() bool {
+	return d.mode == ReadOnly
+}
+
+//Name returns the path of the image
+func (d *Disk) Name() string {
+	return d.file.Name()
+}
+
+//check rejects accesses beyond the end of the disk
+func (d *Disk) check(length int, off uint64) error {
+	if off > d.size || uint64(length) > d.size-off {
+		return fmt.Errorf("Could not access %d bytes at %#x, beyond the end of the disk", length, off)
+	}
+	return nil
+}
+
+//ReadAt reads len(p) bytes at offset off
+func (d *Disk) ReadAt(p []byte, off uint64) error {
+	if err := d.check(len(p), off); err != nil {
+		return err
+	}
+	if d.overlay == nil {
+		_, err := d.file.ReadAt(p, int64(off))
+		return err
+	}
+	for len(p) > 0 {
+		sector, index := off/SectorSize, off%SectorSize
+		n := SectorSize - int(index)
+		if n > len(p) {
+			n = len(p)
+		}
+		if data, ok := d.overlay[sector]; ok {
+			copy(p[:n], data[index:])
+		} else if _, err := d.file.ReadAt(p[:n], int64(off)); err != nil {
+			return err
+		}
+		p, off = p[n:], off+uint64(n)
+	}
+	return nil
+}
+
+//WriteAt writes p at offset off
+func (d *Disk) WriteAt(p []byte, off uint64) error {
+	if d.mode == ReadOnly {
+		return errors.New("Could not write to read only disk")
+	}
+	if err := d.check(len(p), off); err != nil {
+		return err
+	}
+	if d.overlay == nil {
+		_, err := d.file.WriteAt(p, int64(off))
+		return err
+	}
+	for len(p) > 0 {
+		sector, index := off/SectorSize, off%SectorSize
+		n := SectorSize - int(index)
+		if n > len(p) {
+			n = len(p)
+		}
+		data, ok := d.overlay[sector]
+		if !ok {
+			//copy the sector on its first write
+			data = new([SectorSize]byte)
+			if _, err := d.file.ReadAt(data[:], int64(sector*SectorSize)); err != nil {
+				return err
+			}
+			d.overlay[sector] = data
+		}
+		copy(data[index:], p[:n])
+		p, off = p[n:], off+uint64(n)
+	}
+	return nil
+}
+
+//Flush makes written data durable
+func (d *Disk) Flush() error {
+	if d.mode != ReadWrite {
+		return nil
+	}
+	return d.file.Sync()
+}
+
+//Close closes the image, changes in the overlay are dropped
+func (d *Disk) Close() error {
+	return d.file.Close()
+}
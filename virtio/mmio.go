@@ -0,0 +1,331 @@
+package virtio
+
+import (
+	"errors"
+	"fmt"
+	"rvsim/bus"
+)
+
+const debug bool = false
+
+//Size of the address space of one virtio-mmio device
+const Size uint64 = 0x1000
+
+//DefaultBase and DefaultIRQ are the address and PLIC source of the first
+//virtio-mmio device on the virt machine, further devices follow every Size bytes
+//and on the next sources
+const (
+	DefaultBase uint64 = 0x10001000
+	DefaultIRQ         = 1
+)
+
+//Register offsets of the virtio-mmio version 2 transport
+const (
+	regMagic             uint64 = 0x000
+	regVersion           uint64 = 0x004
+	regDeviceID          uint64 = 0x008
+	regVendorID          uint64 = 0x00c
+	regDeviceFeatures    uint64 = 0x010
+	regDeviceFeaturesSel uint64 = 0x014
+	regDriverFeatures    uint64 = 0x020
+	regDriverFeaturesSel uint64 = 0x024
+	regQueueSel          uint64 = 0x030
+	regQueueNumMax       uint64 = 0x034
+	regQueueNum          uint64 = 0x038
+	regQueueReady        uint64 = 0x044
+	regQueueNotify       uint64 = 0x050
+	regInterruptStatus   uint64 = 0x060
+	regInterruptACK      uint64 = 0x064
+	regStatus            uint64 = 0x070
+	regQueueDescLow      uint64 = 0x080
+	regQueueDescHigh     uint64 = 0x084
+	regQueueDriverLow    uint64 = 0x090
+	regQueueDriverHigh   uint64 = 0x094
+	regQueueDeviceLow    uint64 = 0x0a0
+	regQueueDeviceHigh   uint64 = 0x0a4
+	regConfigGeneration  uint64 = 0x0fc
+	regConfig            uint64 = 0x100
+)
+
+const (
+	magic   uint32 = 0x74726976
+	version uint32 = 2
+	//vendor is the ID QEMU reports
+	vendor uint32 = 0x554d4551
+)
+
+//featureVersion1 marks a device which follows virtio 1.0 and later
+const featureVersion1 uint64 = 1 << 32
+
+//Device status bits
+const (
+	statusFeaturesOK uint32 = 8
+	statusNeedsReset uint32 = 64
+)
+
+//Interrupt status bits
+const (
+	interruptUsed   uint32 = 1
+	interruptConfig uint32 = 2
+)
+
+//queueNumMax is the largest queue size drivers may set
+const queueNumMax = 256
+
+//backend is the device type behind the transport
+type backend interface {
+	//deviceID returns the virtio device type
+	deviceID() uint32
+	//features returns the device feature bits besides featureVersion1
+	features() uint64
+	//config returns the device configuration space
+	config() []byte
+	//queues returns the number of virtqueues
+	queues() int
+	//process handles a descriptor chain of queue q
+	process(q int, c *chain)
+}
+
+//MMIO is a virtio-mmio version 2 device. Requests are handled right away
+//when the driver notifies a queue.
+type MMIO struct {
+	base uint64
+	//mem is the guest memory holding the virtqueues
+	mem bus.Device
+	irq bus.IRQLine
+	dev backend
+
+	deviceFeaturesSel uint32
+	driverFeaturesSel uint32
+	driverFeatures    uint64
+	queueSel          uint32
+	queues            []queue
+	interruptStatus   uint32
+	status            uint32
+}
+
+func newMMIO(base uint64, mem bus.Device, irq bus.IRQLine, dev backend) *MMIO {
+	return &MMIO{
+		base:   base,
+		mem:    mem,
+		irq:    irq,
+		dev:    dev,
+		queues: make([]queue, dev.queues()),
+	}
+}
+
+//reset returns the transport to its state after power on
+func (m *MMIO) reset() {
+	m.deviceFeaturesSel = 0
+	m.driverFeaturesSel = 0
+	m.driverFeatures = 0
+	m.queueSel = 0
+	for i := range m.queues {
+		m.queues[i] = queue{}
+	}
+	m.interruptStatus = 0
+	m.status = 0
+	m.irq.Lower()
+}
+
+//queue returns the selected queue, nil if it does not exist
+func (m *MMIO) queue() *queue {
+	if m.queueSel >= uint32(len(m.queues)) {
+		return nil
+	}
+	return &m.queues[m.queueSel]
+}
+
+//interrupt sets bits of the interrupt status and drives the line
+func (m *MMIO) interrupt(bits uint32) {
+	m.interruptStatus |= bits
+	if m.interruptStatus != 0 {
+		m.irq.Raise()
+	} else {
+		m.irq.Lower()
+	}
+}
+
+//fail reports a driver error, the driver has to reset the device
+func (m *MMIO) fail(err error) {
+	if debug {
+		fmt.Println("VIRTIO device needs reset: ", err)
+	}
+	m.status |= statusNeedsReset
+	m.interrupt(interruptConfig)
+}
+
+//notify processes the new available entries of queue q
+func (m *MMIO) notify(q int) {
+	queue := &m.queues[q]
+	if !queue.ready || m.status&statusNeedsReset != 0 {
+		return
+	}
+	avail, err := m.mem.Load(queue.driver, 32)
+	if err != nil {
+		m.fail(err)
+		return
+	}
+	flags, availIdx := uint16(avail), uint16(avail>>16)
+	processed := false
+	for queue.lastAvail != availIdx {
+		head, err := m.mem.Load(queue.driver+4+2*uint64(uint32(queue.lastAvail)%queue.num), 16)
+		if err != nil {
+			m.fail(err)
+			return
+		}
+		c, err := queue.readChain(m.mem, uint16(head))
+		if err != nil {
+			m.fail(err)
+			return
+		}
+		m.dev.process(q, c)
+		elem := queue.device + 4 + 8*uint64(uint32(queue.used)%queue.num)
+		err = m.mem.Store(elem, 64, uint64(c.written)<<32|uint64(c.head))
+		if err == nil {
+			queue.used++
+			err = m.mem.Store(queue.device+2, 16, uint64(queue.used))
+		}
+		if err != nil {
+			m.fail(err)
+			return
+		}
+		queue.lastAvail++
+		processed = true
+	}
+	if processed && flags&availNoInterrupt == 0 {
+		m.interrupt(interruptUsed)
+	}
+}
+
+//Peek reads like Load, the registers have no read side effects
+func (m *MMIO) Peek(addr uint64, size uint64) (uint64, error) {
+	return m.Load(addr, size)
+}
+
+//Load value
+func (m *MMIO) Load(addr uint64, size uint64) (uint64, error) {
+	if debug {
+		fmt.Println("VIRTIO Load addr, size", addr, size)
+	}
+	off := addr - m.base
+	if off >= regConfig {
+		//the configuration space allows any access size
+		config := m.dev.config()
+		var value uint64
+		for i := uint64(0); i < size/8; i++ {
+			if off-regConfig+i < uint64(len(config)) {
+				value |= uint64(config[off-regConfig+i]) << (8 * i)
+			}
+		}
+		return value, nil
+	}
+	if size != 32 {
+		return 0, errors.New("Could not access virtio register with this size")
+	}
+	q := m.queue()
+	switch off {
+	case regMagic:
+		return uint64(magic), nil
+	case regVersion:
+		return uint64(version), nil
+	case regDeviceID:
+		return uint64(m.dev.deviceID()), nil
+	case regVendorID:
+		return uint64(vendor), nil
+	case regDeviceFeatures:
+		features := m.dev.features() | featureVersion1
+		if m.deviceFeaturesSel < 2 {
+			return (features >> (32 * m.deviceFeaturesSel)) & 0xffffffff, nil
+		}
+	case regQueueNumMax:
+		if q != nil {
+			return queueNumMax, nil
+		}
+	case regQueueReady:
+		if q != nil && q.ready {
+			return 1, nil
+		}
+	case regInterruptStatus:
+		return uint64(m.interruptStatus), nil
+	case regStatus:
+		return uint64(m.status), nil
+	case regConfigGeneration:
+		//the configuration never changes
+		return 0, nil
+	}
+	return 0, nil
+}
+
+//Store value
+func (m *MMIO) Store(addr uint64, size uint64, value uint64) error {
+	if debug {
+		fmt.Println("VIRTIO Store addr, size, value ", addr, size, value)
+	}
+	off := addr - m.base
+	if off >= regConfig {
+		//the configuration space is read only
+		return nil
+	}
+	if size != 32 {
+		return errors.New("Could not access virtio register with this size")
+	}
+	v := uint32(value)
+	q := m.queue()
+	switch off {
+	case regDeviceFeaturesSel:
+		m.deviceFeaturesSel = v
+	case regDriverFeatures:
+		if m.driverFeaturesSel < 2 {
+			shift := 32 * m.driverFeaturesSel
+			m.driverFeatures = m.driverFeatures&^(0xffffffff<<shift) | uint64(v)<<shift
+		}
+	case regDriverFeaturesSel:
+		m.driverFeaturesSel = v
+	case regQueueSel:
+		m.queueSel = v
+	case regQueueNum:
+		//the size is a power of two
+		if q != nil && v != 0 && v <= queueNumMax && v&(v-1) == 0 {
+			q.num = v
+		}
+	case regQueueReady:
+		if q != nil {
+			q.ready = v&1 != 0 && q.num != 0
+		}
+	case regQueueNotify:
+		if v < uint32(len(m.queues)) {
+			m.notify(int(v))
+		}
+	case regInterruptACK:
+		m.interruptStatus &^= v
+		m.interrupt(0)
+	case regStatus:
+		if v == 0 {
+			m.reset()
+			break
+		}
+		//the driver may only accept offered features and must accept version 1
+		offered := m.dev.features() | featureVersion1
+		if v&statusFeaturesOK != 0 && (m.driverFeatures&^offered != 0 || m.driverFeatures&featureVersion1 == 0) {
+			v &^= statusFeaturesOK
+		}
+		m.status = v | m.status&statusNeedsReset
+	case regQueueDescLow, regQueueDescHigh, regQueueDriverLow, regQueueDriverHigh, regQueueDeviceLow, regQueueDeviceHigh:
+		if q == nil || q.ready {
+			break
+		}
+		var reg *uint64
+		switch off &^ 0x4 {
+		case regQueueDescLow:
+			reg = &q.desc
+		case regQueueDriverLow:
+			reg = &q.driver
+		default:
+			reg = &q.device
+		}
+		shift := 8 * (off & 0x4)
+		*reg = *reg&^(0xffffffff<<shift) | uint64(v)<<shift
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package virtio
+
+import (
+	"errors"
+	"io"
+	"rvsim/bus"
+)
+
+//Descriptor flags
+const (
+	descNext  uint16 = 1
+	descWrite uint16 = 2
+)
+
+//availNoInterrupt is set by drivers which poll the used ring
+const availNoInterrupt uint16 = 1
+
+//queue is a split virtqueue, its rings are in guest memory
+type queue struct {
+	num   uint32
+	ready bool
+	//desc, driver and device are the addresses of the descriptor table, the
+	//available ring and the used ring
+	desc, driver, device uint64
+	//lastAvail is the next available entry to process, used the next used entry
+	lastAvail uint16
+	used      uint16
+}
+
+//buffer is one descriptor of a chain
+type buffer struct {
+	addr  uint64
+	len   uint32
+	write bool
+}
+
+//chain is a descriptor chain. The device reads the readable buffers and
+//writes the writable ones in order, like a stream.
+type chain struct {
+	mem  bus.Device
+	head uint16
+	bufs []buffer
+	//rpos and wpos are the stream positions of the reader and the writer
+	rpos, wpos uint64
+	written    uint32
+}
+
+//readChain collects the chain starting at descriptor head
+func (q *queue) readChain(mem bus.Device, head uint16) (*chain, error) {
+	c := &chain{mem: mem, head: head}
+	index := head
+	for {
+		if uint32(index) >= q.num || uint32(len(c.bufs)) >= q.num {
+			return nil, errors.New("Could not follow virtqueue descriptor chain")
+		}
+		desc := q.desc + 16*uint64(index)
+		addr, err := mem.Load(desc, 64)
+		if err != nil {
+			return nil, err
+		}
+		meta, err := mem.Load(desc+8, 64)
+		if err != nil {
+			return nil, err
+		}
+		flags := uint16(meta >> 32)
+		c.bufs = append(c.bufs, buffer{addr: addr, len: uint32(meta), write: flags&descWrite != 0})
+		if flags&descNext == 0 {
+			return c, nil
+		}
+		index = uint16(meta >> 48)
+	}
+}
+
+//size returns the number of readable or writable bytes
+func (c *chain) size(write bool) uint64 {
+	var n uint64
+	for _, b := range c.bufs {
+		if b.write == write {
+			n += uint64(b.len)
+		}
+	}
+	return n
+}
+
+//Read copies the next readable bytes of the chain to p
+func (c *chain) Read(p []byte) (int, error) {
+	n, err := c.copy(p, &c.rpos, false)
+	if n == 0 && err == nil {
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+//Write copies p to the next writable bytes of the chain
+func (c *chain) Write(p []byte) (int, error) {
+	n, err := c.copy(p, &c.wpos, true)
+	c.written += uint32(n)
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+//copy moves bytes between p and the buffers of one direction, starting at stream position pos
+func (c *chain) copy(p []byte, pos *uint64, write bool) (int, error) {
+	n := 0
+	start := uint64(0)
+	for _, b := range c.bufs {
+		if b.write != write {
+			continue
+		}
+		end := start + uint64(b.len)
+		if *pos < end && n < len(p) {
+			addr := b.addr + *pos - start
+			count := int(end - *pos)
+			if count > len(p)-n {
+				count = len(p) - n
+			}
+			var err error
+			if write {
+				err = storeBytes(c.mem, addr, p[n:n+count])
+			} else {
+				err = loadBytes(c.mem, addr, p[n:n+count])
+			}
+			if err != nil {
+				return n, err
+			}
+			n += count
+			*pos += uint64(count)
+		}
+		start = end
+	}
+	return n, nil
+}
+
+//loadBytes fills p from guest memory at addr
+func loadBytes(mem bus.Device, addr uint64, p []byte) error {
+	i := 0
+	for ; i+8 <= len(p); i += 8 {
+		value, err := mem.Load(addr+uint64(i), 64)
+		if err != nil {
+			return err
+		}
+		for j := 0; j < 8; j++ {
+			p[i+j] = byte(value >> (8 * uint(j)))
+		}
+	}
+	for ; i < len(p); i++ {
+		value, err := mem.Load(addr+uint64(i), 8)
+		if err != nil {
+			return err
+		}
+		p[i] = byte(value)
+	}
+	return nil
+}
+
+//storeBytes writes p to guest memory at addr
+func storeBytes(mem bus.Device, addr uint64, p []byte) error {
+	i := 0
+	for ; i+8 <= len(p); i += 8 {
+		var value uint64
+		for j := 0; j < 8; j++ {
+			value |= uint64(p[i+j]) << (8 * uint(j))
+		}
+		if err := mem.Store(addr+uint64(i), 64, value); err != nil {
+			return err
+		}
+	}
+	for ; i < len(p); i++ {
+		if err := mem.Store(addr+uint64(i), 8, uint64(p[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}